@@ -0,0 +1,62 @@
+// Command fakeplex runs an in-memory fake of the plex.tv API for local development.
+//
+// Point the auth server at it with PLEX_URL and use the printed owner token as PLEX_TOKEN.
+// The fake is driven through its control API under /__plextest/ (see package plextest).
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex/plextest"
+)
+
+func main() {
+	addr := flag.String("addr", ":8090", "listen address")
+	serverID := flag.String("server-id", "fake-server", "machine identifier of the fake Plex server")
+	owner := flag.String("owner", "owner", "username of the server owner")
+	shared := flag.String("shared", "alice,bob", "comma-separated usernames the server is shared with")
+	home := flag.String("home", "", "comma-separated usernames in the owner's Plex Home")
+	flag.Parse()
+
+	fake := plextest.New()
+	fake.EnableControlAPI()
+
+	nextID := 1
+	addUser := func(username string) int {
+		id := nextID
+		nextID++
+		token := fake.AddUser(plextest.User{ID: id, Username: username, Email: username + "@example.com"})
+		log.Printf("User %s (ID: %d) token: %s", username, id, token)
+		return id
+	}
+
+	ownerID := addUser(*owner)
+	fake.AddServer(plextest.Server{MachineID: *serverID, Name: "Fake Plex Server", OwnerID: ownerID, Online: true})
+
+	for _, username := range splitList(*shared) {
+		fake.Share(*serverID, addUser(username))
+	}
+	for _, username := range splitList(*home) {
+		fake.AddHomeUser(ownerID, addUser(username))
+	}
+
+	log.Printf("Fake Plex server %s owned by %s", *serverID, *owner)
+	log.Printf("Approve logins with: curl -X POST 'http://localhost%s/__plextest/pins/approve?pin=<PIN ID>&user=<USER ID>'", *addr)
+	log.Printf("Starting fake Plex API on %s", *addr)
+	if err := http.ListenAndServe(*addr, fake); err != nil {
+		log.Fatalf("Fake Plex API failed to start: %v", err)
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
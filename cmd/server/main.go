@@ -1,97 +1,271 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/hubert_i/nginx_plex_auth_server/internal/access"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/apikeys"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/admin"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/audit"
 	"github.com/hubert_i/nginx_plex_auth_server/internal/auth"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/clientip"
 	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
 	"github.com/hubert_i/nginx_plex_auth_server/internal/health"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/history"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/notify"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/owner"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/ratelimit"
 	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
 )
 
-func extractTokenFromRequest(r *http.Request) string {
-	// Try Authorization header
-	if auth := r.Header.Get("Authorization"); auth != "" {
-		if len(auth) > 7 && auth[:7] == "Bearer " {
-			return auth[7:]
-		}
-		return auth
-	}
-
-	// Try X-Plex-Token header
-	if token := r.Header.Get("X-Plex-Token"); token != "" {
-		return token
-	}
-
-	// Try cookie
-	if cookie, err := r.Cookie("X-Plex-Token"); err == nil {
-		return cookie.Value
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
 	}
-
-	return ""
 }
 
-func main() {
+// run starts the server and blocks until it fails or is stopped by SIGTERM or SIGINT,
+// stopping the background tasks before returning
+func run() error {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML configuration file")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration (secrets redacted) and exit")
+	flag.Parse()
+
 	// Load configuration
-	cfg, err := config.Load()
+	cfg, err := config.LoadFrom(*configFile)
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	if *printConfig {
+		out, err := cfg.Print()
+		if err != nil {
+			return fmt.Errorf("failed to print configuration: %w", err)
+		}
+		os.Stdout.Write(out)
+		return nil
 	}
 
 	// Create Plex client
-	plexClient := plex.NewClient(cfg.PlexURL, cfg.PlexToken, cfg.PlexClientID)
+	breakerOptions := plex.DefaultBreakerOptions()
+	breakerOptions.ConsecutiveFailures = cfg.PlexBreakerFailures
+	breakerOptions.FailureRate = cfg.PlexBreakerFailureRate
+	breakerOptions.OpenTimeout = cfg.PlexBreakerOpenTimeout
+	breakerOptions.OnStateChange = func(from, to plex.BreakerState) {
+		if to == plex.BreakerOpen {
+			log.Printf("⚠️  Plex API circuit breaker opened (was %s), failing fast for %v", from, cfg.PlexBreakerOpenTimeout)
+		} else {
+			log.Printf("Plex API circuit breaker is now %s (was %s)", to, from)
+		}
+	}
+
+	plexClient := plex.NewClientWithOptions(cfg.PlexURL, cfg.PlexToken, cfg.PlexClientID, plex.Options{
+		RequestTimeout: cfg.PlexRequestTimeout,
+		MaxRetries:     cfg.PlexMaxRetries,
+		RetryBackoff:   cfg.PlexRetryBackoff,
+		Breaker:        breakerOptions,
+	})
 
 	// Validate Plex token at startup
 	log.Println("Validating Plex token...")
-	valid, err := plexClient.ValidateToken(cfg.PlexToken)
-	if err != nil {
-		log.Fatalf("Failed to validate Plex token: %v", err)
+	identity, err := plexClient.Identify(cfg.PlexToken)
+	switch {
+	case err != nil && cfg.StartupMode == "degraded" && (errors.Is(err, plex.ErrUpstreamUnavailable) || errors.Is(err, plex.ErrRateLimited)):
+		// The token monitor keeps retrying, the server is ready once it succeeds
+		log.Printf("⚠️  Plex API unavailable, starting in degraded mode until the owner token is validated: %v", err)
+	case err != nil:
+		return fmt.Errorf("failed to validate Plex token: %w", err)
+	case !identity.Valid:
+		return errors.New("Plex token is invalid, please check your PLEX_TOKEN environment variable")
+	default:
+		log.Println("✓ Plex token validated successfully")
+		log.Printf("✓ Authenticated as: %s (ID: %d)", identity.User.Username, identity.User.ID)
 	}
-	if !valid {
-		log.Fatalf("Plex token is invalid. Please check your PLEX_TOKEN environment variable.")
-	}
-	log.Println("✓ Plex token validated successfully")
-
-	// Verify server access
-	log.Printf("Verifying access to Plex server: %s", cfg.PlexServerID)
-	userInfo, err := plexClient.GetUserInfo(cfg.PlexToken)
-	if err != nil {
-		log.Fatalf("Failed to get user info from Plex token: %v", err)
-	}
-	log.Printf("✓ Authenticated as: %s (ID: %d)", userInfo.Username, userInfo.ID)
 
 	// Initialize token health monitor
-	tokenMonitor := health.NewTokenMonitor(plexClient, cfg.PlexToken, cfg.TokenHealthCheckTTL)
+	tokenMonitor := health.NewTokenMonitor(plexClient, cfg.PlexToken, cfg.PlexServerID, cfg.TokenHealthCheckTTL)
+	tokenMonitor.SetRetryBackoff(cfg.TokenHealthRetryBackoff)
 
 	// Set callback for when token becomes invalid
 	tokenMonitor.SetInvalidTokenCallback(func(err error) {
 		if err != nil {
 			log.Printf("⚠️  ALERT: Token validation failed: %v", err)
 		} else {
-			log.Printf("❌ CRITICAL ALERT: PLEX_TOKEN is INVALID! Update your environment variable immediately!")
+			log.Printf("❌ CRITICAL ALERT: PLEX_TOKEN is INVALID! Rotate it through /admin/api/owner-token or update it immediately!")
 		}
 	})
 
+	// Send notifications when the owner token or Plex state changes
+	notifiers, err := notify.New(cfg.Notifications.Channels)
+	if err != nil {
+		return fmt.Errorf("failed to configure notifications: %w", err)
+	}
+	dispatcher := notify.NewDispatcher(notifiers, cfg.Notifications.ReAlertInterval)
+	defer dispatcher.Wait()
+	if len(notifiers) > 0 {
+		log.Printf("Sending owner token alerts to %d notification channel(s)", len(notifiers))
+		alerter := notify.NewTokenAlerter(dispatcher, cfg.Notifications.UnreachableChecks)
+		tokenMonitor.SetStatusCallback(alerter.Observe)
+	}
+
+	// Audit log of authentication and admin events
+	auditLog, err := audit.NewLogger(cfg.Audit)
+	if err != nil {
+		return fmt.Errorf("failed to open the audit log: %w", err)
+	}
+	defer auditLog.Close()
+	if cfg.Audit.Output != "" {
+		log.Printf("Writing audit events to %s", cfg.Audit.Output)
+	}
+
+	// Shared token cache used by all handlers
+	tokenCache := cache.NewTokenCache(cfg.CacheTTL, cfg.CacheMaxSize)
+	tokenCache.SetStaleGrace(cfg.CacheStaleGrace)
+	// Revoked tokens are refused as long as their session cookie could live
+	tokenCache.SetRevokedTTL(cfg.Sessions.MaxAge)
+	defer tokenCache.Stop()
+
+	// Keep a snapshot of the owner and shared users so access checks don't hit Plex
+	accessList := access.NewRefresher(plexClient, cfg.PlexServerID, cfg.SharedUsersRefreshInterval)
+
+	// Recheck the users with active sessions and revoke the sessions of users who lost access
+	verifier := access.NewVerifier(accessList, tokenCache, cfg.Sessions.VerifyInterval)
+	verifier.SetRevokeCallback(func(revocation access.Revocation) {
+		auditLog.Log(audit.Event{
+			Type:     audit.EventAccess,
+			UserID:   revocation.User.ID,
+			Username: revocation.User.Username,
+			Decision: auth.DecisionRevoked,
+			Reason:   fmt.Sprintf("lost access to the Plex server, revoked %d session(s)", revocation.Sessions),
+		})
+	})
+
+	// Drop cached decisions and revocations of users who gained access, revoke the sessions of users who lost it
+	accessList.SetChangeCallback(func(change access.Change) {
+		for _, user := range change.Added {
+			if removed := tokenCache.InvalidateUser(user.ID); removed > 0 {
+				log.Printf("Invalidated %d cached token(s) of %s after access change", removed, user.Username)
+			}
+			if cleared := tokenCache.ClearUserRevocations(user.ID); cleared > 0 {
+				log.Printf("Accepting %d revoked token(s) of %s again after regaining access", cleared, user.Username)
+			}
+		}
+		for _, user := range change.Removed {
+			verifier.Revoke(user)
+		}
+	})
+
+	// Rotate the owner token at runtime through the admin API or its secret file
+	rotator := owner.NewRotator(plexClient, cfg.PlexServerID, tokenMonitor, accessList, tokenCache)
+	defer rotator.Stop()
+
+	// Pick up a rotated token from its secret file when the current one becomes invalid
+	if cfg.PlexTokenFile != "" {
+		tokenMonitor.SetTokenReloader(func() bool {
+			return rotator.RotateFromFile(cfg.PlexTokenFile)
+		})
+	}
+
 	// Start the monitor
 	tokenMonitor.Start()
 	defer tokenMonitor.Stop()
 
+	accessList.Start()
+	defer accessList.Stop()
+
+	if cfg.Sessions.VerifyInterval > 0 {
+		verifier.Start()
+		defer verifier.Stop()
+	}
+
+	if cfg.PlexTokenWatchInterval > 0 {
+		rotator.WatchFile(cfg.PlexTokenFile, cfg.PlexTokenWatchInterval)
+	}
+
+	// Last-seen times and login history of the users, fed by the audit events
+	userHistory, err := history.NewStore(cfg.History.File, cfg.History.Retention, cfg.History.MaxLogins, cfg.History.FlushInterval)
+	if err != nil {
+		return fmt.Errorf("failed to load the user history: %w", err)
+	}
+	auditLog.SetEventCallback(userHistory.Observe)
+	userHistory.Start()
+	defer userHistory.Stop()
+
+	// Rate limits of the endpoints calling plex.tv
+	guard := ratelimit.NewGuard(cfg.RateLimit)
+	guard.Start()
+	defer guard.Stop()
+
+	// API keys of scripts and services, from the configuration and the admin API
+	apiKeys, err := apikeys.NewStore(cfg.APIKeysFile, cfg.APIKeys)
+	if err != nil {
+		return fmt.Errorf("failed to load the API keys: %w", err)
+	}
+
+	// Session cookies, signed with the session secret
+	sessions := auth.NewSessions(cfg)
+	if cfg.Sessions.Secret == "" {
+		log.Println("No session secret configured (SESSION_SECRET), using a key derived from the owner token: sessions end when it changes")
+	}
+	// A rotated owner token derives a new key, unless a session secret is configured
+	rotator.SetRotateCallback(sessions.SetOwnerToken)
+
 	// Create handlers
-	authHandler := auth.NewHandler(cfg)
-	oauthHandler := auth.NewOAuthHandler(cfg, plexClient)
-	healthHandler := health.NewHandler(tokenMonitor)
+	authHandler := auth.NewHandler(cfg, plexClient, tokenCache, accessList, auditLog, guard, apiKeys, sessions)
+	oauthHandler := auth.NewOAuthHandler(cfg, plexClient, tokenCache, accessList, auditLog, sessions)
+
+	reloader := config.NewReloader(*configFile, cfg)
+
+	// Checks reported by /readyz and /health/detailed
+	checks := health.NewRegistry(cfg.HealthCheckTimeout)
+	checks.Register("owner_token", health.TokenCheck(tokenMonitor))
+	checks.Register("plex", health.PlexCheck(plexClient))
+	checks.Register("cache", health.CacheCheck(tokenCache))
+	checks.Register("config", health.ConfigCheck(reloader))
+	checks.SetReadinessChecks(cfg.ReadinessChecks)
+
+	// Apply reloaded policies, identity headers, cache settings, readiness checks and API keys
+	reloader.SetReloadCallback(func(old, new *config.Config) {
+		authHandler.ApplyConfig(new)
+		apiKeys.SetConfigKeys(new.APIKeys)
+		tokenCache.SetTTL(new.CacheTTL)
+		tokenCache.SetMaxSize(new.CacheMaxSize)
+		tokenCache.SetStaleGrace(new.CacheStaleGrace)
+		checks.SetReadinessChecks(new.ReadinessChecks)
+	})
+	reloader.Start()
+	defer reloader.Stop()
+
+	// Reload the configuration on SIGHUP
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	go func() {
+		for range hangup {
+			reloader.Reload("SIGHUP")
+		}
+	}()
+
+	healthHandler := health.NewHandler(checks, tokenMonitor, plexClient, reloader)
+	adminHandler := admin.NewHandler(cfg, plexClient, accessList, tokenMonitor, rotator, tokenCache, reloader, authHandler.Decisions(), auditLog, userHistory, apiKeys, guard, sessions)
 
 	// Setup routes
 	// Auth endpoint for Nginx auth_request (returns status codes only)
 	http.HandleFunc("/auth", authHandler.HandleAuth)
 
 	// OAuth flow endpoints
-	http.HandleFunc("/login", oauthHandler.HandleLogin)
+	http.HandleFunc("/login", guard.Limit(ratelimit.EndpointLogin, oauthHandler.HandleLogin))
 	http.HandleFunc("/auth/plex", oauthHandler.HandlePlexAuth)
-	http.HandleFunc("/callback", oauthHandler.HandleCallback)
+	http.HandleFunc("/callback", guard.Limit(ratelimit.EndpointCallback, oauthHandler.HandleCallback))
 	http.HandleFunc("/logout", oauthHandler.HandleLogout)
 
 	// Status endpoint
@@ -99,8 +273,28 @@ func main() {
 
 	// Health check endpoints
 	http.HandleFunc("/health", healthHandler.HandleHealthCheck)
+	http.HandleFunc("/livez", healthHandler.HandleLiveness)
+	http.HandleFunc("/readyz", healthHandler.HandleReadiness)
 	http.HandleFunc("/health/token", healthHandler.HandleTokenHealth)
 	http.HandleFunc("/health/detailed", healthHandler.HandleDetailedHealth)
+	http.HandleFunc("/metrics", healthHandler.HandleMetrics)
+
+	// Admin API (server owner or admin API key)
+	http.HandleFunc("/admin/api/owner-token", adminHandler.HandleOwnerToken)
+	http.HandleFunc("/admin/api/sessions", adminHandler.HandleSessions)
+	http.HandleFunc("/admin/api/cache", adminHandler.HandleCache)
+	http.HandleFunc("/admin/api/shared-users", adminHandler.HandleSharedUsers)
+	http.HandleFunc("/admin/api/shared-users/refresh", adminHandler.HandleSharedUsersRefresh)
+	http.HandleFunc("/admin/api/policy", adminHandler.HandlePolicy)
+	http.HandleFunc("/admin/api/decisions", adminHandler.HandleDecisions)
+	http.HandleFunc("/admin/api/audit", adminHandler.HandleAudit)
+	http.HandleFunc("/admin/api/history", adminHandler.HandleHistory)
+	http.HandleFunc("/admin/api/keys", adminHandler.HandleAPIKeys)
+	http.HandleFunc("/admin/api/config/reload", adminHandler.HandleConfigReload)
+
+	// Admin dashboard (server owner only)
+	http.HandleFunc("/admin/", adminHandler.HandleDashboard)
+	http.HandleFunc("/admin/actions", adminHandler.HandleDashboardAction)
 
 	// Root endpoint - show welcome page
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -110,7 +304,7 @@ func main() {
 			return
 		}
 
-		token := extractTokenFromRequest(r)
+		token := auth.ExtractToken(r, cfg.Sessions.CookieName)
 		if token == "" {
 			// Not logged in - show login prompt
 							w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -160,15 +354,10 @@ func main() {
 			`))
 		} else {
 			// Logged in - show status
-			valid, _ := plexClient.ValidateToken(token)
-			if valid {
-				hasAccess, _ := plexClient.CheckServerAccess(token, cfg.PlexServerID)
-				userInfo, _ := plexClient.GetUserInfo(token)
-
-				username := "Unknown"
-				if userInfo != nil {
-					username = userInfo.Username
-				}
+			identity, _ := plexClient.IdentifyContext(r.Context(), token)
+			if identity != nil && identity.Valid {
+				hasAccess, _ := accessList.CheckAccess(r.Context(), identity.User.ID)
+				username := identity.User.Username
 
 				w.Header().Set("Content-Type", "text/html; charset=utf-8")
 				w.Write([]byte(fmt.Sprintf(`
@@ -232,14 +421,49 @@ func main() {
 		}
 	})
 
+	// Handlers get the client IP forwarded by the trusted proxies from clientip.FromRequest
+	server := &http.Server{
+		Addr:              cfg.ServerAddr,
+		Handler:           clientip.NewResolver(cfg.TrustedProxies).Middleware(http.DefaultServeMux),
+		ReadHeaderTimeout: cfg.ServerReadHeaderTimeout,
+		ReadTimeout:       cfg.ServerReadTimeout,
+		WriteTimeout:      cfg.ServerWriteTimeout,
+		IdleTimeout:       cfg.ServerIdleTimeout,
+	}
+
+	// Stop on SIGTERM (docker stop, Kubernetes) or SIGINT (Ctrl+C)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Start server
-	addr := os.Getenv("SERVER_ADDR")
-	if addr == "" {
-		addr = ":8080"
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Starting Nginx auth server on %s", cfg.ServerAddr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return fmt.Errorf("server failed to start: %w", err)
+	case <-ctx.Done():
+		stop()
 	}
 
-	log.Printf("Starting Nginx auth server on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	// Stop accepting connections and wait for in-flight requests
+	log.Printf("Shutting down, draining in-flight requests (timeout: %v)...", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("⚠️  Shutdown timed out, closing remaining connections: %v", err)
+		server.Close()
 	}
+
+	breakerStats := plexClient.BreakerStats()
+	reloadStats := reloader.Stats()
+	log.Printf("Final stats: %d cached token(s), Plex circuit breaker %s (opened %d time(s), rejected %d request(s)), %d config reload(s)",
+		tokenCache.Size(), breakerStats.State, breakerStats.Opens, breakerStats.Rejected, reloadStats.Reloads)
+	log.Println("Server stopped, stopping background tasks")
+
+	return nil
 }
@@ -0,0 +1,285 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
+)
+
+// minOnDemandRefreshInterval limits how often an unknown user can trigger a refresh
+const minOnDemandRefreshInterval = 30 * time.Second
+
+// Snapshot is a point-in-time view of the users allowed on the Plex server
+type Snapshot struct {
+	Owner       plex.UserInfo
+	SharedUsers map[int]plex.SharedUser
+	// HomeUsers are the members of the owner's Plex Home, except the owner
+	HomeUsers   map[int]plex.SharedUser
+	RefreshedAt time.Time
+}
+
+// HasAccess returns true if the user is the server owner, a shared user or a member
+// of the owner's Plex Home
+func (s *Snapshot) HasAccess(userID int) bool {
+	if userID == s.Owner.ID {
+		return true
+	}
+	if _, shared := s.SharedUsers[userID]; shared {
+		return true
+	}
+	_, home := s.HomeUsers[userID]
+	return home
+}
+
+// members returns the shared users and the members of the Plex Home
+func (s *Snapshot) members() map[int]plex.SharedUser {
+	members := make(map[int]plex.SharedUser, len(s.SharedUsers)+len(s.HomeUsers))
+	for id, user := range s.HomeUsers {
+		members[id] = user
+	}
+	for id, user := range s.SharedUsers {
+		members[id] = user
+	}
+	return members
+}
+
+// Change describes the users that gained or lost access between two snapshots
+type Change struct {
+	Added   []plex.SharedUser
+	Removed []plex.SharedUser
+}
+
+// Refresher keeps a background-refreshed snapshot of the owner identity, of the
+// users the Plex server is shared with and of the members of the owner's Plex Home
+type Refresher struct {
+	plexClient      *plex.Client
+	serverID        string
+	refreshInterval time.Duration
+	snapshot        *Snapshot
+	snapshotMu      sync.RWMutex
+	refreshMu       sync.Mutex
+	stopChan        chan struct{}
+	onChange        func(Change)
+	// emptySince is when refreshes started returning no users while the snapshot had
+	// some, they are only believed once confirmed by a later refresh
+	emptySince time.Time
+}
+
+// NewRefresher creates a new shared users refresher
+func NewRefresher(client *plex.Client, serverID string, refreshInterval time.Duration) *Refresher {
+	return &Refresher{
+		plexClient:      client,
+		serverID:        serverID,
+		refreshInterval: refreshInterval,
+		stopChan:        make(chan struct{}),
+	}
+}
+
+// SetChangeCallback sets a callback function that will be called when users gain or lose access
+func (r *Refresher) SetChangeCallback(callback func(Change)) {
+	r.onChange = callback
+}
+
+// Start performs an initial refresh and begins the periodic refreshes
+func (r *Refresher) Start() {
+	log.Printf("Starting shared users refresher (refresh interval: %v)", r.refreshInterval)
+
+	if err := r.Refresh(context.Background()); err != nil {
+		log.Printf("⚠️  Initial shared users refresh failed: %v", err)
+	}
+
+	ticker := time.NewTicker(r.refreshInterval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.Refresh(context.Background()); err != nil {
+					log.Printf("⚠️  Shared users refresh failed: %v", err)
+				}
+			case <-r.stopChan:
+				ticker.Stop()
+				log.Println("Shared users refresher stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic refreshes
+func (r *Refresher) Stop() {
+	close(r.stopChan)
+}
+
+// Snapshot returns the latest snapshot, or nil if no refresh succeeded yet
+func (r *Refresher) Snapshot() *Snapshot {
+	r.snapshotMu.RLock()
+	defer r.snapshotMu.RUnlock()
+	return r.snapshot
+}
+
+// Refresh fetches the owner identity and shared users from Plex and replaces the snapshot
+func (r *Refresher) Refresh(ctx context.Context) error {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+	return r.refresh(ctx)
+}
+
+// CheckAccess returns true if the user has access to the Plex server.
+// Unknown users trigger an on-demand refresh so newly shared users
+// don't have to wait for the next periodic refresh.
+func (r *Refresher) CheckAccess(ctx context.Context, userID int) (bool, error) {
+	snapshot := r.Snapshot()
+	if snapshot != nil && snapshot.HasAccess(userID) {
+		return true, nil
+	}
+
+	if err := r.refreshIfOlderThan(ctx, minOnDemandRefreshInterval); err != nil {
+		if snapshot == nil {
+			return false, err
+		}
+		log.Printf("⚠️  On-demand shared users refresh failed, using previous snapshot: %v", err)
+	}
+
+	return r.Snapshot().HasAccess(userID), nil
+}
+
+// refreshIfOlderThan refreshes the snapshot unless it was refreshed within maxAge
+func (r *Refresher) refreshIfOlderThan(ctx context.Context, maxAge time.Duration) error {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+
+	// Another request may have refreshed while we were waiting for the lock
+	if snapshot := r.Snapshot(); snapshot != nil && time.Since(snapshot.RefreshedAt) < maxAge {
+		return nil
+	}
+
+	return r.refresh(ctx)
+}
+
+// refresh replaces the snapshot
+// Must be called with refreshMu held
+func (r *Refresher) refresh(ctx context.Context) error {
+	owner, err := r.plexClient.GetOwnerInfoContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Once loaded, the snapshot is only replaced by plausible answers: losing every
+	// shared user to a transient error of plex.tv would revoke all their sessions
+	previous := r.Snapshot()
+
+	users, err := r.plexClient.GetSharedUsersContext(ctx, r.serverID)
+	if errors.Is(err, plex.ErrServerNotFound) {
+		if previous != nil {
+			return fmt.Errorf("plex server %s not found, keeping the previous snapshot (check PLEX_SERVER_ID): %w", r.serverID, err)
+		}
+		log.Printf("⚠️  Plex server %s not found, only the owner has access. Please check PLEX_SERVER_ID!", r.serverID)
+	} else if err != nil {
+		return err
+	}
+
+	homeUsers, err := r.plexClient.GetHomeUsersContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	snapshot := &Snapshot{
+		Owner:       *owner,
+		SharedUsers: make(map[int]plex.SharedUser, len(users)),
+		HomeUsers:   make(map[int]plex.SharedUser, len(homeUsers)),
+		RefreshedAt: time.Now(),
+	}
+	for _, user := range users {
+		snapshot.SharedUsers[user.ID] = user
+	}
+	for _, user := range homeUsers {
+		if user.ID == owner.ID {
+			continue
+		}
+		username := user.Username
+		if username == "" {
+			username = user.Title
+		}
+		snapshot.HomeUsers[user.ID] = plex.SharedUser{ID: user.ID, Username: username, Email: user.Email}
+	}
+
+	if previous != nil && len(previous.members()) > 0 && len(snapshot.members()) == 0 {
+		if r.emptySince.IsZero() {
+			r.emptySince = time.Now()
+		}
+		if time.Since(r.emptySince) < minOnDemandRefreshInterval {
+			return fmt.Errorf("plex returned no shared or home users, keeping the previous snapshot until a refresh confirms it in %v", minOnDemandRefreshInterval)
+		}
+	}
+	r.emptySince = time.Time{}
+
+	r.snapshotMu.Lock()
+	r.snapshot = snapshot
+	r.snapshotMu.Unlock()
+
+	if previous == nil {
+		log.Printf("✓ Loaded shared users snapshot (owner: %s, shared users: %d, home users: %d)", owner.Username, len(snapshot.SharedUsers), len(snapshot.HomeUsers))
+		return nil
+	}
+
+	change := diff(previous, snapshot)
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return nil
+	}
+
+	for _, user := range change.Added {
+		log.Printf("Shared users: %s (ID: %d) gained access", user.Username, user.ID)
+	}
+	for _, user := range change.Removed {
+		log.Printf("Shared users: %s (ID: %d) lost access", user.Username, user.ID)
+	}
+
+	if r.onChange != nil {
+		r.onChange(change)
+	}
+
+	return nil
+}
+
+// diff computes the users that gained or lost access between two snapshots.
+// An owner change is reported as the old owner being removed and the new one added.
+func diff(previous, current *Snapshot) Change {
+	var change Change
+
+	for id, user := range current.members() {
+		if !previous.HasAccess(id) {
+			change.Added = append(change.Added, user)
+		}
+	}
+	for id, user := range previous.members() {
+		if !current.HasAccess(id) {
+			change.Removed = append(change.Removed, user)
+		}
+	}
+
+	if previous.Owner.ID != current.Owner.ID {
+		oldOwner := ownerAsSharedUser(previous.Owner)
+		newOwner := ownerAsSharedUser(current.Owner)
+		if !current.HasAccess(oldOwner.ID) {
+			change.Removed = append(change.Removed, oldOwner)
+		}
+		if !previous.HasAccess(newOwner.ID) {
+			change.Added = append(change.Added, newOwner)
+		}
+	}
+
+	return change
+}
+
+func ownerAsSharedUser(owner plex.UserInfo) plex.SharedUser {
+	return plex.SharedUser{
+		ID:       owner.ID,
+		Username: owner.Username,
+		Email:    owner.Email,
+	}
+}
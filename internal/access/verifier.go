@@ -0,0 +1,111 @@
+package access
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
+)
+
+// Revocation describes the sessions of a user revoked after losing access
+type Revocation struct {
+	User plex.SharedUser
+	// Sessions is the number of revoked tokens
+	Sessions int
+}
+
+// Verifier periodically checks the users with active sessions against a fresh
+// snapshot, so users who lost access are logged out without waiting for their
+// cached decisions or session cookies to expire
+type Verifier struct {
+	refresher  *Refresher
+	tokenCache *cache.TokenCache
+	interval   time.Duration
+	stopChan   chan struct{}
+	onRevoke   func(Revocation)
+}
+
+// NewVerifier creates a new session access verifier
+func NewVerifier(refresher *Refresher, tokenCache *cache.TokenCache, interval time.Duration) *Verifier {
+	return &Verifier{
+		refresher:  refresher,
+		tokenCache: tokenCache,
+		interval:   interval,
+		stopChan:   make(chan struct{}),
+	}
+}
+
+// SetRevokeCallback sets a callback function that will be called when the sessions of a user are revoked
+func (v *Verifier) SetRevokeCallback(callback func(Revocation)) {
+	v.onRevoke = callback
+}
+
+// Start begins the periodic verifications
+func (v *Verifier) Start() {
+	log.Printf("Starting session access verifier (interval: %v)", v.interval)
+
+	ticker := time.NewTicker(v.interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := v.Verify(context.Background()); err != nil {
+					log.Printf("⚠️  Session access verification failed, keeping sessions: %v", err)
+				}
+			case <-v.stopChan:
+				ticker.Stop()
+				log.Println("Session access verifier stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic verifications
+func (v *Verifier) Stop() {
+	close(v.stopChan)
+}
+
+// Verify refreshes the snapshot unless it was just refreshed and revokes the
+// sessions of the users who are no longer the owner, shared users or members
+// of the owner's Plex Home. Nothing is revoked if the refresh fails.
+func (v *Verifier) Verify(ctx context.Context) error {
+	users := make(map[int]plex.SharedUser)
+	for _, session := range v.tokenCache.Sessions() {
+		if session.UserID != 0 && session.HasAccess {
+			users[session.UserID] = plex.SharedUser{ID: session.UserID, Username: session.Username, Email: session.Email}
+		}
+	}
+	if len(users) == 0 {
+		return nil
+	}
+
+	if err := v.refresher.refreshIfOlderThan(ctx, minOnDemandRefreshInterval); err != nil {
+		return err
+	}
+
+	snapshot := v.refresher.Snapshot()
+	for id, user := range users {
+		if !snapshot.HasAccess(id) {
+			v.Revoke(user)
+		}
+	}
+	return nil
+}
+
+// Revoke revokes the cached tokens of a user who lost access, they are refused
+// until the user logs in again. It returns the number of revoked tokens.
+func (v *Verifier) Revoke(user plex.SharedUser) int {
+	revoked := v.tokenCache.RevokeUser(user.ID)
+	if revoked == 0 {
+		return 0
+	}
+
+	log.Printf("Revoked %d session(s) of %s (ID: %d) after losing access to the Plex server", revoked, user.Username, user.ID)
+	if v.onRevoke != nil {
+		v.onRevoke(Revocation{User: user, Sessions: revoked})
+	}
+	return revoked
+}
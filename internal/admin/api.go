@@ -0,0 +1,431 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/apikeys"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/audit"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/auth"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/policy"
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
+)
+
+// HandleSessions lists the cached sessions (GET) or revokes them (DELETE).
+// GET accepts ?user_id= to list the sessions of a user. DELETE expects ?user_id=
+// to revoke every session of a user or ?id= to revoke a single session.
+// Revoked tokens are refused until their user logs in again.
+func (h *Handler) HandleSessions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	actor, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	userID := 0
+	if value := query.Get("user_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil || id <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid user_id")
+			return
+		}
+		userID = id
+	}
+
+	if r.Method == http.MethodGet {
+		sessions := []cache.Session{}
+		for _, session := range h.tokenCache.Sessions() {
+			if userID == 0 || session.UserID == userID {
+				sessions = append(sessions, session)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": sessions})
+		return
+	}
+
+	switch id := query.Get("id"); {
+	case userID != 0:
+		revoked := h.tokenCache.RevokeUser(userID)
+		log.Printf("Revoked %d session(s) of user %d (by %s)", revoked, userID, actor)
+		h.audit(r, actor, "revoke_user", auth.DecisionSuccess, fmt.Sprintf("revoked %d session(s) of user %d", revoked, userID))
+		writeJSON(w, http.StatusOK, map[string]int{"revoked": revoked})
+	case id != "":
+		if !h.tokenCache.RevokeSession(id) {
+			writeError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		log.Printf("Revoked session %s (by %s)", id, actor)
+		h.audit(r, actor, "revoke_session", auth.DecisionSuccess, "revoked session "+id)
+		writeJSON(w, http.StatusOK, map[string]int{"revoked": 1})
+	default:
+		writeError(w, http.StatusBadRequest, "expected a user_id or id parameter")
+	}
+}
+
+// HandleCache returns the cache statistics (GET) or drops every cached decision (DELETE).
+// Flushing doesn't log users out, their tokens are validated with Plex again.
+func (h *Handler) HandleCache(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	actor, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, h.tokenCache.Stats())
+		return
+	}
+
+	removed := h.tokenCache.Clear()
+	log.Printf("Token cache flushed, %d entries removed (by %s)", removed, actor)
+	h.audit(r, actor, "flush_cache", auth.DecisionSuccess, fmt.Sprintf("%d entries removed", removed))
+	writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+}
+
+// HandleSharedUsers returns the snapshot of the owner, shared users and Plex Home users
+func (h *Handler) HandleSharedUsers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.sharedUsers())
+}
+
+// HandleSharedUsersRefresh refreshes the snapshot of the owner and shared users now.
+// Cached decisions of users who gained or lost access are dropped.
+func (h *Handler) HandleSharedUsersRefresh(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	actor, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.accessList.Refresh(r.Context()); err != nil {
+		log.Printf("Shared users refresh requested by %s failed: %v", actor, err)
+		h.audit(r, actor, "refresh_users", auth.DecisionFailure, err.Error())
+		writeError(w, http.StatusServiceUnavailable, "failed to refresh the shared users: "+err.Error())
+		return
+	}
+	log.Printf("Shared users refreshed (by %s)", actor)
+	h.audit(r, actor, "refresh_users", auth.DecisionSuccess, "")
+
+	writeJSON(w, http.StatusOK, h.sharedUsers())
+}
+
+// sharedUsers describes the current snapshot of the owner, shared users and Plex Home users
+func (h *Handler) sharedUsers() map[string]interface{} {
+	snapshot := h.accessList.Snapshot()
+	if snapshot == nil {
+		return map[string]interface{}{"loaded": false, "shared_users": []plex.SharedUser{}, "home_users": []plex.SharedUser{}}
+	}
+
+	return map[string]interface{}{
+		"loaded":       true,
+		"owner":        snapshot.Owner,
+		"shared_users": sortedUsers(snapshot.SharedUsers),
+		"home_users":   sortedUsers(snapshot.HomeUsers),
+		"refreshed_at": snapshot.RefreshedAt,
+	}
+}
+
+// sortedUsers returns the users sorted by username
+func sortedUsers(byID map[int]plex.SharedUser) []plex.SharedUser {
+	users := make([]plex.SharedUser, 0, len(byID))
+	for _, user := range byID {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return strings.ToLower(users[i].Username) < strings.ToLower(users[j].Username)
+	})
+	return users
+}
+
+// HandlePolicy returns the policy rules and identity headers in effect, including
+// reloaded changes. With ?user= or ?ip=, and optionally ?host= and ?path=, it also
+// returns the decision for that user, given as a username, email or account ID,
+// and that client IP.
+func (h *Handler) HandlePolicy(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	cfg := h.reloader.Current()
+	policies := cfg.Policies
+	if policies == nil {
+		policies = []config.PolicyRule{}
+	}
+	response := map[string]interface{}{
+		"policies": policies,
+		"headers":  cfg.Headers,
+	}
+
+	query := r.URL.Query()
+	if user, ip := query.Get("user"), query.Get("ip"); user != "" || ip != "" {
+		req := h.policyRequest(user)
+		req.ClientIP = ip
+		req.Host = query.Get("host")
+		// Cleaned like the original path of /auth requests
+		req.Path = path.Clean("/" + query.Get("path"))
+
+		decision := policy.NewEngine(cfg.Policies).Evaluate(req)
+		response["decision"] = map[string]interface{}{
+			"host":      req.Host,
+			"path":      req.Path,
+			"client_ip": req.ClientIP,
+			"user_id":   req.UserID,
+			"username":  req.Username,
+			"allowed":   decision.Allowed,
+			"bypass":    decision.Bypass,
+			"rule":      decision.Rule,
+			"reason":    decision.Reason,
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// policyRequest identifies a user of the shared users snapshot by username, email or ID.
+// Unknown users are evaluated by the given name only.
+func (h *Handler) policyRequest(user string) policy.Request {
+	req := policy.Request{Username: user}
+
+	snapshot := h.accessList.Snapshot()
+	if snapshot == nil || user == "" {
+		return req
+	}
+
+	id, _ := strconv.Atoi(user)
+	matches := func(candidate plex.SharedUser) bool {
+		return candidate.ID == id || strings.EqualFold(candidate.Username, user) || strings.EqualFold(candidate.Email, user)
+	}
+
+	owner := plex.SharedUser(snapshot.Owner)
+	if matches(owner) {
+		return policy.Request{UserID: owner.ID, Username: owner.Username, Email: owner.Email}
+	}
+	for _, users := range []map[int]plex.SharedUser{snapshot.SharedUsers, snapshot.HomeUsers} {
+		for _, member := range users {
+			if matches(member) {
+				return policy.Request{UserID: member.ID, Username: member.Username, Email: member.Email}
+			}
+		}
+	}
+	return req
+}
+
+// allowMethods writes a 405 response unless the request uses one of the methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+// HandleDecisions returns the recent /auth decisions, most recent first
+func (h *Handler) HandleDecisions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"decisions": h.decisions.Recent()})
+}
+
+// HandleHistory returns the last-seen times and login history of the users, most
+// recently seen first, or of a single user with ?user_id=
+func (h *Handler) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	if value := r.URL.Query().Get("user_id"); value != "" {
+		userID, err := strconv.Atoi(value)
+		if err != nil || userID <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid user_id")
+			return
+		}
+		user, found := h.history.User(userID)
+		if !found {
+			writeError(w, http.StatusNotFound, "no history for this user")
+			return
+		}
+		writeJSON(w, http.StatusOK, user)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"users": h.history.Users(),
+		"stats": h.history.Stats(),
+	})
+}
+
+// HandleConfigReload reloads the configuration file and environment, like SIGHUP
+func (h *Handler) HandleConfigReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	actor, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.reloader.Reload("admin API (" + actor + ")"); err != nil {
+		h.audit(r, actor, "reload_config", auth.DecisionFailure, err.Error())
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":  err.Error(),
+			"reload": h.reloader.Stats(),
+		})
+		return
+	}
+	h.audit(r, actor, "reload_config", auth.DecisionSuccess, "")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"reload": h.reloader.Stats()})
+}
+
+// HandleAPIKeys lists the API keys of scripts and services (GET), creates one (POST)
+// or deletes one created through the admin API (DELETE with ?name=). POST expects a
+// JSON body such as {"name": "backup", "hosts": ["files.example.com"], "paths": ["/api/"],
+// "expires_at": "2027-01-01T00:00:00Z"} and returns the key, which is only shown once.
+func (h *Handler) HandleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	actor, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": h.apiKeys.List()})
+
+	case http.MethodPost:
+		var body struct {
+			Name      string    `json:"name"`
+			Hosts     []string  `json:"hosts"`
+			Paths     []string  `json:"paths"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16384)).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "expected a JSON body with a name, hosts, paths and expires_at")
+			return
+		}
+		if errs := config.ValidateAPIKey(body.Name, body.Hosts, body.Paths); len(errs) > 0 {
+			writeError(w, http.StatusBadRequest, errors.Join(errs...).Error())
+			return
+		}
+		if !body.ExpiresAt.IsZero() && body.ExpiresAt.Before(time.Now()) {
+			writeError(w, http.StatusBadRequest, "expires_at is in the past")
+			return
+		}
+
+		raw, key, err := h.apiKeys.Create(body.Name, body.Hosts, body.Paths, body.ExpiresAt)
+		switch {
+		case errors.Is(err, apikeys.ErrKeyExists):
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		case err != nil:
+			log.Printf("Failed to create API key %s: %v", body.Name, err)
+			h.audit(r, actor, "create_api_key", auth.DecisionFailure, err.Error())
+			writeError(w, http.StatusInternalServerError, "failed to create the API key")
+			return
+		}
+		log.Printf("API key %s created (by %s)", key.Name, actor)
+		h.audit(r, actor, "create_api_key", auth.DecisionSuccess, "created API key "+key.Name)
+		key.Hash = ""
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"key": raw, "api_key": key})
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			writeError(w, http.StatusBadRequest, "expected a name parameter")
+			return
+		}
+		err := h.apiKeys.Delete(name)
+		switch {
+		case errors.Is(err, apikeys.ErrUnknownKey):
+			writeError(w, http.StatusNotFound, "API key not found")
+			return
+		case errors.Is(err, apikeys.ErrConfigKey):
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		case err != nil:
+			log.Printf("Failed to delete API key %s: %v", name, err)
+			h.audit(r, actor, "delete_api_key", auth.DecisionFailure, err.Error())
+			writeError(w, http.StatusInternalServerError, "failed to delete the API key")
+			return
+		}
+		log.Printf("API key %s deleted (by %s)", name, actor)
+		h.audit(r, actor, "delete_api_key", auth.DecisionSuccess, "deleted API key "+name)
+		writeJSON(w, http.StatusOK, map[string]int{"deleted": 1})
+	}
+}
+
+// HandleAudit returns the recent audit events, most recent first. It accepts
+// ?type= (auth, login, logout or admin), ?user= (username, account ID or API key name),
+// ?decision=, ?since= (RFC 3339 time) and ?limit= (100 by default) filters.
+func (h *Handler) HandleAudit(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := audit.Query{
+		Type:     audit.EventType(query.Get("type")),
+		User:     query.Get("user"),
+		Decision: query.Get("decision"),
+		Limit:    100,
+	}
+	if value := query.Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid since, expected an RFC 3339 time")
+			return
+		}
+		filter.Since = since
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		filter.Limit = limit
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": h.auditLog.Query(filter)})
+}
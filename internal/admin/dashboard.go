@@ -0,0 +1,280 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/access"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/auth"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/health"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/history"
+)
+
+// dashboardData is rendered by the dashboard template
+type dashboardData struct {
+	Actor            string
+	CSRF             string
+	Notice           string
+	Error            string
+	Token            health.TokenStatus
+	Reload           config.ReloadStats
+	Cache            cache.Stats
+	Sessions         []cache.Session
+	Decisions        []auth.DecisionRecord
+	Users            []dashboardUser
+	UsersLoaded      bool
+	UsersRefreshedAt time.Time
+	History          history.Stats
+}
+
+// dashboardUser is a user of the shared users snapshot, seen in the sessions or in the history
+type dashboardUser struct {
+	ID       int
+	Username string
+	Email    string
+	// Access is "owner", "shared", "home" or "none" for users seen without server access
+	Access    string
+	Sessions  int
+	LastSeen  time.Time
+	LastLogin time.Time
+	LastIP    string
+	// Hosts are the hosts the user accessed, most recent first
+	Hosts []string
+}
+
+// HandleDashboard shows the admin dashboard to the server owner.
+// Visitors without a session are sent to the login page.
+func (h *Handler) HandleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin" && r.URL.Path != "/admin/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	actor, credential, failure := h.authenticate(w, r)
+	if failure != nil {
+		h.dashboardAuthError(w, r, failure)
+		return
+	}
+
+	snapshot := h.accessList.Snapshot()
+	data := dashboardData{
+		Actor:     actor,
+		CSRF:      h.sessions.CSRFToken(credential),
+		Notice:    r.URL.Query().Get("notice"),
+		Error:     r.URL.Query().Get("error"),
+		Token:     h.tokenMonitor.GetStatus(),
+		Reload:    h.reloader.Stats(),
+		Cache:     h.tokenCache.Stats(),
+		Sessions:  h.tokenCache.Sessions(),
+		Decisions: h.decisions.Recent(),
+	}
+	data.Users = dashboardUsers(snapshot, data.Sessions, h.history.Users())
+	data.History = h.history.Stats()
+	if snapshot != nil {
+		data.UsersLoaded = true
+		data.UsersRefreshedAt = snapshot.RefreshedAt
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		log.Printf("Error rendering admin dashboard: %v", err)
+	}
+}
+
+// HandleDashboardAction runs the action of a dashboard button and redirects back to the dashboard
+func (h *Handler) HandleDashboardAction(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	actor, credential, failure := h.authenticate(w, r)
+	if failure != nil {
+		h.dashboardAuthError(w, r, failure)
+		return
+	}
+
+	// The form carries a value derived from the session so other sites can't post it
+	if subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(h.sessions.CSRFToken(credential))) != 1 {
+		http.Error(w, "Invalid form, reload the dashboard and try again", http.StatusForbidden)
+		return
+	}
+
+	var notice string
+	var err error
+
+	action := r.PostFormValue("action")
+	switch action {
+	case "revoke_session":
+		id := r.PostFormValue("id")
+		if !h.tokenCache.RevokeSession(id) {
+			err = fmt.Errorf("session %s not found", id)
+			break
+		}
+		log.Printf("Revoked session %s (by %s)", id, actor)
+		notice = "Session revoked " + id
+
+	case "revoke_user":
+		userID, convErr := strconv.Atoi(r.PostFormValue("user_id"))
+		if convErr != nil || userID <= 0 {
+			err = fmt.Errorf("invalid user")
+			break
+		}
+		revoked := h.tokenCache.RevokeUser(userID)
+		log.Printf("Revoked %d session(s) of user %d (by %s)", revoked, userID, actor)
+		notice = fmt.Sprintf("Revoked %d session(s) of user %d", revoked, userID)
+
+	case "flush_cache":
+		removed := h.tokenCache.Clear()
+		log.Printf("Token cache flushed, %d entries removed (by %s)", removed, actor)
+		notice = fmt.Sprintf("Cache flushed, %d entries removed", removed)
+
+	case "refresh_users":
+		if err = h.accessList.Refresh(r.Context()); err != nil {
+			log.Printf("Shared users refresh requested by %s failed: %v", actor, err)
+			err = fmt.Errorf("failed to refresh the shared users: %w", err)
+			break
+		}
+		log.Printf("Shared users refreshed (by %s)", actor)
+		notice = "Shared users refreshed"
+
+	case "reload_config":
+		if err = h.reloader.Reload("dashboard (" + actor + ")"); err != nil {
+			err = fmt.Errorf("configuration rejected: %w", err)
+			break
+		}
+		notice = "Configuration reloaded"
+
+	default:
+		err = fmt.Errorf("unknown action")
+	}
+
+	target := "/admin/?notice=" + url.QueryEscape(notice)
+	if err != nil {
+		h.audit(r, actor, action, auth.DecisionFailure, err.Error())
+		target = "/admin/?error=" + url.QueryEscape(err.Error())
+	} else {
+		h.audit(r, actor, action, auth.DecisionSuccess, notice)
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// dashboardAuthError sends visitors without a session to the login page
+// and shows other authentication failures
+func (h *Handler) dashboardAuthError(w http.ResponseWriter, r *http.Request, failure *adminError) {
+	if failure.status == http.StatusUnauthorized {
+		http.Redirect(w, r, "/login?redirect="+url.QueryEscape("/admin/"), http.StatusFound)
+		return
+	}
+
+	if failure.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(failure.retryAfter.Seconds())+1))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(failure.status)
+	if err := dashboardErrorTemplate.Execute(w, failure.message); err != nil {
+		log.Printf("Error rendering admin dashboard error: %v", err)
+	}
+}
+
+// dashboardUsers lists the owner, shared and Plex Home users with their sessions and history,
+// followed by the users seen in the sessions or the history without server access
+func dashboardUsers(snapshot *access.Snapshot, sessions []cache.Session, activity []history.User) []dashboardUser {
+	var users []dashboardUser
+	if snapshot != nil {
+		users = append(users, dashboardUser{ID: snapshot.Owner.ID, Username: snapshot.Owner.Username, Email: snapshot.Owner.Email, Access: "owner"})
+
+		shared := make([]dashboardUser, 0, len(snapshot.SharedUsers)+len(snapshot.HomeUsers))
+		for _, user := range snapshot.SharedUsers {
+			shared = append(shared, dashboardUser{ID: user.ID, Username: user.Username, Email: user.Email, Access: "shared"})
+		}
+		for _, user := range snapshot.HomeUsers {
+			if _, isShared := snapshot.SharedUsers[user.ID]; !isShared {
+				shared = append(shared, dashboardUser{ID: user.ID, Username: user.Username, Email: user.Email, Access: "home"})
+			}
+		}
+		sort.Slice(shared, func(i, j int) bool {
+			return strings.ToLower(shared[i].Username) < strings.ToLower(shared[j].Username)
+		})
+		users = append(users, shared...)
+	}
+
+	index := make(map[int]int, len(users))
+	for i, user := range users {
+		index[user.ID] = i
+	}
+
+	for _, session := range sessions {
+		if session.UserID == 0 {
+			continue
+		}
+		i, known := index[session.UserID]
+		if !known {
+			i = len(users)
+			index[session.UserID] = i
+			users = append(users, dashboardUser{ID: session.UserID, Username: session.Username, Email: session.Email, Access: "none"})
+		}
+		users[i].Sessions++
+		if session.LastSeen.After(users[i].LastSeen) {
+			users[i].LastSeen = session.LastSeen
+		}
+	}
+
+	for _, user := range activity {
+		i, known := index[user.UserID]
+		if !known {
+			i = len(users)
+			index[user.UserID] = i
+			users = append(users, dashboardUser{ID: user.UserID, Username: user.Username, Access: "none"})
+		}
+		if user.LastSeen.After(users[i].LastSeen) {
+			users[i].LastSeen = user.LastSeen
+		}
+		users[i].LastLogin = user.LastLogin
+		users[i].LastIP = user.LastIP
+
+		for host := range user.Hosts {
+			users[i].Hosts = append(users[i].Hosts, host)
+		}
+		sort.Slice(users[i].Hosts, func(a, b int) bool {
+			return user.Hosts[users[i].Hosts[a]].LastSeen.After(user.Hosts[users[i].Hosts[b]].LastSeen)
+		})
+	}
+
+	return users
+}
+
+// since formats the time elapsed since t for the dashboard
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	elapsed := time.Since(t)
+	switch {
+	case elapsed < time.Minute:
+		return fmt.Sprintf("%ds ago", int(elapsed.Seconds()))
+	case elapsed < time.Hour:
+		return fmt.Sprintf("%dm ago", int(elapsed.Minutes()))
+	case elapsed < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(elapsed.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(elapsed.Hours()/24))
+	}
+}
+
+var dashboardFuncs = template.FuncMap{
+	"since": since,
+}
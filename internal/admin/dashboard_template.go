@@ -0,0 +1,254 @@
+package admin
+
+import (
+	"html/template"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/auth"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/health"
+)
+
+// dashboardStyle follows the theme of the login pages
+const dashboardStyle = `
+	<style>
+		body {
+			font-family: Arial, sans-serif;
+			max-width: 1100px;
+			margin: 30px auto;
+			padding: 20px;
+			background-color: #1a1a1a;
+			color: #fff;
+		}
+		h1 { color: #e5a00d; text-align: center; }
+		h2 { color: #e5a00d; font-size: 18px; margin: 0 0 15px 0; }
+		p { color: #ccc; }
+		a { color: #e5a00d; }
+		.subtitle { text-align: center; }
+		.panel {
+			background-color: #282828;
+			border-radius: 5px;
+			padding: 20px;
+			margin: 20px 0;
+			overflow-x: auto;
+		}
+		.panel-header { display: flex; justify-content: space-between; align-items: flex-start; }
+		.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(200px, 1fr)); gap: 10px; }
+		.stat .label { color: #999; font-size: 12px; text-transform: uppercase; }
+		.stat .value { font-size: 16px; margin-top: 4px; word-break: break-word; }
+		table { width: 100%; border-collapse: collapse; font-size: 14px; }
+		th { color: #999; font-weight: normal; text-align: left; padding: 6px; border-bottom: 1px solid #444; }
+		td { padding: 6px; border-bottom: 1px solid #333; }
+		.ok { color: #4caf50; }
+		.warn { color: #e5a00d; }
+		.bad { color: #f44336; }
+		.muted { color: #999; }
+		.mono { font-family: monospace; }
+		.button {
+			background-color: #e5a00d;
+			color: #000;
+			padding: 8px 16px;
+			border: none;
+			border-radius: 5px;
+			font-weight: bold;
+			cursor: pointer;
+		}
+		.button:hover { background-color: #cc8800; }
+		.button.small { padding: 4px 10px; font-size: 12px; }
+		.button.danger { background-color: #f44336; color: #fff; }
+		.button.danger:hover { background-color: #d32f2f; }
+		form.inline { display: inline; margin: 0; }
+		.notice { border-left: 4px solid #4caf50; }
+		.error { border-left: 4px solid #f44336; }
+	</style>`
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(dashboardFuncs).Funcs(template.FuncMap{
+	"stateClass": func(state health.TokenState) string {
+		switch state {
+		case health.TokenStateOK:
+			return "ok"
+		case health.TokenStateServerOffline, health.TokenStatePlexUnreachable, health.TokenStateUnknown:
+			return "warn"
+		default:
+			return "bad"
+		}
+	},
+	"decisionClass": func(decision string) string {
+		switch decision {
+		case auth.DecisionAllowed:
+			return "ok"
+		case auth.DecisionBypassed:
+			return "warn"
+		default:
+			return "bad"
+		}
+	},
+}).Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Plex Auth Dashboard</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+` + dashboardStyle + `
+</head>
+<body>
+	<h1>Plex Auth Dashboard</h1>
+	<p class="subtitle">Signed in as <strong>{{.Actor}}</strong> &middot; <a href="/admin/">Refresh</a> &middot; <a href="/logout">Logout</a></p>
+
+	{{if .Notice}}<div class="panel notice">{{.Notice}}</div>{{end}}
+	{{if .Error}}<div class="panel error">{{.Error}}</div>{{end}}
+
+	<div class="panel">
+		<h2>Owner Token</h2>
+		<div class="grid">
+			<div class="stat"><div class="label">State</div><div class="value {{stateClass .Token.State}}">{{.Token.State}}</div></div>
+			<div class="stat"><div class="label">Owner</div><div class="value">{{with .Token.OwnerUsername}}{{.}}{{else}}<span class="muted">unknown</span>{{end}}</div></div>
+			<div class="stat"><div class="label">Server</div><div class="value">{{with .Token.ServerName}}{{.}}{{else}}{{.Token.ServerID}}{{end}}</div></div>
+			<div class="stat"><div class="label">Server owned / online</div><div class="value">{{if .Token.ServerOwned}}<span class="ok">yes</span>{{else}}<span class="bad">no</span>{{end}} / {{if .Token.ServerOnline}}<span class="ok">yes</span>{{else}}<span class="warn">no</span>{{end}}</div></div>
+			<div class="stat"><div class="label">Last checked</div><div class="value">{{since .Token.LastChecked}}</div></div>
+			<div class="stat"><div class="label">Last success</div><div class="value">{{since .Token.LastSuccess}}</div></div>
+			<div class="stat"><div class="label">Consecutive failures</div><div class="value">{{.Token.ConsecutiveFailures}}</div></div>
+			<div class="stat"><div class="label">Average latency</div><div class="value">{{.Token.AverageLatency}}</div></div>
+		</div>
+		{{with .Token.LastError}}<p class="bad">{{.}}</p>{{end}}
+	</div>
+
+	<div class="panel">
+		<div class="panel-header">
+			<h2>Configuration</h2>
+			<form class="inline" method="POST" action="/admin/actions">
+				<input type="hidden" name="csrf" value="{{.CSRF}}">
+				<input type="hidden" name="action" value="reload_config">
+				<button class="button" type="submit">Reload config</button>
+			</form>
+		</div>
+		<div class="grid">
+			<div class="stat"><div class="label">Reloads / failures</div><div class="value">{{.Reload.Reloads}} / {{.Reload.Failures}}</div></div>
+			<div class="stat"><div class="label">Last reload</div><div class="value">{{since .Reload.LastReloadAt}}{{with .Reload.LastTrigger}} <span class="muted">({{.}})</span>{{end}}</div></div>
+			<div class="stat"><div class="label">Last result</div><div class="value">{{with .Reload.LastResult}}{{.}}{{else}}<span class="muted">none</span>{{end}}</div></div>
+		</div>
+		{{with .Reload.LastError}}<p class="bad">{{.}}</p>{{end}}
+	</div>
+
+	<div class="panel">
+		<div class="panel-header">
+			<h2>Cache</h2>
+			<form class="inline" method="POST" action="/admin/actions">
+				<input type="hidden" name="csrf" value="{{.CSRF}}">
+				<input type="hidden" name="action" value="flush_cache">
+				<button class="button danger" type="submit">Flush cache</button>
+			</form>
+		</div>
+		<div class="grid">
+			<div class="stat"><div class="label">Entries</div><div class="value">{{.Cache.Entries}} / {{.Cache.MaxSize}}</div></div>
+			<div class="stat"><div class="label">Revoked tokens</div><div class="value">{{.Cache.Revoked}}</div></div>
+			<div class="stat"><div class="label">TTL</div><div class="value">{{.Cache.TTL}}</div></div>
+			<div class="stat"><div class="label">Stale grace</div><div class="value">{{.Cache.StaleGrace}}</div></div>
+		</div>
+	</div>
+
+	<div class="panel">
+		<h2>Sessions</h2>
+		{{if .Sessions}}
+		<table>
+			<tr><th>User</th><th>Session</th><th>Client IP</th><th>Last decision</th><th>Last seen</th><th>Started</th><th></th></tr>
+			{{range .Sessions}}
+			<tr>
+				<td>{{with .Username}}{{.}}{{else}}<span class="muted">invalid token</span>{{end}}</td>
+				<td class="mono">{{.ID}}</td>
+				<td>{{.ClientIP}}</td>
+				<td class="{{decisionClass .Decision}}">{{.Decision}}{{if .Stale}} <span class="muted">(stale)</span>{{end}}</td>
+				<td>{{since .LastSeen}}</td>
+				<td>{{since .CreatedAt}}</td>
+				<td>
+					<form class="inline" method="POST" action="/admin/actions">
+						<input type="hidden" name="csrf" value="{{$.CSRF}}">
+						<input type="hidden" name="action" value="revoke_session">
+						<input type="hidden" name="id" value="{{.ID}}">
+						<button class="button small danger" type="submit">Revoke</button>
+					</form>
+				</td>
+			</tr>
+			{{end}}
+		</table>
+		{{else}}
+		<p class="muted">No cached sessions.</p>
+		{{end}}
+	</div>
+
+	<div class="panel">
+		<div class="panel-header">
+			<h2>Users</h2>
+			<form class="inline" method="POST" action="/admin/actions">
+				<input type="hidden" name="csrf" value="{{.CSRF}}">
+				<input type="hidden" name="action" value="refresh_users">
+				<button class="button" type="submit">Refresh shared users</button>
+			</form>
+		</div>
+		{{if .UsersLoaded}}<p class="muted">Shared users refreshed {{since .UsersRefreshedAt}}</p>{{else}}<p class="warn">The shared users couldn't be loaded from Plex yet.</p>{{end}}
+		<p class="muted">History of {{.History.Users}} user(s){{with .History.File}}, saved {{since $.History.LastFlush}}{{else}}, kept in memory only{{end}}</p>
+		{{with .History.LastError}}<p class="bad">{{.}}</p>{{end}}
+		{{if .Users}}
+		<table>
+			<tr><th>User</th><th>Email</th><th>Access</th><th>Sessions</th><th>Last seen</th><th>Last login</th><th>Last IP</th><th>Hosts</th><th></th></tr>
+			{{range .Users}}
+			<tr>
+				<td>{{.Username}} <span class="muted">#{{.ID}}</span></td>
+				<td>{{.Email}}</td>
+				<td class="{{if eq .Access "none"}}bad{{else}}ok{{end}}">{{.Access}}</td>
+				<td>{{.Sessions}}</td>
+				<td>{{since .LastSeen}}</td>
+				<td>{{since .LastLogin}}</td>
+				<td>{{.LastIP}}</td>
+				<td>{{range $i, $host := .Hosts}}{{if $i}}, {{end}}{{$host}}{{end}}</td>
+				<td>
+					{{if .Sessions}}
+					<form class="inline" method="POST" action="/admin/actions">
+						<input type="hidden" name="csrf" value="{{$.CSRF}}">
+						<input type="hidden" name="action" value="revoke_user">
+						<input type="hidden" name="user_id" value="{{.ID}}">
+						<button class="button small danger" type="submit">Revoke sessions</button>
+					</form>
+					{{end}}
+				</td>
+			</tr>
+			{{end}}
+		</table>
+		{{end}}
+	</div>
+
+	<div class="panel">
+		<h2>Recent Decisions</h2>
+		{{if .Decisions}}
+		<table>
+			<tr><th>Time</th><th>User</th><th>Request</th><th>Client IP</th><th>Decision</th></tr>
+			{{range .Decisions}}
+			<tr>
+				<td>{{since .Time}}</td>
+				<td>{{with .Username}}{{.}}{{else}}<span class="muted">unknown</span>{{end}}</td>
+				<td>{{.Host}}{{.Path}}</td>
+				<td>{{.ClientIP}}</td>
+				<td class="{{decisionClass .Decision}}">{{.Decision}}{{with .Source}} <span class="muted">({{.}})</span>{{end}}</td>
+			</tr>
+			{{end}}
+		</table>
+		{{else}}
+		<p class="muted">No authentication requests yet.</p>
+		{{end}}
+	</div>
+</body>
+</html>
+`))
+
+var dashboardErrorTemplate = template.Must(template.New("dashboard-error").Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Plex Auth Dashboard</title>
+` + dashboardStyle + `
+</head>
+<body>
+	<h1>Plex Auth Dashboard</h1>
+	<div class="panel error">{{.}}</div>
+	<p class="subtitle"><a href="/">Home</a> &middot; <a href="/logout">Logout</a></p>
+</body>
+</html>
+`))
@@ -0,0 +1,248 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/access"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/apikeys"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/audit"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/auth"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/clientip"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/health"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/history"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/owner"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/ratelimit"
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
+)
+
+// Handler serves the administration API, restricted to the Plex server owner
+// and to clients presenting the admin API key
+type Handler struct {
+	config       *config.Config
+	plexClient   *plex.Client
+	accessList   *access.Refresher
+	tokenMonitor *health.TokenMonitor
+	rotator      *owner.Rotator
+	tokenCache   *cache.TokenCache
+	reloader     *config.Reloader
+	decisions    *auth.DecisionLog
+	auditLog     *audit.Logger
+	history      *history.Store
+	apiKeys      *apikeys.Store
+	guard        *ratelimit.Guard
+	sessions     *auth.Sessions
+}
+
+// NewHandler creates a new administration handler
+func NewHandler(cfg *config.Config, client *plex.Client, accessList *access.Refresher, tokenMonitor *health.TokenMonitor, rotator *owner.Rotator, tokenCache *cache.TokenCache, reloader *config.Reloader, decisions *auth.DecisionLog, auditLog *audit.Logger, userHistory *history.Store, apiKeys *apikeys.Store, guard *ratelimit.Guard, sessions *auth.Sessions) *Handler {
+	return &Handler{
+		config:       cfg,
+		plexClient:   client,
+		accessList:   accessList,
+		tokenMonitor: tokenMonitor,
+		rotator:      rotator,
+		tokenCache:   tokenCache,
+		reloader:     reloader,
+		decisions:    decisions,
+		auditLog:     auditLog,
+		history:      userHistory,
+		apiKeys:      apiKeys,
+		guard:        guard,
+		sessions:     sessions,
+	}
+}
+
+// HandleOwnerToken replaces the owner token at runtime.
+// It expects a POST with a JSON body such as {"token": "new-owner-token"}.
+func (h *Handler) HandleOwnerToken(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	actor, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil || body.Token == "" {
+		writeError(w, http.StatusBadRequest, "expected a JSON body with a token")
+		return
+	}
+
+	ownerInfo, err := h.rotator.Rotate(r.Context(), body.Token)
+	switch {
+	case errors.Is(err, owner.ErrInvalidToken), errors.Is(err, owner.ErrNotServerOwner):
+		log.Printf("Owner token rotation rejected: %v", err)
+		h.audit(r, actor, "rotate_owner_token", auth.DecisionFailure, err.Error())
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	case errors.Is(err, plex.ErrUpstreamUnavailable), errors.Is(err, plex.ErrRateLimited):
+		log.Printf("Owner token rotation failed: %v", err)
+		h.audit(r, actor, "rotate_owner_token", auth.DecisionFailure, err.Error())
+		writeError(w, http.StatusServiceUnavailable, "Plex API is unavailable, try again later")
+		return
+	case err != nil:
+		log.Printf("Owner token rotation failed: %v", err)
+		h.audit(r, actor, "rotate_owner_token", auth.DecisionFailure, err.Error())
+		writeError(w, http.StatusInternalServerError, "failed to validate the owner token")
+		return
+	}
+
+	h.audit(r, actor, "rotate_owner_token", auth.DecisionSuccess, "owner token of "+ownerInfo.Username+" in use")
+	h.tokenMonitor.Check()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"owner_username": ownerInfo.Username,
+		"owner_id":       ownerInfo.ID,
+		"token":          h.tokenMonitor.GetStatus(),
+	})
+}
+
+// adminError is a failed admin authentication, with the status code of the response
+type adminError struct {
+	status  int
+	message string
+	// retryAfter is set on 429 responses
+	retryAfter time.Duration
+}
+
+// write writes the error as a JSON response
+func (e *adminError) write(w http.ResponseWriter) {
+	if e.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(e.retryAfter.Seconds())+1))
+	}
+	writeError(w, e.status, e.message)
+}
+
+// requireAdmin checks that the request comes from the Plex server owner or carries
+// the admin API key, writing an error response otherwise. It returns who is calling
+// for the logs.
+func (h *Handler) requireAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	actor, _, failure := h.authenticate(w, r)
+	if failure != nil {
+		failure.write(w)
+		return "", false
+	}
+	return actor, true
+}
+
+// authenticate identifies the admin calling, returning who is calling for the logs
+// and the credential used. Revoked tokens and ended cookie sessions are refused like
+// by /auth, the state cookie of active sessions is renewed on w.
+func (h *Handler) authenticate(w http.ResponseWriter, r *http.Request) (string, string, *adminError) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = auth.ExtractToken(r, h.config.Sessions.CookieName)
+	}
+	if key == "" {
+		return "", "", &adminError{status: http.StatusUnauthorized, message: "authentication required"}
+	}
+
+	if h.config.AdminAPIKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(h.config.AdminAPIKey)) == 1 {
+		return "API key", key, nil
+	}
+	// API keys of scripts and services only grant access through /auth
+	if apikeys.IsKey(key) {
+		return "", "", &adminError{status: http.StatusForbidden, message: "API keys of services can't use the admin API"}
+	}
+
+	if h.tokenCache.IsRevoked(key) {
+		log.Printf("Revoked admin token (client %s)", clientip.FromRequest(r))
+		h.audit(r, "", "", auth.DecisionRevoked, "token revoked")
+		return "", "", &adminError{status: http.StatusUnauthorized, message: "session revoked, log in again"}
+	}
+	if err := h.sessions.Verify(w, r, key); err != nil {
+		// The token is refused from headers too, like when /auth ends the session
+		h.tokenCache.EndSession(key)
+		log.Printf("Admin session ended (client %s): %v", clientip.FromRequest(r), err)
+		h.audit(r, "", "", auth.DecisionExpired, err.Error())
+		return "", "", &adminError{status: http.StatusUnauthorized, message: "session ended, log in again"}
+	}
+
+	// Tokens validated by /auth are known without asking Plex
+	if cached, found := h.tokenCache.Get(key); found && cached.Valid && cached.UserID != 0 {
+		return h.checkOwner(r, key, &plex.UserInfo{ID: cached.UserID, Username: cached.Username, Email: cached.Email})
+	}
+
+	// Other tokens are validated with Plex, under the same lockout and rate limits as /auth
+	if wait := h.guard.TokenLocked(key); wait > 0 {
+		h.audit(r, "", "", auth.DecisionFailure, "token locked out after repeated failed validations")
+		return "", "", &adminError{status: http.StatusTooManyRequests, message: "too many requests, try again later", retryAfter: wait}
+	}
+	if wait := h.guard.Wait(r, ratelimit.EndpointAdmin); wait > 0 {
+		h.audit(r, "", "", auth.DecisionFailure, "too many validations with Plex")
+		return "", "", &adminError{status: http.StatusTooManyRequests, message: "too many requests, try again later", retryAfter: wait}
+	}
+
+	identity, err := h.plexClient.IdentifyContext(r.Context(), key)
+	if err != nil {
+		log.Printf("Error validating admin token: %v", err)
+		return "", "", &adminError{status: http.StatusServiceUnavailable, message: "Plex API is unavailable, try again later"}
+	}
+	if !identity.Valid {
+		log.Printf("Invalid admin token (client %s)", clientip.FromRequest(r))
+		h.audit(r, "", "", auth.DecisionFailure, "token rejected by Plex")
+		if h.guard.TokenFailed(key) {
+			log.Printf("⚠️  Admin token %s locked out after repeated failed validations", cache.SessionID(key))
+		}
+		return "", "", &adminError{status: http.StatusUnauthorized, message: "invalid token"}
+	}
+	h.guard.TokenSucceeded(key)
+
+	return h.checkOwner(r, key, identity.User)
+}
+
+// checkOwner accepts the user of a Plex token if it is the server owner
+func (h *Handler) checkOwner(r *http.Request, key string, user *plex.UserInfo) (string, string, *adminError) {
+
+	if user.ID != h.ownerID() {
+		log.Printf("Admin access denied for user %s (client %s)", user.Username, clientip.FromRequest(r))
+		h.audit(r, user.Username, "", auth.DecisionFailure, "not the server owner")
+		return "", "", &adminError{status: http.StatusForbidden, message: "only the server owner can use the admin API"}
+	}
+
+	return user.Username, key, nil
+}
+
+// ownerID returns the account ID of the server owner, known from the shared users
+// snapshot or the token monitor even if the owner token became invalid
+func (h *Handler) ownerID() int {
+	if snapshot := h.accessList.Snapshot(); snapshot != nil && snapshot.Owner.ID != 0 {
+		return snapshot.Owner.ID
+	}
+	return h.tokenMonitor.GetStatus().OwnerID
+}
+
+// audit records an admin action in the audit log
+func (h *Handler) audit(r *http.Request, actor, action, decision, reason string) {
+	h.auditLog.Log(audit.Event{
+		Type:     audit.EventAdmin,
+		Username: actor,
+		ClientIP: clientip.FromRequest(r),
+		Host:     r.Host,
+		URI:      r.URL.Path,
+		Decision: decision,
+		Reason:   reason,
+		Action:   action,
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
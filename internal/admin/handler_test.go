@@ -0,0 +1,391 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/access"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/apikeys"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/audit"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/auth"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/clientip"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/health"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/history"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/owner"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/ratelimit"
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex/plextest"
+)
+
+const (
+	testServerID = "test-server"
+	testAPIKey   = "test-admin-api-key"
+)
+
+// Accounts of the fake Plex: the owner, a user the server is shared with and
+// a user without access
+var (
+	testOwner  = plextest.User{ID: 1, Username: "owner", Email: "owner@example.com"}
+	testShared = plextest.User{ID: 2, Username: "alice", Email: "alice@example.com"}
+	testOther  = plextest.User{ID: 3, Username: "bob", Email: "bob@example.com"}
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testEnv wires the admin handler to a fake Plex the way the server does
+type testEnv struct {
+	fake        *plextest.Fake
+	config      *config.Config
+	tokenCache  *cache.TokenCache
+	apiKeys     *apikeys.Store
+	sessions    *auth.Sessions
+	authHandler *auth.Handler
+	handler     *Handler
+	ownerToken  string
+	sharedToken string
+	otherToken  string
+}
+
+// newTestEnv starts a fake Plex with the test accounts and loads the shared users
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	env := &testEnv{fake: plextest.New()}
+	env.ownerToken = env.fake.AddUser(testOwner)
+	env.sharedToken = env.fake.AddUser(testShared)
+	env.otherToken = env.fake.AddUser(testOther)
+	env.fake.AddServer(plextest.Server{MachineID: testServerID, Name: "Test", OwnerID: testOwner.ID, Online: true})
+	env.fake.Share(testServerID, testShared.ID)
+	plexServer := plextest.NewServer(env.fake)
+	t.Cleanup(plexServer.Close)
+
+	cfg := config.Default()
+	cfg.PlexURL = plexServer.URL
+	cfg.PlexToken = env.ownerToken
+	cfg.PlexServerID = testServerID
+	cfg.AdminAPIKey = testAPIKey
+	cfg.Sessions.Secret = "test-session-secret"
+	cfg.Policies = []config.PolicyRule{{Name: "admin-only", Hosts: []string{"admin.example.com"}, AllowUsers: []string{"owner"}}}
+	env.config = cfg
+
+	client := plex.NewClientWithOptions(cfg.PlexURL, cfg.PlexToken, cfg.PlexClientID, plex.Options{
+		RequestTimeout: 2 * time.Second,
+		Breaker:        plex.DefaultBreakerOptions(),
+	})
+	env.tokenCache = cache.NewTokenCache(cfg.CacheTTL, cfg.CacheMaxSize)
+	t.Cleanup(env.tokenCache.Stop)
+	accessList := access.NewRefresher(client, cfg.PlexServerID, cfg.SharedUsersRefreshInterval)
+	if err := accessList.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	tokenMonitor := health.NewTokenMonitor(client, cfg.PlexToken, cfg.PlexServerID, cfg.TokenHealthCheckTTL)
+	rotator := owner.NewRotator(client, cfg.PlexServerID, tokenMonitor, accessList, env.tokenCache)
+	t.Cleanup(rotator.Stop)
+
+	auditLog, err := audit.NewLogger(cfg.Audit)
+	if err != nil {
+		t.Fatalf("audit.NewLogger: %v", err)
+	}
+	userHistory, err := history.NewStore("", cfg.History.Retention, cfg.History.MaxLogins, cfg.History.FlushInterval)
+	if err != nil {
+		t.Fatalf("history.NewStore: %v", err)
+	}
+	env.apiKeys, err = apikeys.NewStore("", cfg.APIKeys)
+	if err != nil {
+		t.Fatalf("apikeys.NewStore: %v", err)
+	}
+	guard := ratelimit.NewGuard(cfg.RateLimit)
+	env.sessions = auth.NewSessions(cfg)
+
+	env.authHandler = auth.NewHandler(cfg, client, env.tokenCache, accessList, auditLog, guard, env.apiKeys, env.sessions)
+	env.handler = NewHandler(cfg, client, accessList, tokenMonitor, rotator, env.tokenCache, config.NewReloader("", cfg),
+		env.authHandler.Decisions(), auditLog, userHistory, env.apiKeys, guard, env.sessions)
+	return env
+}
+
+// serve sends a request to a handler through the client IP middleware, like the server does
+func (env *testEnv) serve(handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	clientip.NewResolver(env.config.TrustedProxies).Middleware(handler).ServeHTTP(recorder, r)
+	return recorder
+}
+
+// get sends a GET request to an admin endpoint with the given X-Plex-Token (none if empty)
+func (env *testEnv) get(handler http.HandlerFunc, target, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if token != "" {
+		r.Header.Set("X-Plex-Token", token)
+	}
+	return env.serve(handler, r)
+}
+
+// sessionCookies returns the cookies of a new session of token
+func (env *testEnv) sessionCookies(token string) []*http.Cookie {
+	recorder := httptest.NewRecorder()
+	env.sessions.Start(recorder, token, true)
+	return recorder.Result().Cookies()
+}
+
+// decode decodes a JSON response
+func decode(t *testing.T, recorder *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response is not JSON: %v\n%s", err, recorder.Body)
+	}
+	return body
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, env *testEnv, r *http.Request)
+		status  int
+	}{
+		{
+			name:    "no credential",
+			prepare: func(t *testing.T, env *testEnv, r *http.Request) {},
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    "admin API key",
+			prepare: func(t *testing.T, env *testEnv, r *http.Request) { r.Header.Set("X-API-Key", testAPIKey) },
+			status:  http.StatusOK,
+		},
+		{
+			name:    "owner token",
+			prepare: func(t *testing.T, env *testEnv, r *http.Request) { r.Header.Set("X-Plex-Token", env.ownerToken) },
+			status:  http.StatusOK,
+		},
+		{
+			name: "owner session cookies",
+			prepare: func(t *testing.T, env *testEnv, r *http.Request) {
+				for _, cookie := range env.sessionCookies(env.ownerToken) {
+					r.AddCookie(cookie)
+				}
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "owner session without state cookie",
+			prepare: func(t *testing.T, env *testEnv, r *http.Request) {
+				r.AddCookie(&http.Cookie{Name: env.config.Sessions.CookieName, Value: env.ownerToken})
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:    "shared user token",
+			prepare: func(t *testing.T, env *testEnv, r *http.Request) { r.Header.Set("X-Plex-Token", env.sharedToken) },
+			status:  http.StatusForbidden,
+		},
+		{
+			name:    "token of a user without access",
+			prepare: func(t *testing.T, env *testEnv, r *http.Request) { r.Header.Set("X-Plex-Token", env.otherToken) },
+			status:  http.StatusForbidden,
+		},
+		{
+			name:    "token rejected by Plex",
+			prepare: func(t *testing.T, env *testEnv, r *http.Request) { r.Header.Set("X-Plex-Token", "unknown-token") },
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name: "API key of a service",
+			prepare: func(t *testing.T, env *testEnv, r *http.Request) {
+				raw, _, err := env.apiKeys.Create("backup", nil, nil, time.Time{})
+				if err != nil {
+					t.Fatalf("Create: %v", err)
+				}
+				r.Header.Set("X-API-Key", raw)
+			},
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+
+			r := httptest.NewRequest(http.MethodGet, "/admin/api/cache", nil)
+			tt.prepare(t, env, r)
+			recorder := env.serve(env.handler.HandleCache, r)
+			if recorder.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, tt.status, recorder.Body)
+			}
+		})
+	}
+}
+
+func TestAuthenticateRevokedSession(t *testing.T) {
+	env := newTestEnv(t)
+
+	// The owner's token is cached by /auth, then every session of the owner is revoked
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-Plex-Token", env.ownerToken)
+	if recorder := env.serve(env.authHandler.HandleAuth, r); recorder.Code != http.StatusOK {
+		t.Fatalf("auth status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	r = httptest.NewRequest(http.MethodDelete, "/admin/api/sessions?user_id=1", nil)
+	r.Header.Set("X-API-Key", testAPIKey)
+	if body := decode(t, env.serve(env.handler.HandleSessions, r)); body["revoked"] != float64(1) {
+		t.Fatalf("revoked = %v, want 1", body["revoked"])
+	}
+
+	if recorder := env.get(env.handler.HandleCache, "/admin/api/cache", env.ownerToken); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("status with the revoked token = %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/admin/", nil)
+	for _, cookie := range env.sessionCookies(env.ownerToken) {
+		r.AddCookie(cookie)
+	}
+	recorder := env.serve(env.handler.HandleDashboard, r)
+	if recorder.Code != http.StatusFound || !strings.HasPrefix(recorder.Header().Get("Location"), "/login") {
+		t.Errorf("dashboard answered %d to %q, want a redirect to the login page", recorder.Code, recorder.Header().Get("Location"))
+	}
+}
+
+func TestAdminResponses(t *testing.T) {
+	env := newTestEnv(t)
+
+	// A decision and a session of the shared user
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-Plex-Token", env.sharedToken)
+	if recorder := env.serve(env.authHandler.HandleAuth, r); recorder.Code != http.StatusOK {
+		t.Fatalf("auth status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+
+	t.Run("sessions", func(t *testing.T) {
+		body := decode(t, env.get(env.handler.HandleSessions, "/admin/api/sessions?user_id=2", env.ownerToken))
+		sessions, ok := body["sessions"].([]interface{})
+		if !ok || len(sessions) != 1 {
+			t.Fatalf("sessions = %v, want the session of %s", body["sessions"], testShared.Username)
+		}
+		session := sessions[0].(map[string]interface{})
+		if session["id"] != cache.SessionID(env.sharedToken) || session["username"] != testShared.Username ||
+			session["user_id"] != float64(testShared.ID) || session["has_access"] != true {
+			t.Errorf("session = %v", session)
+		}
+		for _, field := range []string{"valid", "created_at", "last_seen", "expires_at", "stale"} {
+			if _, ok := session[field]; !ok {
+				t.Errorf("session has no %q field", field)
+			}
+		}
+		if strings.Contains(env.get(env.handler.HandleSessions, "/admin/api/sessions", env.ownerToken).Body.String(), env.sharedToken) {
+			t.Error("sessions contain a token")
+		}
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		body := decode(t, env.get(env.handler.HandleCache, "/admin/api/cache", env.ownerToken))
+		// Admin requests don't cache the owner's token, only /auth does
+		if body["entries"] != float64(1) || body["revoked"] != float64(0) || body["max_size"] != float64(env.config.CacheMaxSize) {
+			t.Errorf("cache = %v", body)
+		}
+		for _, field := range []string{"ttl", "stale_grace"} {
+			if _, ok := body[field].(string); !ok {
+				t.Errorf("cache %q = %v, want a duration", field, body[field])
+			}
+		}
+	})
+
+	t.Run("shared users", func(t *testing.T) {
+		body := decode(t, env.get(env.handler.HandleSharedUsers, "/admin/api/shared-users", env.ownerToken))
+		if body["loaded"] != true {
+			t.Fatalf("loaded = %v", body["loaded"])
+		}
+		if ownerInfo, _ := body["owner"].(map[string]interface{}); ownerInfo["username"] != testOwner.Username {
+			t.Errorf("owner = %v", body["owner"])
+		}
+		shared, _ := body["shared_users"].([]interface{})
+		if len(shared) != 1 || shared[0].(map[string]interface{})["username"] != testShared.Username {
+			t.Errorf("shared_users = %v", body["shared_users"])
+		}
+		if home, ok := body["home_users"].([]interface{}); !ok || len(home) != 0 {
+			t.Errorf("home_users = %v, want an empty list", body["home_users"])
+		}
+		if _, ok := body["refreshed_at"].(string); !ok {
+			t.Errorf("refreshed_at = %v", body["refreshed_at"])
+		}
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		query := url.Values{"user": {testShared.Email}, "host": {"admin.example.com"}, "path": {"settings"}}
+		body := decode(t, env.get(env.handler.HandlePolicy, "/admin/api/policy?"+query.Encode(), env.ownerToken))
+		policies, _ := body["policies"].([]interface{})
+		if len(policies) != 1 || policies[0].(map[string]interface{})["name"] != "admin-only" {
+			t.Errorf("policies = %v", body["policies"])
+		}
+		if _, ok := body["headers"].(map[string]interface{}); !ok {
+			t.Errorf("headers = %v", body["headers"])
+		}
+		decision, _ := body["decision"].(map[string]interface{})
+		if decision["allowed"] != false || decision["rule"] != "admin-only" || decision["user_id"] != float64(testShared.ID) ||
+			decision["username"] != testShared.Username || decision["path"] != "/settings" {
+			t.Errorf("decision = %v", body["decision"])
+		}
+	})
+
+	t.Run("decisions", func(t *testing.T) {
+		body := decode(t, env.get(env.handler.HandleDecisions, "/admin/api/decisions", env.ownerToken))
+		decisions, _ := body["decisions"].([]interface{})
+		if len(decisions) != 1 {
+			t.Fatalf("decisions = %v, want the /auth decision", body["decisions"])
+		}
+		decision := decisions[0].(map[string]interface{})
+		if decision["username"] != testShared.Username || decision["decision"] != auth.DecisionAllowed {
+			t.Errorf("decision = %v", decision)
+		}
+		for _, field := range []string{"time", "host", "path", "client_ip"} {
+			if _, ok := decision[field]; !ok {
+				t.Errorf("decision has no %q field", field)
+			}
+		}
+	})
+}
+
+func TestDashboardActionCSRF(t *testing.T) {
+	tests := []struct {
+		name   string
+		csrf   func(env *testEnv) string
+		status int
+	}{
+		{name: "missing token", csrf: func(env *testEnv) string { return "" }, status: http.StatusForbidden},
+		{name: "token of another session", csrf: func(env *testEnv) string { return env.sessions.CSRFToken(env.sharedToken) }, status: http.StatusForbidden},
+		{name: "token of the session", csrf: func(env *testEnv) string { return env.sessions.CSRFToken(env.ownerToken) }, status: http.StatusSeeOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+
+			form := url.Values{"action": {"flush_cache"}, "csrf": {tt.csrf(env)}}
+			r := httptest.NewRequest(http.MethodPost, "/admin/actions", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			for _, cookie := range env.sessionCookies(env.ownerToken) {
+				r.AddCookie(cookie)
+			}
+
+			recorder := env.serve(env.handler.HandleDashboardAction, r)
+			if recorder.Code != tt.status {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.status)
+			}
+		})
+	}
+}
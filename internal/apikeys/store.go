@@ -0,0 +1,298 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/policy"
+)
+
+// Prefix starts every API key, telling them apart from Plex tokens
+const Prefix = "pak_"
+
+// Sources of the keys
+const (
+	SourceConfig = "config"
+	SourceAdmin  = "admin"
+)
+
+var (
+	// ErrUnknownKey is returned for keys that don't exist
+	ErrUnknownKey = errors.New("unknown API key")
+	// ErrExpiredKey is returned for keys past their expiry
+	ErrExpiredKey = errors.New("API key expired")
+	// ErrKeyExists is returned when creating a key with the name of another key
+	ErrKeyExists = errors.New("an API key with this name already exists")
+	// ErrConfigKey is returned when deleting a key of the configuration
+	ErrConfigKey = errors.New("API keys of the configuration can't be deleted through the admin API")
+)
+
+// Key is a named API key. Only the SHA-256 hash of the key is stored.
+type Key struct {
+	Name string `json:"name"`
+	Hash string `json:"hash,omitempty"`
+	// Hosts and Paths are the scopes of the key, matched like policy rules (empty matches all)
+	Hosts     []string  `json:"hosts"`
+	Paths     []string  `json:"paths"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+	// Source is "config" for keys of the configuration, "admin" for keys created through the admin API
+	Source string `json:"source"`
+}
+
+// Allows returns true if the scopes of the key match the host and path
+func (k *Key) Allows(host, path string) bool {
+	return policy.Matches(k.Hosts, k.Paths, host, path)
+}
+
+// keysFile is the content of the file holding the keys created through the admin API
+type keysFile struct {
+	Keys []*Key `json:"keys"`
+}
+
+// Store holds the API keys of the configuration and the ones created through
+// the admin API, persisted to a JSON file. Without a file the created keys are
+// lost on restart.
+type Store struct {
+	path string
+
+	mu      sync.RWMutex
+	config  []*Key
+	managed []*Key
+	// byHash indexes every key by hash, keys of the configuration take precedence
+	byHash map[string]*Key
+}
+
+// NewStore creates a store, loading the keys file if it exists
+func NewStore(path string, configKeys []config.APIKey) (*Store, error) {
+	s := &Store{path: path}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("failed to read API keys file %s: %w", path, err)
+		default:
+			var file keysFile
+			if err := json.Unmarshal(data, &file); err != nil {
+				return nil, fmt.Errorf("failed to parse API keys file %s: %w", path, err)
+			}
+			for _, key := range file.Keys {
+				key.Source = SourceAdmin
+			}
+			s.managed = file.Keys
+		}
+	}
+
+	s.SetConfigKeys(configKeys)
+	return s, nil
+}
+
+// SetConfigKeys replaces the keys of the configuration, e.g. after a reload
+func (s *Store) SetConfigKeys(configKeys []config.APIKey) {
+	keys := make([]*Key, 0, len(configKeys))
+	for _, configKey := range configKeys {
+		keys = append(keys, &Key{
+			Name:      configKey.Name,
+			Hash:      strings.ToLower(strings.TrimPrefix(configKey.Hash, "sha256:")),
+			Hosts:     configKey.Hosts,
+			Paths:     configKey.Paths,
+			ExpiresAt: configKey.ExpiresAt,
+			Source:    SourceConfig,
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Keep the last use of unchanged keys
+	for _, key := range keys {
+		if previous, exists := s.byHash[key.Hash]; exists && previous.Source == SourceConfig {
+			key.LastUsed = previous.LastUsed
+		}
+	}
+	s.config = keys
+	s.index()
+}
+
+// index rebuilds the hash index, the caller must hold the lock
+func (s *Store) index() {
+	s.byHash = make(map[string]*Key, len(s.config)+len(s.managed))
+	for _, key := range s.managed {
+		s.byHash[key.Hash] = key
+	}
+	for _, key := range s.config {
+		s.byHash[key.Hash] = key
+	}
+}
+
+// Authenticate returns the key matching raw and records its use
+func (s *Store) Authenticate(raw string) (Key, error) {
+	hash := Hash(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, exists := s.byHash[hash]
+	if !exists {
+		return Key{}, ErrUnknownKey
+	}
+	if !key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt) {
+		return *key, ErrExpiredKey
+	}
+	key.LastUsed = time.Now()
+	return *key, nil
+}
+
+// Create adds a key and returns it with its raw value, which can't be retrieved later
+func (s *Store) Create(name string, hosts, paths []string, expiresAt time.Time) (string, Key, error) {
+	raw, err := generate()
+	if err != nil {
+		return "", Key{}, err
+	}
+	key := &Key{
+		Name:      name,
+		Hash:      Hash(raw),
+		Hosts:     hosts,
+		Paths:     paths,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+		Source:    SourceAdmin,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.find(name) != nil {
+		return "", Key{}, ErrKeyExists
+	}
+	s.managed = append(s.managed, key)
+	if err := s.save(); err != nil {
+		s.managed = s.managed[:len(s.managed)-1]
+		return "", Key{}, err
+	}
+	s.index()
+	return raw, *key, nil
+}
+
+// Delete removes a key created through the admin API
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := s.find(name)
+	if key == nil {
+		return ErrUnknownKey
+	}
+	if key.Source == SourceConfig {
+		return ErrConfigKey
+	}
+
+	previous := s.managed
+	s.managed = make([]*Key, 0, len(previous))
+	for _, managed := range previous {
+		if managed != key {
+			s.managed = append(s.managed, managed)
+		}
+	}
+	if err := s.save(); err != nil {
+		s.managed = previous
+		return err
+	}
+	s.index()
+	return nil
+}
+
+// List returns the keys without their hashes, sorted by name
+func (s *Store) List() []Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]Key, 0, len(s.config)+len(s.managed))
+	for _, key := range append(append([]*Key{}, s.config...), s.managed...) {
+		listed := *key
+		listed.Hash = ""
+		keys = append(keys, listed)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+	return keys
+}
+
+// find returns the key with the given name, the caller must hold the lock
+func (s *Store) find(name string) *Key {
+	for _, key := range s.config {
+		if key.Name == name {
+			return key
+		}
+	}
+	for _, key := range s.managed {
+		if key.Name == name {
+			return key
+		}
+	}
+	return nil
+}
+
+// save writes the keys created through the admin API, the caller must hold the lock
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(keysFile{Keys: s.managed}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write API keys file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write API keys file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write API keys file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write API keys file: %w", err)
+	}
+	return nil
+}
+
+// IsKey returns true if the credential looks like an API key rather than a Plex token
+func IsKey(credential string) bool {
+	return strings.HasPrefix(credential, Prefix)
+}
+
+// Hash returns the hex-encoded SHA-256 hash of a raw key
+func Hash(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// generate returns a new random key
+func generate() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	return Prefix + hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,177 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+)
+
+// EventType tells which component emitted an event
+type EventType string
+
+const (
+	// EventAuth is an /auth decision
+	EventAuth EventType = "auth"
+	// EventLogin is a login through the Plex OAuth flow
+	EventLogin EventType = "login"
+	// EventLogout is a logout
+	EventLogout EventType = "logout"
+	// EventAdmin is an action through the admin API or dashboard
+	EventAdmin EventType = "admin"
+	// EventAccess is the revocation of the sessions of a user who lost access to the Plex server
+	EventAccess EventType = "access"
+)
+
+// Event is an audit record. It never contains tokens, sessions are
+// identified by cache.SessionID.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     EventType `json:"type"`
+	UserID   int       `json:"user_id,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Service  string    `json:"service,omitempty"`
+	ClientIP string    `json:"client_ip,omitempty"`
+	Host     string    `json:"host,omitempty"`
+	URI      string    `json:"uri,omitempty"`
+	// Decision is e.g. "allowed", "invalid", "no_access" or "policy_denied" for /auth,
+	// "success" or "failure" for other events
+	Decision string `json:"decision"`
+	Reason   string `json:"reason,omitempty"`
+	// Action is the admin action, e.g. "revoke_user"
+	Action  string `json:"action,omitempty"`
+	Session string `json:"session,omitempty"`
+}
+
+// Query filters the events returned by Logger.Query, zero values match everything
+type Query struct {
+	Type     EventType
+	User     string
+	Decision string
+	Since    time.Time
+	Limit    int
+}
+
+// matches returns true if the event passes the filters
+func (q Query) matches(event Event) bool {
+	if q.Type != "" && event.Type != q.Type {
+		return false
+	}
+	if q.Decision != "" && event.Decision != q.Decision {
+		return false
+	}
+	if !q.Since.IsZero() && event.Time.Before(q.Since) {
+		return false
+	}
+	if q.User != "" && !strings.EqualFold(event.Username, q.User) && !strings.EqualFold(event.Service, q.User) && fmt.Sprint(event.UserID) != q.User {
+		return false
+	}
+	return true
+}
+
+// Logger writes audit events as JSON lines and keeps the most recent ones in memory
+type Logger struct {
+	mu      sync.Mutex
+	out     io.Writer
+	closer  io.Closer
+	recent  []Event
+	next    int
+	onEvent func(Event)
+}
+
+// NewLogger creates a logger writing to stdout, to a rotating file or nowhere
+// depending on the configuration
+func NewLogger(cfg config.Audit) (*Logger, error) {
+	l := &Logger{recent: make([]Event, 0, cfg.RecentEvents)}
+
+	switch cfg.Output {
+	case "":
+	case "stdout":
+		l.out = os.Stdout
+	default:
+		file, err := openRotatingFile(cfg.Output, int64(cfg.MaxSizeMB)*1024*1024, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.out, l.closer = file, file
+	}
+	return l, nil
+}
+
+// SetEventCallback sets a callback function that will be called with every event.
+// It is called on the request path and must not block.
+func (l *Logger) SetEventCallback(callback func(Event)) {
+	l.onEvent = callback
+}
+
+// Log records an event, setting its time if missing
+func (l *Logger) Log(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if l.onEvent != nil {
+		l.onEvent(event)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cap(l.recent) > 0 {
+		if len(l.recent) < cap(l.recent) {
+			l.recent = append(l.recent, event)
+		} else {
+			l.recent[l.next] = event
+			l.next = (l.next + 1) % len(l.recent)
+		}
+	}
+
+	if l.out == nil {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("⚠️  Failed to encode audit event: %v", err)
+		return
+	}
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		log.Printf("⚠️  Failed to write audit event: %v", err)
+	}
+}
+
+// Query returns the recent events matching the query, most recent first
+func (l *Logger) Query(q Query) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := []Event{}
+	for i := len(l.recent) - 1; i >= 0; i-- {
+		event := l.recent[(l.next+i)%len(l.recent)]
+		if !q.matches(event) {
+			continue
+		}
+		events = append(events, event)
+		if q.Limit > 0 && len(events) >= q.Limit {
+			break
+		}
+	}
+	return events
+}
+
+// Close closes the audit file, if any
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closer == nil {
+		return nil
+	}
+	err := l.closer.Close()
+	l.out, l.closer = nil, nil
+	return err
+}
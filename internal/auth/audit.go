@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/audit"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/clientip"
+)
+
+// Audit decisions besides the ones recorded on sessions
+const (
+	DecisionRevoked     = "revoked"
+	DecisionUnavailable = "unavailable"
+	DecisionRateLimited = "rate_limited"
+	DecisionLockedOut   = "locked_out"
+	DecisionBypassed    = "bypassed"
+	DecisionExpired     = "expired"
+	DecisionSuccess     = "success"
+	DecisionFailure     = "failure"
+)
+
+// auditEvent describes a request for the audit log. The token is only kept as its
+// session ID and the original URI without its query string, which may carry tokens.
+// entry may be nil when the user is unknown.
+func auditEvent(r *http.Request, eventType audit.EventType, token string, entry *cache.TokenCacheEntry) audit.Event {
+	host, path := originalRequest(r)
+	event := audit.Event{
+		Type:     eventType,
+		ClientIP: clientip.FromRequest(r),
+		Host:     host,
+		URI:      path,
+	}
+	if token != "" {
+		event.Session = cache.SessionID(token)
+	}
+	if entry != nil {
+		event.UserID = entry.UserID
+		event.Username = entry.Username
+	}
+	return event
+}
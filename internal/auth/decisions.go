@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// recentDecisions is the number of /auth decisions kept for the admin dashboard
+const recentDecisions = 100
+
+// DecisionRecord is the outcome of an /auth request
+type DecisionRecord struct {
+	Time     time.Time `json:"time"`
+	UserID   int       `json:"user_id,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Service  string    `json:"service,omitempty"`
+	Host     string    `json:"host"`
+	Path     string    `json:"path"`
+	ClientIP string    `json:"client_ip"`
+	Decision string    `json:"decision"`
+	// Source tells where the validation result came from, e.g. "cached", empty for Plex
+	Source string `json:"source,omitempty"`
+}
+
+// DecisionLog keeps the most recent /auth decisions in memory
+type DecisionLog struct {
+	mu      sync.Mutex
+	records []DecisionRecord
+	next    int
+}
+
+// NewDecisionLog creates a log keeping the last size decisions
+func NewDecisionLog(size int) *DecisionLog {
+	return &DecisionLog{records: make([]DecisionRecord, 0, size)}
+}
+
+// Record adds a decision, replacing the oldest one when the log is full
+func (l *DecisionLog) Record(record DecisionRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.records) < cap(l.records) {
+		l.records = append(l.records, record)
+		return
+	}
+	l.records[l.next] = record
+	l.next = (l.next + 1) % len(l.records)
+}
+
+// Recent returns the recorded decisions, most recent first
+func (l *DecisionLog) Recent() []DecisionRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	recent := make([]DecisionRecord, 0, len(l.records))
+	for i := len(l.records) - 1; i >= 0; i-- {
+		recent = append(recent, l.records[(l.next+i)%len(l.records)])
+	}
+	return recent
+}
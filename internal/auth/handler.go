@@ -1,32 +1,95 @@
 package auth
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"time"
 
+	"github.com/hubert_i/nginx_plex_auth_server/internal/access"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/apikeys"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/audit"
 	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/clientip"
 	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/policy"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/ratelimit"
 	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
 )
 
+// APIKeyHeader is the header carrying the API key of scripts and services
+const APIKeyHeader = "X-API-Key"
+
+// Decisions recorded on the sessions listed by the admin API and in the audit log
+const (
+	DecisionAllowed      = "allowed"
+	DecisionInvalid      = "invalid"
+	DecisionNoAccess     = "no_access"
+	DecisionPolicyDenied = "policy_denied"
+)
+
 // Handler manages authentication requests
 type Handler struct {
 	config      *config.Config
 	plexClient  *plex.Client
 	tokenCache  *cache.TokenCache
+	accessList  *access.Refresher
+	settings    atomic.Pointer[settings]
+	decisions   *DecisionLog
+	auditLog    *audit.Logger
+	guard       *ratelimit.Guard
+	apiKeys     *apikeys.Store
+	sessions    *Sessions
+}
+
+// settings holds the reloadable settings of the handler.
+// They are swapped as a whole so a request uses a consistent snapshot.
+type settings struct {
+	policies *policy.Engine
+	headers  config.Headers
 }
 
 // NewHandler creates a new authentication handler
-func NewHandler(cfg *config.Config) *Handler {
-	return &Handler{
+func NewHandler(cfg *config.Config, client *plex.Client, tokenCache *cache.TokenCache, accessList *access.Refresher, auditLog *audit.Logger, guard *ratelimit.Guard, apiKeys *apikeys.Store, sessions *Sessions) *Handler {
+	h := &Handler{
 		config:     cfg,
-		plexClient: plex.NewClient(cfg.PlexURL, cfg.PlexToken, cfg.PlexClientID),
-		tokenCache: cache.NewTokenCache(cfg.CacheTTL, cfg.CacheMaxSize),
+		plexClient: client,
+		tokenCache: tokenCache,
+		accessList: accessList,
+		decisions:  NewDecisionLog(recentDecisions),
+		auditLog:   auditLog,
+		guard:      guard,
+		apiKeys:    apiKeys,
+		sessions:   sessions,
 	}
+	h.ApplyConfig(cfg)
+	return h
+}
+
+// Decisions returns the log of the recent /auth decisions
+func (h *Handler) Decisions() *DecisionLog {
+	return h.decisions
+}
+
+// ApplyConfig swaps the policies and identity headers used by new requests,
+// in-flight requests finish with the previous ones
+func (h *Handler) ApplyConfig(cfg *config.Config) {
+	h.settings.Store(&settings{
+		policies: policy.NewEngine(cfg.Policies),
+		headers:  cfg.Headers,
+	})
 }
 
 // HandleAuth processes Nginx auth_request subrequests
 func (h *Handler) HandleAuth(w http.ResponseWriter, r *http.Request) {
+	if h.authorizeNetwork(w, r) {
+		return
+	}
+
 	// Extract authentication token from header or cookie
 	token := h.extractToken(r)
 
@@ -36,83 +99,429 @@ func (h *Handler) HandleAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Scripts and services authenticate with an API key instead of a Plex token
+	if apikeys.IsKey(token) {
+		h.authorizeAPIKey(w, r, token)
+		return
+	}
+
+	if h.tokenCache.IsRevoked(token) {
+		log.Println("Revoked authentication token")
+		h.audit(r, token, nil, DecisionRevoked, "token revoked through the admin API")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !h.checkSession(w, r, token) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
 	// Check cache first
 	if cached, found := h.tokenCache.Get(token); found {
-		log.Println("Using cached token validation result")
+		// Invalid results are cached, their uses still count toward the lockout
 		if !cached.Valid {
-			log.Println("Invalid authentication token (cached)")
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+			if !h.guard.CheckToken(w, token) {
+				log.Println("Authentication token locked out after repeated failed validations")
+				h.audit(r, token, nil, DecisionLockedOut, "token locked out after repeated failed validations")
+				return
+			}
+			h.tokenFailed(token)
 		}
-		if !cached.HasAccess {
-			log.Println("User does not have access to the specified Plex server (cached)")
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-		log.Printf("Authentication and server access validation successful (cached, user: %s)", cached.Username)
-		w.WriteHeader(http.StatusOK)
+		log.Println("Using cached token validation result")
+		h.authorize(w, r, token, cached, "cached")
+		return
+	}
+
+	// Cache miss - tokens failing validation repeatedly and clients validating
+	// too many tokens aren't sent to Plex
+	if !h.guard.CheckToken(w, token) {
+		log.Println("Authentication token locked out after repeated failed validations")
+		h.audit(r, token, nil, DecisionLockedOut, "token locked out after repeated failed validations")
+		return
+	}
+	if !h.guard.Allow(w, r, ratelimit.EndpointAuth) {
+		h.audit(r, token, nil, DecisionRateLimited, "too many validations with Plex")
 		return
 	}
 
-	// Cache miss - validate with Plex
+	// A single identity lookup validates the token and identifies the user
 	log.Println("Cache miss - validating token with Plex")
-	valid, err := h.plexClient.ValidateToken(token)
+	identity, err := h.plexClient.IdentifyContext(r.Context(), token)
 	if err != nil {
 		log.Printf("Error validating token: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		h.respondUpstreamError(w, r, token, err)
 		return
 	}
 
-	if !valid {
+	if !identity.Valid {
 		// Cache the invalid result
 		h.tokenCache.Set(token, &cache.TokenCacheEntry{
 			Valid:     false,
 			HasAccess: false,
 		})
-		log.Println("Invalid authentication token")
+		log.Printf("Invalid authentication token (client %s)", clientip.FromRequest(r))
+		h.audit(r, token, nil, DecisionInvalid, "token rejected by Plex")
+		h.tokenFailed(token)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	h.guard.TokenSucceeded(token)
+	userInfo := identity.User
 
-	// Check if user has access to the specified Plex server
-	hasAccess, err := h.plexClient.CheckServerAccess(token, h.config.PlexServerID)
+	// Check if user has access to the specified Plex server (snapshot lookup)
+	hasAccess, err := h.accessList.CheckAccess(r.Context(), userInfo.ID)
 	if err != nil {
 		log.Printf("Error checking server access: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		h.respondAccessError(w, r, token, err)
 		return
 	}
 
-	// Get user info for caching
-	userInfo, _ := h.plexClient.GetUserInfo(token)
-	username := "Unknown"
-	userID := 0
-	if userInfo != nil {
-		username = userInfo.Username
-		userID = userInfo.ID
-	}
-
 	// Cache the result
-	h.tokenCache.Set(token, &cache.TokenCacheEntry{
+	entry := &cache.TokenCacheEntry{
 		Valid:     true,
 		HasAccess: hasAccess,
-		UserID:    userID,
-		Username:  username,
-	})
+		UserID:    userInfo.ID,
+		Username:  userInfo.Username,
+		Email:     userInfo.Email,
+	}
+	h.tokenCache.Set(token, entry)
 
-	if !hasAccess {
-		log.Println("User does not have access to the specified Plex server")
+	h.authorize(w, r, token, entry, "")
+}
+
+// authorize writes the response for a validation result: the token must be valid,
+// the user must have access to the Plex server and the policy rules matching the
+// original request must allow the user. Successful responses carry identity headers.
+// A non-empty source (e.g. "cached") is added to the log messages.
+// The decision and client IP are recorded on the cached session of the token
+// and in the audit log.
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request, token string, entry *cache.TokenCacheEntry, source string) {
+	suffix := ""
+	if source != "" {
+		suffix = " (" + source + ")"
+	}
+
+	host, path := originalRequest(r)
+	record := func(decision, reason string) {
+		ip := clientip.FromRequest(r)
+		h.tokenCache.Touch(token, ip, decision)
+		h.decisions.Record(DecisionRecord{
+			Time:     time.Now(),
+			UserID:   entry.UserID,
+			Username: entry.Username,
+			Host:     host,
+			Path:     path,
+			ClientIP: ip,
+			Decision: decision,
+			Source:   source,
+		})
+		if source != "" {
+			reason += " (" + source + ")"
+		}
+		h.audit(r, token, entry, decision, reason)
+	}
+
+	if !entry.Valid {
+		log.Printf("Invalid authentication token%s", suffix)
+		record(DecisionInvalid, "token rejected by Plex")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !entry.HasAccess {
+		log.Printf("User does not have access to the specified Plex server%s", suffix)
+		record(DecisionNoAccess, "user has no access to the Plex server")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	current := h.settings.Load()
+
+	decision := current.policies.Evaluate(policy.Request{
+		Host:     host,
+		Path:     path,
+		ClientIP: clientip.FromRequest(r),
+		UserID:   entry.UserID,
+		Username: entry.Username,
+		Email:    entry.Email,
+	})
+	if !decision.Allowed {
+		log.Printf("Access to %s%s denied for user %s: %s", host, path, entry.Username, decision.Reason)
+		record(DecisionPolicyDenied, decision.Reason)
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
+	record(DecisionAllowed, decision.Reason)
+	setIdentityHeaders(w, current.headers, entry)
+
 	// Authentication and authorization successful
-	log.Printf("Authentication and server access validation successful (user: %s)", username)
+	if source != "" {
+		log.Printf("Authentication and server access validation successful (%s, user: %s)", source, entry.Username)
+	} else {
+		log.Printf("Authentication and server access validation successful (user: %s)", entry.Username)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// authorizeNetwork applies the network conditions of the policy rule matching the original
+// request, before authentication. It writes the response and returns true if the client
+// network decides: bypassed requests are allowed without a token, others are denied.
+func (h *Handler) authorizeNetwork(w http.ResponseWriter, r *http.Request) bool {
+	current := h.settings.Load()
+	host, path := originalRequest(r)
+	ip := clientip.FromRequest(r)
+
+	decision, decided := current.policies.EvaluateNetwork(policy.Request{Host: host, Path: path, ClientIP: ip})
+	if !decided {
+		return false
+	}
+
+	record := DecisionRecord{Time: time.Now(), Host: host, Path: path, ClientIP: ip, Decision: DecisionPolicyDenied}
+	if decision.Bypass {
+		record.Decision = DecisionBypassed
+	}
+	h.decisions.Record(record)
+	h.audit(r, "", nil, record.Decision, decision.Reason)
+
+	if !decision.Bypass {
+		log.Printf("Access to %s%s denied for client %s: %s", host, path, ip, decision.Reason)
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+
+	log.Printf("Authentication bypassed for %s%s from client %s: %s", host, path, ip, decision.Reason)
+	if current.headers.Bypass != "" {
+		w.Header().Set(current.headers.Bypass, decision.Rule)
+	}
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// checkSession ends cookie sessions past their maximum lifetime or idle timeout,
+// whatever Plex says about their token, and renews the state cookie of active
+// sessions once past half its lifetime. Tokens sent in headers have no session.
+// It returns false if the session ended.
+func (h *Handler) checkSession(w http.ResponseWriter, r *http.Request, token string) bool {
+	if err := h.sessions.Verify(w, r, token); err != nil {
+		user, _ := h.tokenCache.GetStale(token)
+		// The token is refused from headers too, the session can't be resumed by
+		// sending it in X-Plex-Token or by deleting the state cookie
+		h.tokenCache.EndSession(token)
+		log.Printf("Session ended (client %s): %v", clientip.FromRequest(r), err)
+		h.audit(r, token, user, DecisionExpired, err.Error())
+		return false
+	}
+	return true
+}
+
+// authorizeAPIKey writes the response for a request authenticated with an API key:
+// the key must exist, not be expired and be scoped to the original request. User
+// policy rules don't apply, only their network conditions checked before. Successful
+// responses carry the service identity header.
+func (h *Handler) authorizeAPIKey(w http.ResponseWriter, r *http.Request, raw string) {
+	host, path := originalRequest(r)
+	ip := clientip.FromRequest(r)
+
+	// Unknown keys count as failed validations, like invalid Plex tokens
+	if !h.guard.CheckToken(w, raw) {
+		log.Println("API key locked out after repeated failed validations")
+		h.auditAPIKey(r, "", DecisionLockedOut, "API key locked out after repeated failed validations")
+		return
+	}
+
+	key, err := h.apiKeys.Authenticate(raw)
+	record := func(decision, reason string) {
+		h.decisions.Record(DecisionRecord{
+			Time:     time.Now(),
+			Service:  key.Name,
+			Host:     host,
+			Path:     path,
+			ClientIP: ip,
+			Decision: decision,
+			Source:   "api key",
+		})
+		h.auditAPIKey(r, key.Name, decision, reason)
+	}
+
+	switch {
+	case errors.Is(err, apikeys.ErrUnknownKey):
+		log.Printf("Unknown API key (client %s)", ip)
+		record(DecisionInvalid, "unknown API key")
+		h.tokenFailed(raw)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	case err != nil:
+		log.Printf("API key %s rejected (client %s): %v", key.Name, ip, err)
+		record(DecisionInvalid, err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	h.guard.TokenSucceeded(raw)
+
+	if !key.Allows(host, path) {
+		log.Printf("Access to %s%s denied for API key %s: outside of its scopes", host, path, key.Name)
+		record(DecisionPolicyDenied, "request is outside of the scopes of API key "+key.Name)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	record(DecisionAllowed, "request is within the scopes of API key "+key.Name)
+	if headers := h.settings.Load().headers; headers.Service != "" {
+		w.Header().Set(headers.Service, key.Name)
+	}
+	log.Printf("API key authentication successful (service: %s)", key.Name)
 	w.WriteHeader(http.StatusOK)
 }
 
-// extractToken retrieves the authentication token from the request
+// setIdentityHeaders adds the configured identity headers for nginx to forward
+func setIdentityHeaders(w http.ResponseWriter, headers config.Headers, entry *cache.TokenCacheEntry) {
+	if headers.User != "" {
+		w.Header().Set(headers.User, entry.Username)
+	}
+	if headers.UserID != "" {
+		w.Header().Set(headers.UserID, strconv.Itoa(entry.UserID))
+	}
+	if headers.Email != "" && entry.Email != "" {
+		w.Header().Set(headers.Email, entry.Email)
+	}
+}
+
+// originalRequest returns the normalized host and path of the request nginx is authorizing.
+// X-Original-Host, X-Forwarded-Host and X-Original-URI are only believed from trusted
+// proxies, clients could otherwise pick a host or path matching no rule. The decoded
+// path is cleaned so "/public/../admin" is matched as "/admin".
+func originalRequest(r *http.Request) (string, string) {
+	host := r.Host
+	requestPath := r.URL.Path
+	if !clientip.FromTrustedProxy(r) {
+		return policy.NormalizeHost(host), path.Clean("/" + requestPath)
+	}
+
+	if original := r.Header.Get("X-Original-Host"); original != "" {
+		host = original
+	} else if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
+	if uri := r.Header.Get("X-Original-URI"); uri != "" {
+		if parsed, err := url.ParseRequestURI(uri); err == nil {
+			requestPath = parsed.Path
+		}
+	}
+
+	return policy.NormalizeHost(host), path.Clean("/" + requestPath)
+}
+
+// audit records an /auth decision in the audit log, entry may be nil when the user is unknown
+func (h *Handler) audit(r *http.Request, token string, entry *cache.TokenCacheEntry, decision, reason string) {
+	event := auditEvent(r, audit.EventAuth, token, entry)
+	event.Decision = decision
+	event.Reason = reason
+	h.auditLog.Log(event)
+}
+
+// auditAPIKey records an /auth decision on a request authenticated with an API key,
+// service is empty when the key is unknown
+func (h *Handler) auditAPIKey(r *http.Request, service, decision, reason string) {
+	event := auditEvent(r, audit.EventAuth, "", nil)
+	event.Service = service
+	event.Decision = decision
+	event.Reason = reason
+	h.auditLog.Log(event)
+}
+
+// respondUpstreamError writes the response for a failed validation of the user's token.
+// While Plex is unavailable or rate limiting us, a recently expired validation
+// result is served if available, otherwise nginx gets a 503 instead of a generic 500.
+func (h *Handler) respondUpstreamError(w http.ResponseWriter, r *http.Request, token string, err error) {
+	if errors.Is(err, plex.ErrUnauthorized) {
+		// The token was revoked between two calls
+		h.tokenCache.Set(token, &cache.TokenCacheEntry{
+			Valid:     false,
+			HasAccess: false,
+		})
+		log.Println("Invalid authentication token")
+		h.audit(r, token, nil, DecisionInvalid, "token rejected by Plex")
+		h.tokenFailed(token)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if errors.Is(err, plex.ErrUpstreamUnavailable) || errors.Is(err, plex.ErrRateLimited) {
+		if stale, found := h.tokenCache.GetStale(token); found {
+			h.authorize(w, r, token, stale, "stale, Plex unavailable")
+			return
+		}
+	}
+
+	h.audit(r, token, nil, DecisionUnavailable, err.Error())
+	h.writeUpstreamError(w, err)
+}
+
+// respondAccessError writes the response for a failed server access check. Access
+// checks use the owner token, their errors (e.g. a 401 once the owner token expired)
+// say nothing about the user's token: it isn't cached as invalid nor counted as a
+// failed validation. A recently expired validation result is served if available,
+// otherwise nginx gets a 503.
+func (h *Handler) respondAccessError(w http.ResponseWriter, r *http.Request, token string, err error) {
+	if stale, found := h.tokenCache.GetStale(token); found {
+		h.authorize(w, r, token, stale, "stale, access check failed")
+		return
+	}
+
+	h.audit(r, token, nil, DecisionUnavailable, err.Error())
+	if errors.Is(err, plex.ErrUpstreamUnavailable) || errors.Is(err, plex.ErrRateLimited) {
+		h.writeUpstreamError(w, err)
+		return
+	}
+	log.Println("Server access can't be checked with the owner token")
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// tokenFailed records a failed validation of a token, which is locked out after too many
+func (h *Handler) tokenFailed(token string) {
+	if h.guard.TokenFailed(token) {
+		log.Printf("⚠️  Authentication token %s locked out after repeated failed validations", cache.SessionID(token))
+	}
+}
+
+// writeUpstreamError writes the status code matching a failed Plex call
+func (h *Handler) writeUpstreamError(w http.ResponseWriter, err error) {
+	var rateLimitErr *plex.RateLimitError
+	var decodeErr *plex.DecodeError
+
+	switch {
+	case errors.As(err, &rateLimitErr):
+		log.Println("Plex is rate limiting requests")
+		if rateLimitErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(rateLimitErr.RetryAfter.Seconds())+1))
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, plex.ErrCircuitOpen):
+		log.Println("Plex is unavailable (circuit breaker open)")
+		if retryAfter := time.Until(h.plexClient.BreakerStats().OpenUntil); retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, plex.ErrUpstreamUnavailable):
+		log.Println("Plex is unavailable")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.As(err, &decodeErr):
+		log.Println("Plex returned an unexpected response")
+		w.WriteHeader(http.StatusBadGateway)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// extractToken retrieves the authentication token or API key from the request
 func (h *Handler) extractToken(r *http.Request) string {
-	// Try Authorization header first
+	// Try X-API-Key header first, API keys may also be sent as "Bearer <key>"
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+
+	// Try Authorization header
 	if auth := r.Header.Get("Authorization"); auth != "" {
 		// Support "Bearer <token>" format
 		if len(auth) > 7 && auth[:7] == "Bearer " {
@@ -127,7 +536,7 @@ func (h *Handler) extractToken(r *http.Request) string {
 	}
 
 	// Try cookie
-	if cookie, err := r.Cookie("X-Plex-Token"); err == nil {
+	if cookie, err := r.Cookie(h.config.Sessions.CookieName); err == nil {
 		return cookie.Value
 	}
 
@@ -146,37 +555,54 @@ func (h *Handler) HandleAuthWithRedirect(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// API keys can't log in, they are answered like /auth
+	if apikeys.IsKey(token) {
+		h.authorizeAPIKey(w, r, token)
+		return
+	}
+
+	if h.tokenCache.IsRevoked(token) {
+		log.Println("Revoked authentication token, redirecting to login")
+		h.audit(r, token, nil, DecisionRevoked, "token revoked through the admin API")
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !h.checkSession(w, r, token) {
+		h.sessions.Clear(w)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
 	// Validate token with Plex
-	valid, err := h.plexClient.ValidateToken(token)
+	identity, err := h.plexClient.IdentifyContext(r.Context(), token)
 	if err != nil {
 		log.Printf("Error validating token: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		h.writeUpstreamError(w, err)
 		return
 	}
 
-	if !valid {
+	if !identity.Valid {
 		log.Println("Invalid authentication token, redirecting to login")
+		h.audit(r, token, nil, DecisionInvalid, "token rejected by Plex")
 		// Clear the invalid cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:   "X-Plex-Token",
-			Value:  "",
-			Path:   "/",
-			MaxAge: -1,
-		})
+		h.sessions.Clear(w)
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
 
 	// Check if user has access to the specified Plex server
-	hasAccess, err := h.plexClient.CheckServerAccess(token, h.config.PlexServerID)
+	hasAccess, err := h.accessList.CheckAccess(r.Context(), identity.User.ID)
 	if err != nil {
 		log.Printf("Error checking server access: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		h.writeUpstreamError(w, err)
 		return
 	}
 
+	entry := &cache.TokenCacheEntry{UserID: identity.User.ID, Username: identity.User.Username}
 	if !hasAccess {
 		log.Println("User does not have access to the specified Plex server")
+		h.audit(r, token, entry, DecisionNoAccess, "user has no access to the Plex server")
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("You do not have access to this server"))
 		return
@@ -184,5 +610,6 @@ func (h *Handler) HandleAuthWithRedirect(w http.ResponseWriter, r *http.Request)
 
 	// Authentication and authorization successful
 	log.Println("Authentication and server access validation successful")
+	h.audit(r, token, entry, DecisionAllowed, "user has access to the Plex server")
 	w.WriteHeader(http.StatusOK)
 }
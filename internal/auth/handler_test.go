@@ -0,0 +1,487 @@
+package auth
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/access"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/apikeys"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/audit"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/clientip"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/ratelimit"
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex/plextest"
+)
+
+const testServerID = "test-server"
+
+// Accounts of the fake Plex: the owner, a user the server is shared with and
+// a user without access
+var (
+	testOwner  = plextest.User{ID: 1, Username: "owner", Email: "owner@example.com"}
+	testShared = plextest.User{ID: 2, Username: "alice", Email: "alice@example.com"}
+	testOther  = plextest.User{ID: 3, Username: "bob", Email: "bob@example.com"}
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testEnv wires the handlers to a fake Plex the way the server does
+type testEnv struct {
+	fake        *plextest.Fake
+	plexServer  *httptest.Server
+	config      *config.Config
+	tokenCache  *cache.TokenCache
+	accessList  *access.Refresher
+	auditLog    *audit.Logger
+	handler     *Handler
+	oauth       *OAuthHandler
+	sessions    *Sessions
+	ownerToken  string
+	sharedToken string
+	otherToken  string
+}
+
+// newTestEnv starts a fake Plex with the test accounts, configure may adjust the
+// configuration before the handlers are created
+func newTestEnv(t *testing.T, configure func(*config.Config)) *testEnv {
+	t.Helper()
+
+	env := &testEnv{fake: plextest.New()}
+	env.ownerToken = env.fake.AddUser(testOwner)
+	env.sharedToken = env.fake.AddUser(testShared)
+	env.otherToken = env.fake.AddUser(testOther)
+	env.fake.AddServer(plextest.Server{MachineID: testServerID, Name: "Test", OwnerID: testOwner.ID, Online: true})
+	env.fake.Share(testServerID, testShared.ID)
+	env.plexServer = plextest.NewServer(env.fake)
+	t.Cleanup(env.plexServer.Close)
+
+	cfg := config.Default()
+	cfg.PlexURL = env.plexServer.URL
+	cfg.PlexToken = env.ownerToken
+	cfg.PlexServerID = testServerID
+	cfg.Sessions.Secret = "test-session-secret"
+	cfg.Headers = config.Headers{User: "X-User", UserID: "X-User-ID", Email: "X-Email", Bypass: "X-Bypass"}
+	if configure != nil {
+		configure(cfg)
+	}
+	env.config = cfg
+
+	client := plex.NewClientWithOptions(cfg.PlexURL, cfg.PlexToken, cfg.PlexClientID, plex.Options{
+		RequestTimeout: 2 * time.Second,
+		Breaker:        plex.DefaultBreakerOptions(),
+	})
+	env.tokenCache = cache.NewTokenCache(cfg.CacheTTL, cfg.CacheMaxSize)
+	env.tokenCache.SetStaleGrace(cfg.CacheStaleGrace)
+	t.Cleanup(env.tokenCache.Stop)
+	env.accessList = access.NewRefresher(client, cfg.PlexServerID, cfg.SharedUsersRefreshInterval)
+
+	var err error
+	env.auditLog, err = audit.NewLogger(cfg.Audit)
+	if err != nil {
+		t.Fatalf("audit.NewLogger: %v", err)
+	}
+	keys, err := apikeys.NewStore("", cfg.APIKeys)
+	if err != nil {
+		t.Fatalf("apikeys.NewStore: %v", err)
+	}
+	env.sessions = NewSessions(cfg)
+
+	env.handler = NewHandler(cfg, client, env.tokenCache, env.accessList, env.auditLog, ratelimit.NewGuard(cfg.RateLimit), keys, env.sessions)
+	env.oauth = NewOAuthHandler(cfg, client, env.tokenCache, env.accessList, env.auditLog, env.sessions)
+	return env
+}
+
+// serve sends a request to a handler through the client IP middleware, like the server does
+func (env *testEnv) serve(handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	clientip.NewResolver(env.config.TrustedProxies).Middleware(handler).ServeHTTP(recorder, r)
+	return recorder
+}
+
+// auth sends an /auth subrequest with the given token (none if empty)
+func (env *testEnv) auth(token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	if token != "" {
+		r.Header.Set("X-Plex-Token", token)
+	}
+	return env.serve(env.handler.HandleAuth, r)
+}
+
+// lastDecision returns the decision of the most recent /auth audit event
+func (env *testEnv) lastDecision(t *testing.T) string {
+	t.Helper()
+	events := env.auditLog.Query(audit.Query{Type: audit.EventAuth, Limit: 1})
+	if len(events) == 0 {
+		t.Fatal("no /auth audit event recorded")
+	}
+	return events[0].Decision
+}
+
+func TestHandleAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    func(env *testEnv) string
+		status   int
+		decision string
+		user     string
+	}{
+		{
+			name:     "shared user",
+			token:    func(env *testEnv) string { return env.sharedToken },
+			status:   http.StatusOK,
+			decision: DecisionAllowed,
+			user:     testShared.Username,
+		},
+		{
+			name:     "owner",
+			token:    func(env *testEnv) string { return env.ownerToken },
+			status:   http.StatusOK,
+			decision: DecisionAllowed,
+			user:     testOwner.Username,
+		},
+		{
+			name:     "invalid token",
+			token:    func(env *testEnv) string { return "not-a-plex-token" },
+			status:   http.StatusUnauthorized,
+			decision: DecisionInvalid,
+		},
+		{
+			name: "token revoked by Plex",
+			token: func(env *testEnv) string {
+				env.fake.RevokeToken(env.sharedToken)
+				return env.sharedToken
+			},
+			status:   http.StatusUnauthorized,
+			decision: DecisionInvalid,
+		},
+		{
+			name:     "no server access",
+			token:    func(env *testEnv) string { return env.otherToken },
+			status:   http.StatusForbidden,
+			decision: DecisionNoAccess,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, nil)
+
+			recorder := env.auth(tt.token(env))
+
+			if recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.status)
+			}
+			if decision := env.lastDecision(t); decision != tt.decision {
+				t.Errorf("decision = %q, want %q", decision, tt.decision)
+			}
+			if user := recorder.Header().Get("X-User"); user != tt.user {
+				t.Errorf("X-User = %q, want %q", user, tt.user)
+			}
+		})
+	}
+}
+
+func TestHandleAuthIdentityHeaders(t *testing.T) {
+	env := newTestEnv(t, nil)
+
+	recorder := env.auth(env.sharedToken)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	want := map[string]string{"X-User": "alice", "X-User-ID": "2", "X-Email": "alice@example.com"}
+	for header, value := range want {
+		if got := recorder.Header().Get(header); got != value {
+			t.Errorf("%s = %q, want %q", header, got, value)
+		}
+	}
+}
+
+func TestHandleAuthIdentifiesOnce(t *testing.T) {
+	env := newTestEnv(t, nil)
+	// Load the shared users first, the snapshot identifies the owner
+	if err := env.accessList.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	env.fake.ResetRequests()
+
+	if recorder := env.auth(env.sharedToken); recorder.Code != http.StatusOK {
+		t.Fatalf("status on a cache miss = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if requests := env.fake.Requests("/api/v2/user"); requests != 1 {
+		t.Errorf("identity requests on a cache miss = %d, want 1", requests)
+	}
+	if requests := env.fake.Requests(""); requests != 1 {
+		t.Errorf("Plex requests on a cache miss = %d, want 1", requests)
+	}
+
+	env.fake.ResetRequests()
+	if recorder := env.auth(env.sharedToken); recorder.Code != http.StatusOK {
+		t.Fatalf("status on a cache hit = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if requests := env.fake.Requests(""); requests != 0 {
+		t.Errorf("Plex requests on a cache hit = %d, want none", requests)
+	}
+}
+
+func TestHandleAuthNoToken(t *testing.T) {
+	env := newTestEnv(t, nil)
+
+	if recorder := env.auth(""); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+	if requests := env.fake.Requests(""); requests != 0 {
+		t.Errorf("Plex received %d request(s), want none", requests)
+	}
+}
+
+func TestHandleAuthRevokedSession(t *testing.T) {
+	env := newTestEnv(t, nil)
+
+	if recorder := env.auth(env.sharedToken); recorder.Code != http.StatusOK {
+		t.Fatalf("status before revocation = %d, want %d", recorder.Code, http.StatusOK)
+	}
+
+	env.tokenCache.RevokeUser(testShared.ID)
+
+	if recorder := env.auth(env.sharedToken); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("status after revocation = %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+	if decision := env.lastDecision(t); decision != DecisionRevoked {
+		t.Errorf("decision = %q, want %q", decision, DecisionRevoked)
+	}
+}
+
+func TestHandleAuthPlexUnreachable(t *testing.T) {
+	tests := []struct {
+		name       string
+		staleGrace time.Duration
+		status     int
+		user       string
+	}{
+		{name: "with stale grace", staleGrace: time.Minute, status: http.StatusOK, user: testShared.Username},
+		{name: "without stale grace", staleGrace: 0, status: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, func(cfg *config.Config) {
+				cfg.CacheTTL = 10 * time.Millisecond
+				cfg.CacheStaleGrace = tt.staleGrace
+			})
+
+			if recorder := env.auth(env.sharedToken); recorder.Code != http.StatusOK {
+				t.Fatalf("status while Plex is reachable = %d, want %d", recorder.Code, http.StatusOK)
+			}
+
+			// Let the cached result expire, then take Plex down
+			time.Sleep(20 * time.Millisecond)
+			env.plexServer.Close()
+
+			recorder := env.auth(env.sharedToken)
+			if recorder.Code != tt.status {
+				t.Fatalf("status while Plex is unreachable = %d, want %d", recorder.Code, tt.status)
+			}
+			if user := recorder.Header().Get("X-User"); user != tt.user {
+				t.Errorf("X-User = %q, want %q", user, tt.user)
+			}
+		})
+	}
+}
+
+func TestHandleAuthOwnerTokenRejected(t *testing.T) {
+	env := newTestEnv(t, nil)
+
+	// The owner token expires before the shared users are loaded
+	env.fake.RevokeToken(env.ownerToken)
+
+	recorder := env.auth(env.sharedToken)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	if entry, found := env.tokenCache.Get(env.sharedToken); found && !entry.Valid {
+		t.Error("the user's token was cached as invalid after the owner token was rejected")
+	}
+}
+
+func TestHandleAuthPolicies(t *testing.T) {
+	policies := []config.PolicyRule{
+		{Name: "admin", Hosts: []string{"app.example.com"}, Paths: []string{"/admin"}, AllowUsers: []string{testOwner.Username}},
+		{Name: "lan", Hosts: []string{"app.example.com"}, Paths: []string{"/public"}, BypassNetworks: []string{"10.1.0.0/16"}},
+		{Name: "blocked", Hosts: []string{"blocked.example.com"}, DenyNetworks: []string{"203.0.113.0/24"}},
+	}
+
+	tests := []struct {
+		name       string
+		token      func(env *testEnv) string
+		remoteAddr string
+		host       string
+		headers    map[string]string
+		status     int
+		decision   string
+		user       string
+		bypass     string
+	}{
+		{
+			name:     "allowed by a rule",
+			token:    func(env *testEnv) string { return env.ownerToken },
+			host:     "app.example.com",
+			headers:  map[string]string{"X-Original-URI": "/admin/settings"},
+			status:   http.StatusOK,
+			decision: DecisionAllowed,
+			user:     testOwner.Username,
+		},
+		{
+			name:     "denied by a rule",
+			token:    func(env *testEnv) string { return env.sharedToken },
+			host:     "app.example.com",
+			headers:  map[string]string{"X-Original-URI": "/admin/settings"},
+			status:   http.StatusForbidden,
+			decision: DecisionPolicyDenied,
+		},
+		{
+			name:     "dot segments are cleaned",
+			token:    func(env *testEnv) string { return env.sharedToken },
+			host:     "app.example.com",
+			headers:  map[string]string{"X-Original-URI": "/public/../admin?tab=users"},
+			status:   http.StatusForbidden,
+			decision: DecisionPolicyDenied,
+		},
+		{
+			name:     "encoded dot segments are cleaned",
+			token:    func(env *testEnv) string { return env.sharedToken },
+			host:     "app.example.com",
+			headers:  map[string]string{"X-Original-URI": "/public/%2e%2e/admin"},
+			status:   http.StatusForbidden,
+			decision: DecisionPolicyDenied,
+		},
+		{
+			name:     "prefixes match whole segments",
+			token:    func(env *testEnv) string { return env.sharedToken },
+			host:     "app.example.com",
+			headers:  map[string]string{"X-Original-URI": "/administrator"},
+			status:   http.StatusOK,
+			decision: DecisionAllowed,
+			user:     testShared.Username,
+		},
+		{
+			name:     "no rule matched",
+			token:    func(env *testEnv) string { return env.sharedToken },
+			host:     "other.example.com",
+			headers:  map[string]string{"X-Original-URI": "/admin"},
+			status:   http.StatusOK,
+			decision: DecisionAllowed,
+			user:     testShared.Username,
+		},
+		{
+			name:       "bypassed network behind a trusted proxy",
+			token:      func(env *testEnv) string { return "" },
+			remoteAddr: "10.0.0.1:40000",
+			host:       "app.example.com",
+			headers:    map[string]string{"X-Original-URI": "/public/index.html", "X-Forwarded-For": "10.1.2.3"},
+			status:     http.StatusOK,
+			decision:   DecisionBypassed,
+			bypass:     "lan",
+		},
+		{
+			name:       "forwarded client IP of an untrusted peer isn't bypassed",
+			token:      func(env *testEnv) string { return "" },
+			remoteAddr: "192.0.2.1:40000",
+			host:       "app.example.com",
+			headers:    map[string]string{"X-Original-URI": "/public/index.html", "X-Forwarded-For": "10.1.2.3"},
+			status:     http.StatusUnauthorized,
+		},
+		{
+			name:       "denied network despite a valid login",
+			token:      func(env *testEnv) string { return env.ownerToken },
+			remoteAddr: "203.0.113.9:40000",
+			host:       "blocked.example.com",
+			status:     http.StatusForbidden,
+			decision:   DecisionPolicyDenied,
+		},
+		{
+			name:       "X-Original-Host and X-Forwarded-Host of an untrusted peer are ignored",
+			token:      func(env *testEnv) string { return env.ownerToken },
+			remoteAddr: "203.0.113.9:40000",
+			host:       "blocked.example.com",
+			headers:    map[string]string{"X-Original-Host": "other.example.com", "X-Forwarded-Host": "other.example.com"},
+			status:     http.StatusForbidden,
+			decision:   DecisionPolicyDenied,
+		},
+		{
+			name:       "X-Original-URI of an untrusted peer is ignored",
+			token:      func(env *testEnv) string { return "" },
+			remoteAddr: "10.1.2.3:40000",
+			host:       "app.example.com",
+			headers:    map[string]string{"X-Original-URI": "/public/index.html"},
+			status:     http.StatusUnauthorized,
+		},
+		{
+			name:       "X-Forwarded-Host of a trusted proxy is used",
+			token:      func(env *testEnv) string { return env.sharedToken },
+			remoteAddr: "10.0.0.1:40000",
+			host:       "auth:8080",
+			headers:    map[string]string{"X-Original-URI": "/admin", "X-Forwarded-Host": "app.example.com"},
+			status:     http.StatusForbidden,
+			decision:   DecisionPolicyDenied,
+		},
+		{
+			name:     "X-Original-Host takes precedence and is normalized",
+			token:    func(env *testEnv) string { return env.sharedToken },
+			host:     "auth:8080",
+			headers:  map[string]string{"X-Original-URI": "/admin", "X-Original-Host": "APP.example.com.:443", "X-Forwarded-Host": "other.example.com"},
+			status:   http.StatusForbidden,
+			decision: DecisionPolicyDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, func(cfg *config.Config) {
+				cfg.Policies = policies
+				cfg.TrustedProxies = []string{"10.0.0.1"}
+			})
+
+			// Requests come from nginx unless the peer is given
+			r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+			r.Host = tt.host
+			r.RemoteAddr = "10.0.0.1:40000"
+			if tt.remoteAddr != "" {
+				r.RemoteAddr = tt.remoteAddr
+			}
+			for header, value := range tt.headers {
+				r.Header.Set(header, value)
+			}
+			if token := tt.token(env); token != "" {
+				r.Header.Set("X-Plex-Token", token)
+			}
+			recorder := env.serve(env.handler.HandleAuth, r)
+
+			if recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.status)
+			}
+			if tt.decision != "" {
+				if decision := env.lastDecision(t); decision != tt.decision {
+					t.Errorf("decision = %q, want %q", decision, tt.decision)
+				}
+			}
+			if user := recorder.Header().Get("X-User"); user != tt.user {
+				t.Errorf("X-User = %q, want %q", user, tt.user)
+			}
+			if bypass := recorder.Header().Get("X-Bypass"); bypass != tt.bypass {
+				t.Errorf("X-Bypass = %q, want %q", bypass, tt.bypass)
+			}
+		})
+	}
+}
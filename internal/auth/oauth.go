@@ -2,13 +2,17 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"strconv"
 
+	"github.com/hubert_i/nginx_plex_auth_server/internal/access"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/audit"
 	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/clientip"
 	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
 	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
 )
@@ -18,14 +22,20 @@ type OAuthHandler struct {
 	config     *config.Config
 	plexClient *plex.Client
 	tokenCache *cache.TokenCache
+	accessList *access.Refresher
+	auditLog   *audit.Logger
+	sessions   *Sessions
 }
 
 // NewOAuthHandler creates a new OAuth handler
-func NewOAuthHandler(cfg *config.Config, client *plex.Client) *OAuthHandler {
+func NewOAuthHandler(cfg *config.Config, client *plex.Client, tokenCache *cache.TokenCache, accessList *access.Refresher, auditLog *audit.Logger, sessions *Sessions) *OAuthHandler {
 	return &OAuthHandler{
 		config:     cfg,
 		plexClient: client,
-		tokenCache: cache.NewTokenCache(cfg.CacheTTL, cfg.CacheMaxSize),
+		tokenCache: tokenCache,
+		accessList: accessList,
+		auditLog:   auditLog,
+		sessions:   sessions,
 	}
 }
 
@@ -50,13 +60,13 @@ func (h *OAuthHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		redirectURL = "/" // Default to home if no redirect specified
 	}
 
-	log.Printf("Login initiated with redirect URL: %s", redirectURL)
+	log.Printf("Login initiated with redirect URL: %s (client %s)", redirectURL, clientip.FromRequest(r))
 
 	// Request a PIN from Plex
-	pinResp, err := h.plexClient.RequestAuthPin()
+	pinResp, err := h.plexClient.RequestAuthPinContext(r.Context())
 	if err != nil {
 		log.Printf("Error requesting auth PIN: %v", err)
-		http.Error(w, "Failed to initiate authentication", http.StatusInternalServerError)
+		writePlexError(w, err, "Failed to initiate authentication")
 		return
 	}
 
@@ -99,10 +109,15 @@ func (h *OAuthHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 
 	// Check the PIN status
 	log.Printf("Checking PIN %d status...", pinID)
-	checkResp, err := h.plexClient.CheckAuthPin(pinID)
+	checkResp, err := h.plexClient.CheckAuthPinContext(r.Context(), pinID)
 	if err != nil {
 		log.Printf("Error checking auth PIN %d: %v", pinID, err)
-		http.Error(w, "Failed to verify authentication", http.StatusInternalServerError)
+		var statusErr *plex.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			http.Error(w, "Authentication PIN expired, please log in again", http.StatusGone)
+			return
+		}
+		writePlexError(w, err, "Failed to verify authentication")
 		return
 	}
 
@@ -115,38 +130,44 @@ func (h *OAuthHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("PIN %d authenticated successfully, got token", pinID)
 
+	userInfo, err := h.plexClient.GetUserInfoContext(r.Context(), checkResp.AuthToken)
+	if err != nil {
+		log.Printf("Error getting user info: %v", err)
+		h.audit(r, audit.EventLogin, checkResp.AuthToken, nil, DecisionFailure, "failed to identify the user: "+err.Error())
+		writePlexError(w, err, "Failed to verify server access")
+		return
+	}
+	user := &cache.TokenCacheEntry{UserID: userInfo.ID, Username: userInfo.Username}
+
 	// Verify the user has access to the server
-	hasAccess, err := h.plexClient.CheckServerAccess(checkResp.AuthToken, h.config.PlexServerID)
+	hasAccess, err := h.accessList.CheckAccess(r.Context(), userInfo.ID)
 	if err != nil {
 		log.Printf("Error checking server access: %v", err)
-		http.Error(w, "Failed to verify server access", http.StatusInternalServerError)
+		h.audit(r, audit.EventLogin, checkResp.AuthToken, user, DecisionFailure, "failed to check server access: "+err.Error())
+		writePlexError(w, err, "Failed to verify server access")
 		return
 	}
 
 	if !hasAccess {
 		log.Println("User authenticated but does not have access to the server")
+		h.audit(r, audit.EventLogin, checkResp.AuthToken, user, DecisionFailure, "user has no access to the Plex server")
 		http.Error(w, "You do not have access to this Plex server", http.StatusForbidden)
 		return
 	}
 
-	// Create the session cookie
-	cookie := &http.Cookie{
-		Name:     "X-Plex-Token",
-		Value:    checkResp.AuthToken,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   h.config.CookieSecure,
-		SameSite: http.SameSiteLaxMode,
-		MaxAge:   30 * 24 * 60 * 60, // 30 days
-	}
-
-	if h.config.CookieDomain != "" {
-		cookie.Domain = h.config.CookieDomain
-	}
+	// Create the session cookies, persistent unless "remember me" was unchecked
+	persistent := r.URL.Query().Get("remember") != "0"
+	h.sessions.Start(w, checkResp.AuthToken, persistent)
 
-	http.SetCookie(w, cookie)
+	// Logging in again ends a revocation by the admin API
+	h.tokenCache.ClearRevocation(checkResp.AuthToken)
 
-	log.Println("Authentication successful, session cookie created")
+	reason := "persistent session cookie created"
+	if !persistent {
+		reason = "browser session cookie created"
+	}
+	log.Printf("Authentication successful for user %s, %s (client %s)", userInfo.Username, reason, clientip.FromRequest(r))
+	h.audit(r, audit.EventLogin, checkResp.AuthToken, user, DecisionSuccess, reason)
 
 	// Return success status (for polling)
 	w.Header().Set("Content-Type", "application/json")
@@ -210,28 +231,17 @@ func (h *OAuthHandler) HandlePlexAuth(w http.ResponseWriter, r *http.Request) {
 // HandleLogout clears the session cookie
 func (h *OAuthHandler) HandleLogout(w http.ResponseWriter, r *http.Request) {
 	// Get token before clearing to invalidate cache
-	token := extractTokenFromRequest(r)
+	token := ExtractToken(r, h.config.Sessions.CookieName)
 	if token != "" {
+		user, _ := h.tokenCache.GetStale(token)
 		h.tokenCache.Invalidate(token)
 		log.Printf("Invalidated cached token on logout")
+		h.audit(r, audit.EventLogout, token, user, DecisionSuccess, "session cookie cleared")
 	}
 
-	cookie := &http.Cookie{
-		Name:     "X-Plex-Token",
-		Value:    "",
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   h.config.CookieSecure,
-		MaxAge:   -1, // Delete the cookie
-	}
-
-	if h.config.CookieDomain != "" {
-		cookie.Domain = h.config.CookieDomain
-	}
+	h.sessions.Clear(w)
 
-	http.SetCookie(w, cookie)
-
-	log.Println("User logged out, session cookie cleared")
+	log.Printf("User logged out, session cookie cleared (client %s)", clientip.FromRequest(r))
 
 					w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
@@ -303,6 +313,10 @@ func (h *OAuthHandler) renderLoginPage(w http.ResponseWriter, authURL string, pi
 			margin: 20px 0;
 			letter-spacing: 4px;
 		}
+		.remember {
+			color: #ccc;
+			font-size: 14px;
+		}
 		.loading {
 			margin-top: 30px;
 			color: #999;
@@ -329,6 +343,9 @@ func (h *OAuthHandler) renderLoginPage(w http.ResponseWriter, authURL string, pi
 	<button onclick="openAuthPopup()" class="auth-button" id="loginButton">
 		Login with Plex
 	</button>
+	<div class="remember">
+		<label><input type="checkbox" id="remember" checked> Remember me on this device</label>
+	</div>
 	<div class="loading" id="loading" style="display:none;">
 		<div class="spinner"></div>
 		<p>Waiting for authentication...</p>
@@ -420,7 +437,9 @@ func (h *OAuthHandler) renderLoginPage(w http.ResponseWriter, authURL string, pi
 		}
 
 		function checkAuth() {
-			fetch('/callback?pin_id={{.PinID}}')
+			// Without "remember me" the session ends when the browser is closed
+			const remember = document.getElementById('remember').checked ? '1' : '0';
+			fetch('/callback?pin_id={{.PinID}}&remember=' + remember)
 				.then(response => {
 					if (response.ok) {
 						stopPolling();
@@ -477,14 +496,15 @@ func (h *OAuthHandler) renderLoginPage(w http.ResponseWriter, authURL string, pi
 
 // CheckAuthStatus returns the authentication status as JSON
 func (h *OAuthHandler) CheckAuthStatus(w http.ResponseWriter, r *http.Request) {
-	token := extractTokenFromRequest(r)
+	token := ExtractToken(r, h.config.Sessions.CookieName)
 
 	status := map[string]interface{}{
 		"authenticated": false,
 		"hasAccess":     false,
 	}
 
-	if token != "" {
+	// A revoked token or an ended session is reported as not authenticated
+	if token != "" && !h.tokenCache.IsRevoked(token) && h.sessionActive(r, token) {
 		// Check cache first
 		if cached, found := h.tokenCache.Get(token); found {
 			status["authenticated"] = cached.Valid
@@ -494,30 +514,22 @@ func (h *OAuthHandler) CheckAuthStatus(w http.ResponseWriter, r *http.Request) {
 			}
 		} else {
 			// Cache miss - validate with Plex
-			valid, _ := h.plexClient.ValidateToken(token)
-			if valid {
+			identity, err := h.plexClient.IdentifyContext(r.Context(), token)
+			if err == nil && identity.Valid {
 				status["authenticated"] = true
-				hasAccess, _ := h.plexClient.CheckServerAccess(token, h.config.PlexServerID)
-				status["hasAccess"] = hasAccess
+				status["username"] = identity.User.Username
 
-				// Get user info and cache the result
-				userInfo, _ := h.plexClient.GetUserInfo(token)
-				username := "Unknown"
-				userID := 0
-				if userInfo != nil {
-					username = userInfo.Username
-					userID = userInfo.ID
-					status["username"] = username
-				}
+				hasAccess, _ := h.accessList.CheckAccess(r.Context(), identity.User.ID)
+				status["hasAccess"] = hasAccess
 
 				// Cache the result
 				h.tokenCache.Set(token, &cache.TokenCacheEntry{
 					Valid:     true,
 					HasAccess: hasAccess,
-					UserID:    userID,
-					Username:  username,
+					UserID:    identity.User.ID,
+					Username:  identity.User.Username,
 				})
-			} else {
+			} else if err == nil {
 				// Cache invalid token
 				h.tokenCache.Set(token, &cache.TokenCacheEntry{
 					Valid:     false,
@@ -531,7 +543,44 @@ func (h *OAuthHandler) CheckAuthStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(status)
 }
 
-func extractTokenFromRequest(r *http.Request) string {
+// sessionActive returns false if the token comes from a cookie session that ended.
+// Sessions without state are adopted by /auth during the migration window.
+func (h *OAuthHandler) sessionActive(r *http.Request, token string) bool {
+	if !h.sessions.FromCookie(r, token) {
+		return true
+	}
+	_, err := h.sessions.Check(r, token)
+	return err == nil || (errors.Is(err, ErrSessionMissing) && h.sessions.adoptable(token))
+}
+
+// writePlexError writes a user-facing error for a failed Plex call
+func writePlexError(w http.ResponseWriter, err error, message string) {
+	var rateLimitErr *plex.RateLimitError
+
+	switch {
+	case errors.As(err, &rateLimitErr):
+		if rateLimitErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(rateLimitErr.RetryAfter.Seconds())+1))
+		}
+		http.Error(w, "Plex is rate limiting requests, please try again later", http.StatusTooManyRequests)
+	case errors.Is(err, plex.ErrUpstreamUnavailable):
+		http.Error(w, "Plex is currently unavailable, please try again later", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, message, http.StatusInternalServerError)
+	}
+}
+
+// audit records a login or logout in the audit log, user may be nil when unknown
+func (h *OAuthHandler) audit(r *http.Request, eventType audit.EventType, token string, user *cache.TokenCacheEntry, decision, reason string) {
+	event := auditEvent(r, eventType, token, user)
+	event.Decision = decision
+	event.Reason = reason
+	h.auditLog.Log(event)
+}
+
+// ExtractToken returns the Plex token of a request from the Authorization header,
+// the X-Plex-Token header or the session cookie
+func ExtractToken(r *http.Request, cookieName string) string {
 	// Try Authorization header
 	if auth := r.Header.Get("Authorization"); auth != "" {
 		if len(auth) > 7 && auth[:7] == "Bearer " {
@@ -546,7 +595,7 @@ func extractTokenFromRequest(r *http.Request) string {
 	}
 
 	// Try cookie
-	if cookie, err := r.Cookie("X-Plex-Token"); err == nil {
+	if cookie, err := r.Cookie(cookieName); err == nil {
 		return cookie.Value
 	}
 
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/audit"
+)
+
+// pinIDPattern finds the PIN polled by the login page
+var pinIDPattern = regexp.MustCompile(`/callback\?pin_id=(\d+)`)
+
+// login opens the login page and returns the ID of the PIN it polls
+func (env *testEnv) login(t *testing.T) int {
+	t.Helper()
+
+	recorder := env.serve(env.oauth.HandleLogin, httptest.NewRequest(http.MethodGet, "/login?rd=/app", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("login status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	match := pinIDPattern.FindStringSubmatch(recorder.Body.String())
+	if match == nil {
+		t.Fatal("login page doesn't poll a PIN")
+	}
+	pinID, _ := strconv.Atoi(match[1])
+	return pinID
+}
+
+// callback polls the callback of a PIN
+func (env *testEnv) callback(pinID int) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/callback?pin_id="+strconv.Itoa(pinID)+"&remember=1", nil)
+	return env.serve(env.oauth.HandleCallback, r)
+}
+
+func TestOAuthLogin(t *testing.T) {
+	env := newTestEnv(t, nil)
+
+	pinID := env.login(t)
+
+	// The page polls until the user signs in on app.plex.tv
+	if recorder := env.callback(pinID); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("callback status before approval = %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+
+	if !env.fake.ApprovePin(pinID, testShared.ID) {
+		t.Fatalf("PIN %d is unknown to the fake Plex", pinID)
+	}
+	recorder := env.callback(pinID)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("callback status after approval = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	cookies := recorder.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("callback didn't set the session cookies")
+	}
+
+	events := env.auditLog.Query(audit.Query{Type: audit.EventLogin, Limit: 1})
+	if len(events) == 0 || events[0].Decision != DecisionSuccess || events[0].Username != testShared.Username {
+		t.Errorf("login audit events = %+v, want a success of %s", events, testShared.Username)
+	}
+
+	// The browser sends the session cookies to nginx, which asks /auth
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	recorder = env.serve(env.handler.HandleAuth, r)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("auth status with the session cookies = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if user := recorder.Header().Get("X-User"); user != testShared.Username {
+		t.Errorf("X-User = %q, want %q", user, testShared.Username)
+	}
+}
+
+func TestOAuthLoginWithoutAccess(t *testing.T) {
+	env := newTestEnv(t, nil)
+
+	pinID := env.login(t)
+	env.fake.ApprovePin(pinID, testOther.ID)
+
+	recorder := env.callback(pinID)
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("callback status = %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+	if cookies := recorder.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("callback set %d cookie(s) for a user without access", len(cookies))
+	}
+}
+
+func TestOAuthCallbackExpiredPin(t *testing.T) {
+	env := newTestEnv(t, nil)
+
+	if recorder := env.callback(424242); recorder.Code != http.StatusGone {
+		t.Fatalf("callback status = %d, want %d", recorder.Code, http.StatusGone)
+	}
+}
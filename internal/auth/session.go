@@ -0,0 +1,342 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/clientip"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+)
+
+// stateCookieSuffix is appended to the session cookie name to name the state cookie
+const stateCookieSuffix = "-Session"
+
+// maxAdoptedSessions bounds the number of sessions adopted during the migration window,
+// sessions without state beyond it are logged out
+const maxAdoptedSessions = 10000
+
+// derivedKeyInfo is the HKDF info of the session key derived from the owner token
+const derivedKeyInfo = "nginx-plex-auth-server session state"
+
+var (
+	// ErrSessionMissing is returned for cookie sessions without a state cookie, e.g.
+	// created before session lifetimes were enforced, see Sessions.Adopt
+	ErrSessionMissing = errors.New("session state is missing")
+	// ErrSessionInvalid is returned for cookie sessions whose state cookie wasn't signed
+	// with the current key or not for this token
+	ErrSessionInvalid = errors.New("session state is invalid")
+	// ErrSessionExpired is returned for sessions past their maximum lifetime
+	ErrSessionExpired = errors.New("session reached its maximum lifetime")
+	// ErrSessionIdle is returned for sessions without requests for longer than the idle timeout
+	ErrSessionIdle = errors.New("session was idle for too long")
+)
+
+// SessionState describes a cookie session
+type SessionState struct {
+	// IssuedAt is when the user logged in
+	IssuedAt time.Time
+	// RenewedAt is when the cookies were last issued
+	RenewedAt time.Time
+	// Persistent is false for cookies ending with the browser session ("remember me" unchecked)
+	Persistent bool
+}
+
+// Sessions issues, checks and renews the session cookies. The session cookie holds
+// the Plex token and the state cookie next to it the login and renewal times, both
+// for the maximum lifetime of the session. The state is signed with the session
+// secret and bound to the token so neither can be forged or swapped.
+// Renewals only issue the state cookie again, nginx forwards a single Set-Cookie
+// header from /auth.
+type Sessions struct {
+	cookieName   string
+	cookieDomain string
+	cookieSecure bool
+	maxAge       time.Duration
+	idleTimeout  time.Duration
+	// key signs the state cookies, derived from the owner token when serverID is set
+	keyMu    sync.RWMutex
+	key      []byte
+	serverID string
+	// adoptUntil ends the migration window of the sessions without state, adopted
+	// holds the IDs of the sessions adopted so far
+	adoptUntil time.Time
+	adoptMu    sync.Mutex
+	adopted    map[string]struct{}
+}
+
+// NewSessions creates the session manager. Without a session secret the key is derived
+// from the owner token and server ID, so sessions survive restarts until the owner
+// token changes (see SetOwnerToken).
+func NewSessions(cfg *config.Config) *Sessions {
+	key := []byte(cfg.Sessions.Secret)
+	serverID := ""
+	if len(key) == 0 {
+		key = deriveKey(cfg.PlexToken, cfg.PlexServerID)
+		serverID = cfg.PlexServerID
+	}
+
+	return &Sessions{
+		cookieName:   cfg.Sessions.CookieName,
+		cookieDomain: cfg.CookieDomain,
+		cookieSecure: cfg.CookieSecure,
+		maxAge:       cfg.Sessions.MaxAge,
+		idleTimeout:  cfg.Sessions.IdleTimeout,
+		key:          key,
+		serverID:     serverID,
+		adoptUntil:   cfg.Sessions.AdoptLegacyUntil,
+		adopted:      make(map[string]struct{}),
+	}
+}
+
+// Start sets the cookies of a new session, persistent ones survive the browser session
+func (s *Sessions) Start(w http.ResponseWriter, token string, persistent bool) {
+	maxAge := 0
+	if persistent {
+		maxAge = int(s.maxAge.Seconds())
+	}
+	http.SetCookie(w, s.cookie(s.cookieName, token, maxAge))
+
+	now := time.Now()
+	s.setStateCookie(w, token, SessionState{IssuedAt: now, RenewedAt: now, Persistent: persistent})
+}
+
+// FromCookie returns true if the token of the request is the one of its session cookie.
+// Lifetimes are checked on cookie sessions, the token of an ended session is then refused
+// from headers too (see cache.TokenCache.EndSession).
+func (s *Sessions) FromCookie(r *http.Request, token string) bool {
+	cookie, err := r.Cookie(s.cookieName)
+	return err == nil && cookie.Value == token
+}
+
+// Check returns the state of the cookie session of token, or why it ended
+func (s *Sessions) Check(r *http.Request, token string) (SessionState, error) {
+	cookie, err := r.Cookie(s.cookieName + stateCookieSuffix)
+	if err != nil {
+		return SessionState{}, ErrSessionMissing
+	}
+	state, ok := s.decode(cookie.Value, token)
+	if !ok {
+		return SessionState{}, ErrSessionInvalid
+	}
+
+	now := time.Now()
+	if now.After(state.IssuedAt.Add(s.maxAge)) {
+		return state, ErrSessionExpired
+	}
+	if s.idleTimeout > 0 && now.After(state.RenewedAt.Add(s.idleTimeout)) {
+		return state, ErrSessionIdle
+	}
+	return state, nil
+}
+
+// Verify enforces the lifetime of the cookie session of token: sessions without state are
+// adopted during the migration window and the state cookie of active sessions is renewed.
+// It returns why the session ended, nil for active sessions and tokens sent in headers.
+func (s *Sessions) Verify(w http.ResponseWriter, r *http.Request, token string) error {
+	if !s.FromCookie(r, token) {
+		return nil
+	}
+
+	state, err := s.Check(r, token)
+	if errors.Is(err, ErrSessionMissing) && s.Adopt(w, token) {
+		log.Printf("Session state cookie issued for a session without one (client %s)", clientip.FromRequest(r))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.Renew(w, token, state) {
+		log.Printf("Session cookie renewed (logged in %s ago)", time.Since(state.IssuedAt).Round(time.Second))
+	}
+	return nil
+}
+
+// Renew issues the state cookie again once past half its lifetime, if that extends the
+// session. Sessions slide with the idle timeout, never beyond their maximum lifetime.
+// It returns true if the cookie was renewed.
+func (s *Sessions) Renew(w http.ResponseWriter, token string, state SessionState) bool {
+	now := time.Now()
+	expiry := s.expiry(state)
+	if now.Sub(state.RenewedAt) < expiry.Sub(state.RenewedAt)/2 {
+		return false
+	}
+
+	renewed := state
+	renewed.RenewedAt = now
+	if !s.expiry(renewed).After(expiry) {
+		return false
+	}
+	s.setStateCookie(w, token, renewed)
+	return true
+}
+
+// Adopt issues the state cookie of a session created before session lifetimes were
+// enforced, during the migration window (sessions.adopt_legacy_until). Each session is
+// adopted once and ends with the window at the latest, so deleting the state cookie
+// doesn't extend a session. It returns false if the session can't be adopted.
+func (s *Sessions) Adopt(w http.ResponseWriter, token string) bool {
+	if !s.adoptable(token) {
+		return false
+	}
+
+	s.adoptMu.Lock()
+	id := cache.SessionID(token)
+	if _, adopted := s.adopted[id]; adopted || len(s.adopted) >= maxAdoptedSessions {
+		s.adoptMu.Unlock()
+		return false
+	}
+	s.adopted[id] = struct{}{}
+	s.adoptMu.Unlock()
+
+	// Legacy cookies were persistent and issued before the window started
+	now := time.Now()
+	issued := s.adoptUntil.Add(-s.maxAge)
+	if issued.After(now) {
+		issued = now
+	}
+	s.setStateCookie(w, token, SessionState{IssuedAt: issued, RenewedAt: now, Persistent: true})
+	return true
+}
+
+// adoptable returns true if the session of token can still be adopted
+func (s *Sessions) adoptable(token string) bool {
+	if !time.Now().Before(s.adoptUntil) {
+		return false
+	}
+	s.adoptMu.Lock()
+	defer s.adoptMu.Unlock()
+	_, adopted := s.adopted[cache.SessionID(token)]
+	return !adopted
+}
+
+// Clear deletes the session and state cookies
+func (s *Sessions) Clear(w http.ResponseWriter) {
+	for _, name := range []string{s.cookieName, s.cookieName + stateCookieSuffix} {
+		http.SetCookie(w, s.cookie(name, "", -1))
+	}
+}
+
+// expiry returns when a session ends: its maximum lifetime after login, or the idle
+// timeout after the last renewal
+func (s *Sessions) expiry(state SessionState) time.Time {
+	expiry := state.IssuedAt.Add(s.maxAge)
+	if s.idleTimeout > 0 {
+		if idle := state.RenewedAt.Add(s.idleTimeout); idle.Before(expiry) {
+			expiry = idle
+		}
+	}
+	return expiry
+}
+
+// setStateCookie writes the state cookie. A persistent one is kept by the browser as
+// long as the session cookie, so idle sessions are told apart from sessions without
+// state.
+func (s *Sessions) setStateCookie(w http.ResponseWriter, token string, state SessionState) {
+	maxAge := 0
+	if state.Persistent {
+		maxAge = int(time.Until(state.IssuedAt.Add(s.maxAge)).Round(time.Second).Seconds())
+	}
+	http.SetCookie(w, s.cookie(s.cookieName+stateCookieSuffix, s.encode(state, token), maxAge))
+}
+
+// cookie returns a session cookie, maxAge 0 ends it with the browser session and -1 deletes it
+func (s *Sessions) cookie(name, value string, maxAge int) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   s.cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   maxAge,
+	}
+	if s.cookieDomain != "" {
+		cookie.Domain = s.cookieDomain
+	}
+	return cookie
+}
+
+// encode returns the state cookie value: "<issued>.<renewed>.<persistent>.<signature>"
+// with Unix times, the signature covering the token too
+func (s *Sessions) encode(state SessionState, token string) string {
+	persistent := "0"
+	if state.Persistent {
+		persistent = "1"
+	}
+	payload := strconv.FormatInt(state.IssuedAt.Unix(), 10) + "." + strconv.FormatInt(state.RenewedAt.Unix(), 10) + "." + persistent
+	return payload + "." + s.sign(payload, token)
+}
+
+// decode parses and verifies a state cookie value for token
+func (s *Sessions) decode(value, token string) (SessionState, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 4 {
+		return SessionState{}, false
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(s.sign(payload, token))) {
+		return SessionState{}, false
+	}
+
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return SessionState{}, false
+	}
+	renewed, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return SessionState{}, false
+	}
+	return SessionState{
+		IssuedAt:   time.Unix(issued, 0),
+		RenewedAt:  time.Unix(renewed, 0),
+		Persistent: parts[2] == "1",
+	}, true
+}
+
+// CSRFToken returns the token of the forms of a session authenticated with credential,
+// an HMAC under the session key so it can't be derived from the credential or its hash
+func (s *Sessions) CSRFToken(credential string) string {
+	return s.sign("csrf", credential)
+}
+
+// SetOwnerToken derives the session key from a rotated owner token, ending every session
+// like a restart with the new token would. A configured session secret is kept.
+func (s *Sessions) SetOwnerToken(ownerToken string) {
+	if s.serverID == "" {
+		return
+	}
+
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	s.key = deriveKey(ownerToken, s.serverID)
+}
+
+// sign returns the hex-encoded HMAC-SHA256 of the payload and token
+func (s *Sessions) sign(payload, token string) string {
+	s.keyMu.RLock()
+	key := s.key
+	s.keyMu.RUnlock()
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload + "." + token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deriveKey derives the session key from the owner token and server ID with HKDF-SHA256
+func deriveKey(ownerToken, serverID string) []byte {
+	extract := hmac.New(sha256.New, []byte(serverID))
+	extract.Write([]byte(ownerToken))
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(derivedKeyInfo))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+)
+
+// authCookies sends an /auth subrequest with the session cookie of token and the
+// given state cookies
+func (env *testEnv) authCookies(token string, state ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.AddCookie(&http.Cookie{Name: env.config.Sessions.CookieName, Value: token})
+	for _, cookie := range state {
+		r.AddCookie(cookie)
+	}
+	return env.serve(env.handler.HandleAuth, r)
+}
+
+// stateCookie returns the state cookie of a session of token
+func (env *testEnv) stateCookie(t *testing.T, token string, state SessionState) *http.Cookie {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	env.sessions.setStateCookie(recorder, token, state)
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("setStateCookie set %d cookie(s), want 1", len(cookies))
+	}
+	return cookies[0]
+}
+
+func TestHandleAuthEndedSession(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		state SessionState
+	}{
+		{name: "past its lifetime", state: SessionState{IssuedAt: now.Add(-2 * time.Hour), RenewedAt: now.Add(-time.Minute)}},
+		{name: "idle", state: SessionState{IssuedAt: now.Add(-50 * time.Minute), RenewedAt: now.Add(-40 * time.Minute)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, func(cfg *config.Config) {
+				cfg.Sessions.MaxAge = time.Hour
+				cfg.Sessions.IdleTimeout = 30 * time.Minute
+			})
+
+			recorder := env.authCookies(env.sharedToken, env.stateCookie(t, env.sharedToken, tt.state))
+			if recorder.Code != http.StatusUnauthorized {
+				t.Fatalf("status = %d, want %d", recorder.Code, http.StatusUnauthorized)
+			}
+			if decision := env.lastDecision(t); decision != DecisionExpired {
+				t.Errorf("decision = %q, want %q", decision, DecisionExpired)
+			}
+
+			// The session can't be resumed without its state cookie or from a header
+			if recorder := env.authCookies(env.sharedToken); recorder.Code != http.StatusUnauthorized {
+				t.Errorf("status without state cookie = %d, want %d", recorder.Code, http.StatusUnauthorized)
+			}
+			if recorder := env.auth(env.sharedToken); recorder.Code != http.StatusUnauthorized {
+				t.Errorf("status with the X-Plex-Token header = %d, want %d", recorder.Code, http.StatusUnauthorized)
+			}
+
+			// Until its user logs in again
+			env.tokenCache.ClearRevocation(env.sharedToken)
+			if recorder := env.auth(env.sharedToken); recorder.Code != http.StatusOK {
+				t.Errorf("status after a new login = %d, want %d", recorder.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestHandleAuthMissingSessionState(t *testing.T) {
+	t.Run("logged out without migration window", func(t *testing.T) {
+		env := newTestEnv(t, nil)
+
+		if recorder := env.authCookies(env.sharedToken); recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want %d", recorder.Code, http.StatusUnauthorized)
+		}
+		if recorder := env.auth(env.sharedToken); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("status with the X-Plex-Token header = %d, want %d", recorder.Code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("logged out after the migration window", func(t *testing.T) {
+		env := newTestEnv(t, func(cfg *config.Config) {
+			cfg.Sessions.AdoptLegacyUntil = time.Now().Add(-time.Minute)
+		})
+
+		if recorder := env.authCookies(env.sharedToken); recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want %d", recorder.Code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("adopted once during the migration window", func(t *testing.T) {
+		adoptUntil := time.Now().Add(24 * time.Hour)
+		env := newTestEnv(t, func(cfg *config.Config) {
+			cfg.Sessions.AdoptLegacyUntil = adoptUntil
+		})
+
+		recorder := env.authCookies(env.sharedToken)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+		}
+		cookies := recorder.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("/auth set %d cookie(s), want the state cookie", len(cookies))
+		}
+
+		// The adopted session ends with the migration window
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.AddCookie(cookies[0])
+		state, err := env.sessions.Check(r, env.sharedToken)
+		if err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		if expiry := env.sessions.expiry(state); expiry.After(adoptUntil.Add(time.Second)) {
+			t.Errorf("adopted session ends at %v, after the migration window %v", expiry, adoptUntil)
+		}
+
+		if recorder := env.authCookies(env.sharedToken, cookies[0]); recorder.Code != http.StatusOK {
+			t.Errorf("status with the state cookie = %d, want %d", recorder.Code, http.StatusOK)
+		}
+
+		// Deleting the state cookie again doesn't start a new session
+		if recorder := env.authCookies(env.sharedToken); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("status after deleting the state cookie = %d, want %d", recorder.Code, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestSessionsOwnerTokenRotation(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		status int
+	}{
+		{name: "derived key ends the sessions", status: http.StatusUnauthorized},
+		{name: "session secret keeps them", secret: "test-session-secret", status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, func(cfg *config.Config) {
+				cfg.Sessions.Secret = tt.secret
+			})
+
+			recorder := httptest.NewRecorder()
+			env.sessions.Start(recorder, env.sharedToken, true)
+			// The session cookie comes first, authCookies sends it
+			cookies := recorder.Result().Cookies()
+			if recorder := env.authCookies(env.sharedToken, cookies[1:]...); recorder.Code != http.StatusOK {
+				t.Fatalf("status before rotation = %d, want %d", recorder.Code, http.StatusOK)
+			}
+
+			env.sessions.SetOwnerToken(env.fake.IssueToken(testOwner.ID))
+
+			if recorder := env.authCookies(env.sharedToken, cookies[1:]...); recorder.Code != tt.status {
+				t.Errorf("status after rotation = %d, want %d", recorder.Code, tt.status)
+			}
+		})
+	}
+}
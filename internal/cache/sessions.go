@@ -0,0 +1,201 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+)
+
+// defaultRevokedTTL is how long a revoked token is refused unless SetRevokedTTL is called
+const defaultRevokedTTL = 30 * 24 * time.Hour
+
+// revocation is a revoked token of a user, refused until a given time
+type revocation struct {
+	userID int
+	until  time.Time
+	// sessionEnded is true for the tokens of sessions past their lifetime, which
+	// stay refused when their user regains access
+	sessionEnded bool
+}
+
+// Session describes a cached token without exposing the token itself
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	Valid     bool      `json:"valid"`
+	HasAccess bool      `json:"has_access"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	Decision  string    `json:"decision,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Stale is true for expired entries kept to be served while Plex is unavailable
+	Stale bool `json:"stale"`
+}
+
+// Stats describes the cache contents and settings
+type Stats struct {
+	Entries    int    `json:"entries"`
+	Revoked    int    `json:"revoked"`
+	MaxSize    int    `json:"max_size"`
+	TTL        string `json:"ttl"`
+	StaleGrace string `json:"stale_grace"`
+}
+
+// SessionID returns the identifier of a token in session listings, a truncated SHA-256 hash
+func SessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Touch records that a cached token was just used from clientIP with the given decision
+func (c *TokenCache) Touch(token, clientIP, decision string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, exists := c.entries[token]; exists {
+		entry.LastSeen = time.Now()
+		entry.ClientIP = clientIP
+		entry.Decision = decision
+	}
+}
+
+// Sessions lists the cached tokens, most recently seen first
+func (c *TokenCache) Sessions() []Session {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	sessions := make([]Session, 0, len(c.entries))
+	for token, entry := range c.entries {
+		sessions = append(sessions, Session{
+			ID:        SessionID(token),
+			UserID:    entry.UserID,
+			Username:  entry.Username,
+			Email:     entry.Email,
+			Valid:     entry.Valid,
+			HasAccess: entry.HasAccess,
+			ClientIP:  entry.ClientIP,
+			Decision:  entry.Decision,
+			CreatedAt: entry.CreatedAt,
+			LastSeen:  entry.LastSeen,
+			ExpiresAt: entry.ExpiresAt,
+			Stale:     now.After(entry.ExpiresAt),
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions
+}
+
+// SetRevokedTTL sets how long revoked tokens are refused, usually the session lifetime
+func (c *TokenCache) SetRevokedTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.revokedTTL = ttl
+}
+
+// RevokeUser removes every cached token of a user and refuses them until they log in again.
+// It returns the number of revoked tokens.
+func (c *TokenCache) RevokeUser(userID int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	revoked := 0
+	for token, entry := range c.entries {
+		if entry.UserID == userID {
+			c.revokeLocked(token)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+// RevokeSession revokes the cached token with the given session ID, see RevokeUser.
+// It returns false if no cached token has this ID.
+func (c *TokenCache) RevokeSession(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for token := range c.entries {
+		if SessionID(token) == id {
+			c.revokeLocked(token)
+			return true
+		}
+	}
+	return false
+}
+
+// EndSession refuses the token of a session past its lifetime or idle timeout, whatever
+// the way it is sent, until its user logs in again
+func (c *TokenCache) EndSession(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.revokeLocked(token)
+	revoked := c.revoked[token]
+	revoked.sessionEnded = true
+	c.revoked[token] = revoked
+}
+
+// IsRevoked returns true if the token was revoked
+func (c *TokenCache) IsRevoked(token string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	revoked, exists := c.revoked[token]
+	return exists && time.Now().Before(revoked.until)
+}
+
+// ClearRevocation accepts a revoked token again, e.g. when its user logs in again
+func (c *TokenCache) ClearRevocation(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.revoked, token)
+}
+
+// ClearUserRevocations accepts the revoked tokens of a user again, e.g. when the
+// user regains access to the Plex server, except those of ended sessions.
+// It returns the number of cleared tokens.
+func (c *TokenCache) ClearUserRevocations(userID int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cleared := 0
+	for token, revoked := range c.revoked {
+		if revoked.userID == userID && !revoked.sessionEnded {
+			delete(c.revoked, token)
+			cleared++
+		}
+	}
+	return cleared
+}
+
+// Stats returns the cache contents and settings
+func (c *TokenCache) Stats() Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return Stats{
+		Entries:    len(c.entries),
+		Revoked:    len(c.revoked),
+		MaxSize:    c.maxSize,
+		TTL:        c.ttl.String(),
+		StaleGrace: c.staleGrace.String(),
+	}
+}
+
+// revokeLocked removes a token from the cache and refuses it
+// Must be called with lock held
+func (c *TokenCache) revokeLocked(token string) {
+	revoked := revocation{until: time.Now().Add(c.revokedTTL)}
+	if entry, exists := c.entries[token]; exists {
+		revoked.userID = entry.UserID
+	}
+	delete(c.entries, token)
+	c.revoked[token] = revoked
+}
@@ -5,13 +5,22 @@ import (
 	"time"
 )
 
+// CleanupInterval is how often expired entries and revocations are removed
+const CleanupInterval = time.Minute
+
 // TokenCacheEntry represents a cached token validation result
 type TokenCacheEntry struct {
 	Valid      bool
 	HasAccess  bool
 	UserID     int
 	Username   string
+	Email      string
 	ExpiresAt  time.Time
+	// CreatedAt, LastSeen, ClientIP and Decision describe the session, see Touch
+	CreatedAt time.Time
+	LastSeen  time.Time
+	ClientIP  string
+	Decision  string
 }
 
 // TokenCache provides a thread-safe cache for token validation results
@@ -20,14 +29,27 @@ type TokenCache struct {
 	entries map[string]*TokenCacheEntry
 	ttl     time.Duration
 	maxSize int
+	// staleGrace keeps expired entries around so they can be served while Plex is unavailable
+	staleGrace time.Duration
+	// revoked holds the revoked tokens with their user and the time they can be forgotten
+	revoked    map[string]revocation
+	revokedTTL time.Duration
+	// lastCleanup is when expired entries were last removed, see LastCleanup
+	lastCleanup time.Time
+	stopChan   chan struct{}
+	stopOnce   sync.Once
 }
 
 // NewTokenCache creates a new token cache with specified TTL and max size
 func NewTokenCache(ttl time.Duration, maxSize int) *TokenCache {
 	cache := &TokenCache{
 		entries: make(map[string]*TokenCacheEntry),
-		ttl:     ttl,
-		maxSize: maxSize,
+		ttl:      ttl,
+		maxSize:  maxSize,
+		revoked:    make(map[string]revocation),
+		revokedTTL: defaultRevokedTTL,
+		lastCleanup: time.Now(),
+		stopChan: make(chan struct{}),
 	}
 
 	// Start background cleanup goroutine
@@ -54,6 +76,48 @@ func (c *TokenCache) Get(token string) (*TokenCacheEntry, bool) {
 	return entry, true
 }
 
+// SetTTL sets the lifetime of entries stored from now on
+func (c *TokenCache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+}
+
+// SetMaxSize sets the maximum number of entries, evicting the oldest ones if needed
+func (c *TokenCache) SetMaxSize(maxSize int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxSize = maxSize
+	for len(c.entries) > c.maxSize {
+		c.evictOldest()
+	}
+}
+
+// SetStaleGrace sets how long expired entries are kept for GetStale
+func (c *TokenCache) SetStaleGrace(grace time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.staleGrace = grace
+}
+
+// GetStale retrieves a cached token validation result, including entries
+// that expired less than the stale grace period ago
+func (c *TokenCache) GetStale(token string) (*TokenCacheEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, exists := c.entries[token]
+	if !exists {
+		return nil, false
+	}
+
+	if time.Now().After(entry.ExpiresAt.Add(c.staleGrace)) {
+		return nil, false
+	}
+
+	return entry, true
+}
+
 // Set stores a token validation result in the cache
 func (c *TokenCache) Set(token string, entry *TokenCacheEntry) {
 	c.mu.Lock()
@@ -64,7 +128,15 @@ func (c *TokenCache) Set(token string, entry *TokenCacheEntry) {
 		c.evictOldest()
 	}
 
-	entry.ExpiresAt = time.Now().Add(c.ttl)
+	now := time.Now()
+	entry.ExpiresAt = now.Add(c.ttl)
+	if previous, exists := c.entries[token]; exists {
+		// A token validated again keeps its session start
+		entry.CreatedAt = previous.CreatedAt
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = now
+	}
 	c.entries[token] = entry
 }
 
@@ -75,11 +147,30 @@ func (c *TokenCache) Invalidate(token string) {
 	delete(c.entries, token)
 }
 
-// Clear removes all entries from the cache
-func (c *TokenCache) Clear() {
+// InvalidateUser removes every cached token belonging to a user
+// and returns the number of removed entries
+func (c *TokenCache) InvalidateUser(userID int) int {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+
+	removed := 0
+	for token, entry := range c.entries {
+		if entry.UserID == userID {
+			delete(c.entries, token)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Clear removes all entries from the cache and returns the number of removed entries.
+// Revoked tokens stay revoked.
+func (c *TokenCache) Clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := len(c.entries)
 	c.entries = make(map[string]*TokenCacheEntry)
+	return removed
 }
 
 // Size returns the current number of cached entries
@@ -107,19 +198,45 @@ func (c *TokenCache) evictOldest() {
 	}
 }
 
-// cleanupExpired periodically removes expired entries
+// Stop stops the background cleanup goroutine
+func (c *TokenCache) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopChan)
+	})
+}
+
+// LastCleanup returns when expired entries were last removed, or when the cache was
+// created. It stops advancing once the cache is stopped.
+func (c *TokenCache) LastCleanup() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastCleanup
+}
+
+// cleanupExpired periodically removes expired entries until Stop is called
 func (c *TokenCache) cleanupExpired() {
-	ticker := time.NewTicker(1 * time.Minute)
+	ticker := time.NewTicker(CleanupInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		c.mu.Lock()
-		now := time.Now()
-		for token, entry := range c.entries {
-			if now.After(entry.ExpiresAt) {
-				delete(c.entries, token)
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			now := time.Now()
+			for token, entry := range c.entries {
+				if now.After(entry.ExpiresAt.Add(c.staleGrace)) {
+					delete(c.entries, token)
+				}
+			}
+			for token, revoked := range c.revoked {
+				if now.After(revoked.until) {
+					delete(c.revoked, token)
+				}
 			}
+			c.lastCleanup = now
+			c.mu.Unlock()
+		case <-c.stopChan:
+			return
 		}
-		c.mu.Unlock()
 	}
 }
\ No newline at end of file
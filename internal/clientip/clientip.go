@@ -0,0 +1,145 @@
+package clientip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+)
+
+// contextKey is the key of the resolved client in the request context
+type contextKey struct{}
+
+// resolved is the client of a request stored by the middleware
+type resolved struct {
+	ip string
+	// trustedProxy is true if the connection comes from a trusted proxy
+	trustedProxy bool
+}
+
+// Resolver derives the IP address of the client behind the proxies. Forwarded
+// headers are only trusted on connections coming from a trusted proxy.
+type Resolver struct {
+	trustedProxies []*net.IPNet
+}
+
+// NewResolver creates a resolver trusting the given IPs or CIDRs
+func NewResolver(trustedProxies []string) *Resolver {
+	return &Resolver{trustedProxies: config.ParseCIDRs(trustedProxies)}
+}
+
+// Middleware stores the client IP of each request in its context for FromRequest,
+// and whether the connection comes from a trusted proxy for FromTrustedProxy
+func (res *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := resolved{ip: res.Resolve(r), trustedProxy: res.Trusted(peerIP(r))}
+		ctx := context.WithValue(r.Context(), contextKey{}, client)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Resolve returns the client IP of a request. On a connection from a trusted proxy
+// it is the last address of Forwarded or X-Forwarded-For that isn't a trusted proxy,
+// or X-Real-IP. Otherwise it is the address of the connection.
+func (res *Resolver) Resolve(r *http.Request) string {
+	peer := peerIP(r)
+	if !res.Trusted(peer) {
+		return peer
+	}
+
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(header, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// Obfuscated or unknown addresses can't be trusted, use the proxy
+			break
+		}
+		if !res.Trusted(hops[i]) {
+			return hops[i]
+		}
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return peer
+}
+
+// Trusted returns true if ip belongs to a trusted proxy
+func (res *Resolver) Trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range res.trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// FromRequest returns the client IP stored by the middleware,
+// or the address of the connection for requests that didn't go through it
+func FromRequest(r *http.Request) string {
+	if client, ok := r.Context().Value(contextKey{}).(resolved); ok {
+		return client.ip
+	}
+	return peerIP(r)
+}
+
+// FromTrustedProxy returns true if the request came from a trusted proxy, whose
+// forwarded headers can be believed. Requests that didn't go through the middleware
+// are not trusted.
+func FromTrustedProxy(r *http.Request) bool {
+	client, ok := r.Context().Value(contextKey{}).(resolved)
+	return ok && client.trustedProxy
+}
+
+// peerIP returns the IP address of the connection
+func peerIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// forwardedFor returns the for= addresses of RFC 7239 Forwarded headers, in order.
+// Ports and the brackets and quotes around IPv6 addresses are removed.
+func forwardedFor(headers []string) []string {
+	var hops []string
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if !found || !strings.EqualFold(name, "for") {
+					continue
+				}
+				hops = append(hops, forwardedAddress(strings.Trim(value, `"`)))
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedAddress strips the port of a Forwarded address such as "[2001:db8::1]:4711" or "192.0.2.43:47011"
+func forwardedAddress(value string) string {
+	if strings.HasPrefix(value, "[") {
+		if end := strings.Index(value, "]"); end > 0 {
+			return value[1:end]
+		}
+		return value
+	}
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		return host
+	}
+	return value
+}
@@ -1,90 +1,738 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
-	"strconv"
+	"strings"
 	"time"
 )
 
 // Config holds the application configuration
 type Config struct {
-	PlexURL              string
-	PlexToken            string
-	PlexServerID         string
-	PlexClientID         string
-	ServerAddr           string
-	CallbackURL          string
-	CookieDomain         string
-	CookieSecure         bool
-	CacheTTL             time.Duration
-	CacheMaxSize         int
-	TokenHealthCheckTTL  time.Duration
-}
-
-// Load reads configuration from environment variables
+	PlexURL                    string        `yaml:"plex_url" toml:"plex_url"`
+	PlexToken                  string        `yaml:"plex_token" toml:"plex_token" secret:"true"`
+	PlexTokenFile              string        `yaml:"plex_token_file" toml:"plex_token_file"`
+	PlexTokenWatchInterval     time.Duration `yaml:"plex_token_watch_interval" toml:"plex_token_watch_interval"`
+	PlexServerID               string        `yaml:"plex_server_id" toml:"plex_server_id"`
+	PlexClientID               string        `yaml:"plex_client_id" toml:"plex_client_id"`
+	ServerAddr                 string        `yaml:"server_addr" toml:"server_addr"`
+	ServerReadHeaderTimeout    time.Duration `yaml:"server_read_header_timeout" toml:"server_read_header_timeout"`
+	ServerReadTimeout          time.Duration `yaml:"server_read_timeout" toml:"server_read_timeout"`
+	ServerWriteTimeout         time.Duration `yaml:"server_write_timeout" toml:"server_write_timeout"`
+	ServerIdleTimeout          time.Duration `yaml:"server_idle_timeout" toml:"server_idle_timeout"`
+	ShutdownTimeout            time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	CallbackURL                string        `yaml:"callback_url" toml:"callback_url"`
+	CookieDomain               string        `yaml:"cookie_domain" toml:"cookie_domain"`
+	CookieSecure               bool          `yaml:"cookie_secure" toml:"cookie_secure"`
+	CacheTTL                   time.Duration `yaml:"cache_ttl" toml:"cache_ttl"`
+	CacheMaxSize               int           `yaml:"cache_max_size" toml:"cache_max_size"`
+	CacheStaleGrace            time.Duration `yaml:"cache_stale_grace" toml:"cache_stale_grace"`
+	TokenHealthCheckTTL        time.Duration `yaml:"token_health_check_interval" toml:"token_health_check_interval"`
+	SharedUsersRefreshInterval time.Duration `yaml:"shared_users_refresh_interval" toml:"shared_users_refresh_interval"`
+	PlexRequestTimeout         time.Duration `yaml:"plex_request_timeout" toml:"plex_request_timeout"`
+	PlexMaxRetries             int           `yaml:"plex_max_retries" toml:"plex_max_retries"`
+	PlexRetryBackoff           time.Duration `yaml:"plex_retry_backoff" toml:"plex_retry_backoff"`
+	PlexBreakerFailures        int           `yaml:"plex_breaker_failures" toml:"plex_breaker_failures"`
+	PlexBreakerFailureRate     float64       `yaml:"plex_breaker_failure_rate" toml:"plex_breaker_failure_rate"`
+	PlexBreakerOpenTimeout     time.Duration `yaml:"plex_breaker_open_timeout" toml:"plex_breaker_open_timeout"`
+	ReloadInterval             time.Duration `yaml:"reload_interval" toml:"reload_interval"`
+	HealthCheckTimeout         time.Duration `yaml:"health_check_timeout" toml:"health_check_timeout"`
+	// ReadinessChecks are the names of the checks gating /readyz (empty means all)
+	ReadinessChecks []string `yaml:"readiness_checks" toml:"readiness_checks"`
+	// TokenHealthRetryBackoff is the first delay before rechecking the owner token after Plex
+	// couldn't validate it, doubled up to the check interval (0 waits for the check interval)
+	TokenHealthRetryBackoff time.Duration `yaml:"token_health_retry_backoff" toml:"token_health_retry_backoff"`
+	// StartupMode is "strict" to exit if the owner token can't be validated at startup,
+	// or "degraded" to start not ready while Plex is unreachable
+	StartupMode string `yaml:"startup_mode" toml:"startup_mode"`
+	// AdminAPIKey grants access to the admin API besides the server owner's Plex token (empty disables)
+	AdminAPIKey     string `yaml:"admin_api_key" toml:"admin_api_key" secret:"true"`
+	AdminAPIKeyFile string `yaml:"admin_api_key_file" toml:"admin_api_key_file"`
+	// TrustedProxies are the IPs or CIDRs of the proxies whose forwarded client IP and
+	// original host and URI are used
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+	// APIKeysFile is the path the API keys created through the admin API are persisted to,
+	// empty keeps them in memory only
+	APIKeysFile string `yaml:"api_keys_file" toml:"api_keys_file"`
+
+	Policies []PolicyRule `yaml:"policies" toml:"policies"`
+	Headers  Headers      `yaml:"headers" toml:"headers"`
+	Sessions Sessions     `yaml:"sessions" toml:"sessions"`
+	APIKeys  []APIKey     `yaml:"api_keys" toml:"api_keys"`
+
+	Notifications Notifications `yaml:"notifications" toml:"notifications"`
+	Audit         Audit         `yaml:"audit" toml:"audit"`
+	History       History       `yaml:"history" toml:"history"`
+	RateLimit     RateLimit     `yaml:"rate_limit" toml:"rate_limit"`
+}
+
+// PolicyRule restricts which users may access the requests it matches.
+// Rules are evaluated in order and the first matching rule applies.
+type PolicyRule struct {
+	Name string `yaml:"name" toml:"name" json:"name"`
+	// Hosts matched by the rule, "*.example.com" matches any subdomain (empty matches all)
+	Hosts []string `yaml:"hosts" toml:"hosts" json:"hosts"`
+	// Paths are path prefixes matched by the rule (empty matches all)
+	Paths []string `yaml:"paths" toml:"paths" json:"paths"`
+	// AllowUsers are usernames or emails allowed by the rule (empty allows every user with server access)
+	AllowUsers []string `yaml:"allow_users" toml:"allow_users" json:"allow_users"`
+	// DenyUsers are usernames or emails denied by the rule
+	DenyUsers []string `yaml:"deny_users" toml:"deny_users" json:"deny_users"`
+	// AllowNetworks are IPs or CIDRs the client must belong to, besides being allowed as a user (empty allows all)
+	AllowNetworks []string `yaml:"allow_networks" toml:"allow_networks" json:"allow_networks"`
+	// BypassNetworks are IPs or CIDRs of clients allowed without authentication
+	BypassNetworks []string `yaml:"bypass_networks" toml:"bypass_networks" json:"bypass_networks"`
+	// DenyNetworks are IPs or CIDRs of clients denied by the rule, even with a valid login
+	DenyNetworks []string `yaml:"deny_networks" toml:"deny_networks" json:"deny_networks"`
+}
+
+// Headers holds the names of the identity headers returned by /auth (empty disables a header)
+type Headers struct {
+	User   string `yaml:"user" toml:"user" json:"user"`
+	UserID string `yaml:"user_id" toml:"user_id" json:"user_id"`
+	Email  string `yaml:"email" toml:"email" json:"email"`
+	// Bypass carries the name of the rule of requests allowed without authentication
+	Bypass string `yaml:"bypass" toml:"bypass" json:"bypass"`
+	// Service carries the name of the API key of requests authenticated with one
+	Service string `yaml:"service" toml:"service" json:"service"`
+}
+
+// APIKey lets a script or service authenticate to /auth without a Plex login.
+// Only the SHA-256 hash of the key is configured.
+type APIKey struct {
+	// Name identifies the service in the identity headers and the audit log
+	Name string `yaml:"name" toml:"name"`
+	// Hash is the hex-encoded SHA-256 hash of the key, optionally prefixed with "sha256:"
+	Hash string `yaml:"hash" toml:"hash"`
+	// Hosts the key may reach, "*.example.com" matches any subdomain (empty matches all)
+	Hosts []string `yaml:"hosts" toml:"hosts"`
+	// Paths are path prefixes the key may reach (empty matches all)
+	Paths []string `yaml:"paths" toml:"paths"`
+	// ExpiresAt is when the key stops being accepted (empty never expires)
+	ExpiresAt time.Time `yaml:"expires_at" toml:"expires_at"`
+}
+
+// Sessions holds the session cookie configuration
+type Sessions struct {
+	CookieName string `yaml:"cookie_name" toml:"cookie_name"`
+	// MaxAge is the absolute lifetime of a session since login
+	MaxAge time.Duration `yaml:"max_age" toml:"max_age"`
+	// IdleTimeout ends sessions without requests for this long, their cookie is
+	// renewed by /auth once past half of it (0 disables)
+	IdleTimeout time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	// VerifyInterval is how often the users with active sessions are checked against
+	// the shared users and the owner's Plex Home, revoking the sessions of users who
+	// lost access (0 disables)
+	VerifyInterval time.Duration `yaml:"verify_interval" toml:"verify_interval"`
+	// Secret signs the session state cookie. If empty, a key is derived from the
+	// owner token and server ID, sessions then end when the owner token changes,
+	// including rotations at runtime.
+	Secret     string `yaml:"secret" toml:"secret" secret:"true"`
+	SecretFile string `yaml:"secret_file" toml:"secret_file"`
+	// AdoptLegacyUntil is the end of the migration window of the sessions created before
+	// session lifetimes were enforced: until then a session without state cookie is adopted
+	// once, ending at this time. Empty logs them out.
+	AdoptLegacyUntil time.Time `yaml:"adopt_legacy_until" toml:"adopt_legacy_until"`
+}
+
+// Audit configures the audit log of authentication and admin events
+type Audit struct {
+	// Output is "stdout" or the path of a file, empty keeps the events in memory only
+	Output string `yaml:"output" toml:"output"`
+	// MaxSizeMB is the size the audit file is rotated at (0 disables rotation)
+	MaxSizeMB int `yaml:"max_size_mb" toml:"max_size_mb"`
+	// MaxBackups is the number of rotated files kept
+	MaxBackups int `yaml:"max_backups" toml:"max_backups"`
+	// RecentEvents is the number of events kept in memory for the admin API
+	RecentEvents int `yaml:"recent_events" toml:"recent_events"`
+}
+
+// History configures the store of the last-seen times and login history of the users
+type History struct {
+	// File is the path the history is persisted to, empty keeps it in memory only
+	File string `yaml:"file" toml:"file"`
+	// Retention is how long activity is kept (0 keeps it forever)
+	Retention time.Duration `yaml:"retention" toml:"retention"`
+	// MaxLogins is the number of logins and logouts kept per user (0 keeps all)
+	MaxLogins int `yaml:"max_logins" toml:"max_logins"`
+	// FlushInterval is how often the history is written to the file
+	FlushInterval time.Duration `yaml:"flush_interval" toml:"flush_interval"`
+}
+
+// RateLimit configures the limits of the endpoints calling plex.tv, in requests per minute (0 disables a limit)
+type RateLimit struct {
+	LoginPerIP    int `yaml:"login_per_ip" toml:"login_per_ip"`
+	CallbackPerIP int `yaml:"callback_per_ip" toml:"callback_per_ip"`
+	// AuthPerIP limits the /auth requests validated with Plex, cached tokens aren't limited
+	AuthPerIP int `yaml:"auth_per_ip" toml:"auth_per_ip"`
+	// Global limits the requests of all clients to each of these endpoints
+	Global int `yaml:"global" toml:"global"`
+	// LockoutFailures is the number of failed validations of a token within
+	// LockoutDuration locking it out for LockoutDuration (0 disables)
+	LockoutFailures int           `yaml:"lockout_failures" toml:"lockout_failures"`
+	LockoutDuration time.Duration `yaml:"lockout_duration" toml:"lockout_duration"`
+}
+
+// HealthChecks are the names of the health checks that can gate readiness
+var HealthChecks = map[string]bool{
+	"owner_token": true,
+	"plex":        true,
+	"cache":       true,
+	"config":      true,
+}
+
+// StartupModes are the supported startup modes
+var StartupModes = map[string]bool{
+	"strict":   true,
+	"degraded": true,
+}
+
+// Notifications configures the alerts sent when the owner token or Plex state changes
+type Notifications struct {
+	// ReAlertInterval is how often an ongoing problem is notified again (0 notifies once)
+	ReAlertInterval time.Duration `yaml:"realert_interval" toml:"realert_interval"`
+	// UnreachableChecks is the number of consecutive token checks Plex must be unreachable for to alert
+	UnreachableChecks int                   `yaml:"unreachable_checks" toml:"unreachable_checks"`
+	Channels          []NotificationChannel `yaml:"channels" toml:"channels"`
+}
+
+// NotificationChannel is a destination of the notifications
+type NotificationChannel struct {
+	// Type is one of webhook, discord, slack, ntfy or gotify
+	Type string `yaml:"type" toml:"type"`
+	// URL is the webhook URL, the ntfy topic URL or the Gotify server URL
+	URL     string `yaml:"url" toml:"url" secret:"true"`
+	URLFile string `yaml:"url_file" toml:"url_file"`
+	// Token authenticates with ntfy (access token) or Gotify (application token)
+	Token     string `yaml:"token" toml:"token" secret:"true"`
+	TokenFile string `yaml:"token_file" toml:"token_file"`
+}
+
+// NotificationTypes are the supported notification channel types
+var NotificationTypes = map[string]bool{
+	"webhook": true,
+	"discord": true,
+	"slack":   true,
+	"ntfy":    true,
+	"gotify":  true,
+}
+
+// Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		PlexURL:                    "https://plex.tv",
+		PlexClientID:               "plex-auth-nginx-module",
+		ServerAddr:                 ":8080",
+		ServerReadHeaderTimeout:    10 * time.Second,
+		ServerReadTimeout:          30 * time.Second,
+		ServerWriteTimeout:         30 * time.Second,
+		ServerIdleTimeout:          2 * time.Minute,
+		ShutdownTimeout:            15 * time.Second,
+		CallbackURL:                "http://localhost:8080/callback",
+		CacheTTL:                   5 * time.Minute,
+		CacheMaxSize:               1000,
+		TokenHealthCheckTTL:        5 * time.Minute,
+		TokenHealthRetryBackoff:    5 * time.Second,
+		StartupMode:                "strict",
+		SharedUsersRefreshInterval: 5 * time.Minute,
+		PlexRequestTimeout:         10 * time.Second,
+		PlexMaxRetries:             2,
+		PlexRetryBackoff:           200 * time.Millisecond,
+		PlexBreakerFailures:        5,
+		PlexBreakerFailureRate:     0.5,
+		PlexBreakerOpenTimeout:     30 * time.Second,
+		ReloadInterval:             10 * time.Second,
+		HealthCheckTimeout:         2 * time.Second,
+		TrustedProxies:             []string{"127.0.0.1/8", "::1/128"},
+		Headers: Headers{
+			User:    "X-Auth-User",
+			UserID:  "X-Auth-User-Id",
+			Email:   "X-Auth-Email",
+			Bypass:  "X-Auth-Bypass",
+			Service: "X-Auth-Service",
+		},
+		Sessions: Sessions{
+			CookieName:     "X-Plex-Token",
+			MaxAge:         30 * 24 * time.Hour,
+			VerifyInterval: 5 * time.Minute,
+		},
+		Notifications: Notifications{
+			ReAlertInterval:   6 * time.Hour,
+			UnreachableChecks: 3,
+		},
+		Audit: Audit{
+			MaxSizeMB:    100,
+			MaxBackups:   5,
+			RecentEvents: 1000,
+		},
+		History: History{
+			Retention:     90 * 24 * time.Hour,
+			MaxLogins:     50,
+			FlushInterval: 30 * time.Second,
+		},
+		RateLimit: RateLimit{
+			LoginPerIP:      10,
+			CallbackPerIP:   60,
+			AuthPerIP:       120,
+			Global:          600,
+			LockoutFailures: 5,
+			LockoutDuration: 15 * time.Minute,
+		},
+	}
+}
+
+// Load reads configuration from the file named by CONFIG_FILE (if any)
+// and from environment variables
 func Load() (*Config, error) {
-	cfg := &Config{
-		PlexURL:      os.Getenv("PLEX_URL"),
-		PlexToken:    os.Getenv("PLEX_TOKEN"),
-		PlexServerID: os.Getenv("PLEX_SERVER_ID"),
-		PlexClientID: os.Getenv("PLEX_CLIENT_ID"),
-		ServerAddr:   os.Getenv("SERVER_ADDR"),
-		CallbackURL:  os.Getenv("CALLBACK_URL"),
-		CookieDomain: os.Getenv("COOKIE_DOMAIN"),
-		CookieSecure: os.Getenv("COOKIE_SECURE") == "true",
+	return LoadFrom(os.Getenv("CONFIG_FILE"))
+}
+
+// LoadFrom reads configuration from a YAML or TOML file (if path is not empty)
+// and from environment variables, which take precedence over the file.
+// Every invalid value is reported at once.
+func LoadFrom(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		if err := loadFile(path, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	errs = append(errs, loadEnv(cfg)...)
+	errs = append(errs, cfg.readSecretFiles()...)
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+
+	return cfg, nil
+}
+
+// loadEnv overrides configuration values with the environment variables that are set
+func loadEnv(cfg *Config) []error {
+	env := &envLoader{}
+
+	env.string("PLEX_URL", &cfg.PlexURL)
+	env.secret("PLEX_TOKEN", &cfg.PlexToken, &cfg.PlexTokenFile)
+	env.duration("PLEX_TOKEN_WATCH_INTERVAL", time.Second, &cfg.PlexTokenWatchInterval)
+	env.string("PLEX_SERVER_ID", &cfg.PlexServerID)
+	env.string("PLEX_CLIENT_ID", &cfg.PlexClientID)
+	env.string("SERVER_ADDR", &cfg.ServerAddr)
+	env.duration("SERVER_READ_HEADER_TIMEOUT", time.Second, &cfg.ServerReadHeaderTimeout)
+	env.duration("SERVER_READ_TIMEOUT", time.Second, &cfg.ServerReadTimeout)
+	env.duration("SERVER_WRITE_TIMEOUT", time.Second, &cfg.ServerWriteTimeout)
+	env.duration("SERVER_IDLE_TIMEOUT", time.Second, &cfg.ServerIdleTimeout)
+	env.duration("SHUTDOWN_TIMEOUT", time.Second, &cfg.ShutdownTimeout)
+	env.string("CALLBACK_URL", &cfg.CallbackURL)
+	env.string("COOKIE_DOMAIN", &cfg.CookieDomain)
+	env.bool("COOKIE_SECURE", &cfg.CookieSecure)
+
+	// Plain numbers keep their historical unit, e.g. CACHE_TTL_SECONDS=300 or 5m
+	env.duration("CACHE_TTL_SECONDS", time.Second, &cfg.CacheTTL)
+	env.int("CACHE_MAX_SIZE", &cfg.CacheMaxSize)
+	env.duration("CACHE_STALE_GRACE_SECONDS", time.Second, &cfg.CacheStaleGrace)
+	env.duration("TOKEN_HEALTH_CHECK_INTERVAL", time.Second, &cfg.TokenHealthCheckTTL)
+	env.duration("TOKEN_HEALTH_RETRY_BACKOFF", time.Second, &cfg.TokenHealthRetryBackoff)
+	env.string("STARTUP_MODE", &cfg.StartupMode)
+	env.secret("ADMIN_API_KEY", &cfg.AdminAPIKey, &cfg.AdminAPIKeyFile)
+	env.duration("SHARED_USERS_REFRESH_INTERVAL", time.Second, &cfg.SharedUsersRefreshInterval)
+	env.duration("PLEX_REQUEST_TIMEOUT_SECONDS", time.Second, &cfg.PlexRequestTimeout)
+	env.int("PLEX_MAX_RETRIES", &cfg.PlexMaxRetries)
+	env.duration("PLEX_RETRY_BACKOFF_MS", time.Millisecond, &cfg.PlexRetryBackoff)
+	env.int("PLEX_BREAKER_FAILURES", &cfg.PlexBreakerFailures)
+	env.float("PLEX_BREAKER_FAILURE_RATE", &cfg.PlexBreakerFailureRate)
+	env.duration("PLEX_BREAKER_OPEN_SECONDS", time.Second, &cfg.PlexBreakerOpenTimeout)
+	env.duration("CONFIG_RELOAD_INTERVAL", time.Second, &cfg.ReloadInterval)
+	env.duration("HEALTH_CHECK_TIMEOUT", time.Second, &cfg.HealthCheckTimeout)
+	env.list("READINESS_CHECKS", &cfg.ReadinessChecks)
+
+	env.string("HEADER_USER", &cfg.Headers.User)
+	env.string("HEADER_USER_ID", &cfg.Headers.UserID)
+	env.string("HEADER_EMAIL", &cfg.Headers.Email)
+	env.string("HEADER_BYPASS", &cfg.Headers.Bypass)
+	env.string("HEADER_SERVICE", &cfg.Headers.Service)
+
+	env.string("SESSION_COOKIE_NAME", &cfg.Sessions.CookieName)
+	env.duration("SESSION_MAX_AGE", time.Second, &cfg.Sessions.MaxAge)
+	env.duration("SESSION_IDLE_TIMEOUT", time.Second, &cfg.Sessions.IdleTimeout)
+	env.duration("SESSION_VERIFY_INTERVAL", time.Second, &cfg.Sessions.VerifyInterval)
+	env.secret("SESSION_SECRET", &cfg.Sessions.Secret, &cfg.Sessions.SecretFile)
+	env.time("SESSION_ADOPT_LEGACY_UNTIL", &cfg.Sessions.AdoptLegacyUntil)
+
+	env.duration("NOTIFY_REALERT_INTERVAL", time.Second, &cfg.Notifications.ReAlertInterval)
+	env.int("NOTIFY_UNREACHABLE_CHECKS", &cfg.Notifications.UnreachableChecks)
+	// Channels from the environment are added to the ones of the configuration file
+	for _, channelType := range sortedKeys(NotificationTypes) {
+		prefix := "NOTIFY_" + strings.ToUpper(channelType)
+		var channel NotificationChannel
+		env.secret(prefix+"_URL", &channel.URL, &channel.URLFile)
+		env.secret(prefix+"_TOKEN", &channel.Token, &channel.TokenFile)
+		if channel.URL != "" || channel.URLFile != "" {
+			channel.Type = channelType
+			cfg.Notifications.Channels = append(cfg.Notifications.Channels, channel)
+		}
+	}
+
+	env.string("AUDIT_LOG", &cfg.Audit.Output)
+	env.int("AUDIT_LOG_MAX_SIZE_MB", &cfg.Audit.MaxSizeMB)
+	env.int("AUDIT_LOG_MAX_BACKUPS", &cfg.Audit.MaxBackups)
+	env.int("AUDIT_RECENT_EVENTS", &cfg.Audit.RecentEvents)
+
+	env.string("HISTORY_FILE", &cfg.History.File)
+	env.duration("HISTORY_RETENTION", time.Second, &cfg.History.Retention)
+	env.int("HISTORY_MAX_LOGINS", &cfg.History.MaxLogins)
+	env.duration("HISTORY_FLUSH_INTERVAL", time.Second, &cfg.History.FlushInterval)
+
+	env.string("API_KEYS_FILE", &cfg.APIKeysFile)
+
+	env.list("TRUSTED_PROXIES", &cfg.TrustedProxies)
+	env.int("RATE_LIMIT_LOGIN", &cfg.RateLimit.LoginPerIP)
+	env.int("RATE_LIMIT_CALLBACK", &cfg.RateLimit.CallbackPerIP)
+	env.int("RATE_LIMIT_AUTH", &cfg.RateLimit.AuthPerIP)
+	env.int("RATE_LIMIT_GLOBAL", &cfg.RateLimit.Global)
+	env.int("TOKEN_LOCKOUT_FAILURES", &cfg.RateLimit.LockoutFailures)
+	env.duration("TOKEN_LOCKOUT_DURATION", time.Second, &cfg.RateLimit.LockoutDuration)
+
+	return env.errs
+}
+
+// secretFile is a secret setting that can be read from a file
+type secretFile struct {
+	name  string
+	value *string
+	path  *string
+}
+
+// secretFiles lists the secret settings and the settings naming the files they can be read from
+func (c *Config) secretFiles() []secretFile {
+	secrets := []secretFile{
+		{name: "plex_token", value: &c.PlexToken, path: &c.PlexTokenFile},
+		{name: "admin_api_key", value: &c.AdminAPIKey, path: &c.AdminAPIKeyFile},
+		{name: "sessions.secret", value: &c.Sessions.Secret, path: &c.Sessions.SecretFile},
+	}
+	for i := range c.Notifications.Channels {
+		channel := &c.Notifications.Channels[i]
+		name := fmt.Sprintf("notifications.channels[%d].", i)
+		secrets = append(secrets,
+			secretFile{name: name + "url", value: &channel.URL, path: &channel.URLFile},
+			secretFile{name: name + "token", value: &channel.Token, path: &channel.TokenFile},
+		)
+	}
+	return secrets
+}
+
+// readSecretFiles replaces the secrets configured with a file by the file content
+func (c *Config) readSecretFiles() []error {
+	var errs []error
+	for _, secret := range c.secretFiles() {
+		if *secret.path == "" {
+			continue
+		}
+		value, err := ReadSecretFile(*secret.path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s_file: %w", secret.name, err))
+			continue
+		}
+		*secret.value = value
+	}
+	return errs
+}
+
+// ReadSecretFile reads a secret from a file such as a Docker or Kubernetes secret,
+// ignoring surrounding whitespace
+func ReadSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return value, nil
+}
+
+// validate checks every value and returns all the problems found
+func (c *Config) validate() []error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
 	}
 
-	// Set defaults
-	if cfg.ServerAddr == "" {
-		cfg.ServerAddr = ":8080"
+	if c.PlexToken == "" {
+		fail("plex_token (PLEX_TOKEN or PLEX_TOKEN_FILE) is required")
+	}
+	if c.PlexServerID == "" {
+		fail("plex_server_id (PLEX_SERVER_ID) is required")
+	}
+	if u, err := url.Parse(c.PlexURL); err != nil || u.Scheme == "" || u.Host == "" {
+		fail("plex_url: invalid URL %q", c.PlexURL)
+	}
+	if c.PlexClientID == "" {
+		fail("plex_client_id must not be empty")
+	}
+	if c.ServerAddr == "" {
+		fail("server_addr must not be empty")
+	}
+	if u, err := url.Parse(c.CallbackURL); err != nil || u.Scheme == "" || u.Host == "" {
+		fail("callback_url: invalid URL %q", c.CallbackURL)
 	}
 
-	if cfg.PlexURL == "" {
-		cfg.PlexURL = "https://plex.tv"
+	positive := map[string]time.Duration{
+		"cache_ttl":                     c.CacheTTL,
+		"server_read_header_timeout":    c.ServerReadHeaderTimeout,
+		"server_read_timeout":           c.ServerReadTimeout,
+		"server_write_timeout":          c.ServerWriteTimeout,
+		"server_idle_timeout":           c.ServerIdleTimeout,
+		"shutdown_timeout":              c.ShutdownTimeout,
+		"health_check_timeout":          c.HealthCheckTimeout,
+		"token_health_check_interval":   c.TokenHealthCheckTTL,
+		"shared_users_refresh_interval": c.SharedUsersRefreshInterval,
+		"plex_request_timeout":          c.PlexRequestTimeout,
+		"plex_retry_backoff":            c.PlexRetryBackoff,
+		"plex_breaker_open_timeout":     c.PlexBreakerOpenTimeout,
+		"sessions.max_age":              c.Sessions.MaxAge,
+	}
+	for _, name := range sortedKeys(positive) {
+		if positive[name] <= 0 {
+			fail("%s must be a positive duration, got %v", name, positive[name])
+		}
+	}
+	if c.PlexTokenWatchInterval < 0 {
+		fail("plex_token_watch_interval must not be negative, got %v", c.PlexTokenWatchInterval)
+	}
+	if c.PlexTokenWatchInterval > 0 && c.PlexTokenFile == "" {
+		fail("plex_token_watch_interval requires plex_token_file (PLEX_TOKEN_FILE)")
+	}
+	if c.AdminAPIKey != "" && len(c.AdminAPIKey) < 16 {
+		fail("admin_api_key must be at least 16 characters long")
+	}
+	if c.Sessions.IdleTimeout < 0 {
+		fail("sessions.idle_timeout must not be negative, got %v", c.Sessions.IdleTimeout)
+	}
+	if c.Sessions.VerifyInterval < 0 {
+		fail("sessions.verify_interval must not be negative, got %v", c.Sessions.VerifyInterval)
+	}
+	if c.Sessions.Secret != "" && len(c.Sessions.Secret) < 16 {
+		fail("sessions.secret must be at least 16 characters long")
+	}
+	if c.TokenHealthRetryBackoff < 0 {
+		fail("token_health_retry_backoff must not be negative, got %v", c.TokenHealthRetryBackoff)
+	}
+	if !StartupModes[c.StartupMode] {
+		fail("startup_mode: unknown mode %q (use %s)", c.StartupMode, strings.Join(sortedKeys(StartupModes), ", "))
+	}
+	if c.ReloadInterval < 0 {
+		fail("reload_interval must not be negative, got %v", c.ReloadInterval)
+	}
+	if c.CacheStaleGrace < 0 {
+		fail("cache_stale_grace must not be negative, got %v", c.CacheStaleGrace)
+	}
+	if c.CacheMaxSize <= 0 {
+		fail("cache_max_size must be positive, got %d", c.CacheMaxSize)
+	}
+	if c.PlexMaxRetries < 0 {
+		fail("plex_max_retries must not be negative, got %d", c.PlexMaxRetries)
+	}
+	if c.PlexBreakerFailures < 0 {
+		fail("plex_breaker_failures must not be negative, got %d", c.PlexBreakerFailures)
+	}
+	if c.PlexBreakerFailureRate < 0 || c.PlexBreakerFailureRate > 1 {
+		fail("plex_breaker_failure_rate must be between 0 and 1, got %g", c.PlexBreakerFailureRate)
 	}
 
-	if cfg.CallbackURL == "" {
-		cfg.CallbackURL = "http://localhost:8080/callback"
+	for _, name := range c.ReadinessChecks {
+		if !HealthChecks[name] {
+			fail("readiness_checks: unknown check %q (use %s)", name, strings.Join(sortedKeys(HealthChecks), ", "))
+		}
 	}
 
-	if cfg.PlexClientID == "" {
-		cfg.PlexClientID = "plex-auth-nginx-module"
+	for i, rule := range c.Policies {
+		name := fmt.Sprintf("policies[%d]", i)
+		if rule.Name != "" {
+			name = fmt.Sprintf("policies[%d] (%s)", i, rule.Name)
+		}
+		if len(rule.AllowUsers) == 0 && len(rule.DenyUsers) == 0 && len(rule.AllowNetworks) == 0 && len(rule.BypassNetworks) == 0 && len(rule.DenyNetworks) == 0 {
+			fail("%s: allow_users, deny_users, allow_networks, bypass_networks or deny_networks is required", name)
+		}
+		networks := map[string][]string{
+			"allow_networks":  rule.AllowNetworks,
+			"bypass_networks": rule.BypassNetworks,
+			"deny_networks":   rule.DenyNetworks,
+		}
+		for _, field := range sortedKeys(networks) {
+			for _, network := range networks[field] {
+				if parseCIDR(network) == nil {
+					fail("%s: %s: invalid IP or CIDR %q", name, field, network)
+				}
+			}
+		}
+		for _, err := range scopeErrors(rule.Hosts, rule.Paths) {
+			fail("%s: %v", name, err)
+		}
 	}
 
-	// Cache configuration with defaults
-	cacheTTLSeconds := 300 // Default 5 minutes
-	if ttlEnv := os.Getenv("CACHE_TTL_SECONDS"); ttlEnv != "" {
-		if ttl, err := strconv.Atoi(ttlEnv); err == nil && ttl > 0 {
-			cacheTTLSeconds = ttl
+	keyNames := make(map[string]bool, len(c.APIKeys))
+	for i, key := range c.APIKeys {
+		name := fmt.Sprintf("api_keys[%d]", i)
+		if keyNames[key.Name] {
+			fail("%s: duplicate name %q", name, key.Name)
+		}
+		keyNames[key.Name] = true
+		if hash := strings.TrimPrefix(key.Hash, "sha256:"); len(hash) != 64 || strings.Trim(strings.ToLower(hash), "0123456789abcdef") != "" {
+			fail("%s: hash must be a hex-encoded SHA-256 hash", name)
+		}
+		for _, err := range ValidateAPIKey(key.Name, key.Hosts, key.Paths) {
+			fail("%s: %v", name, err)
 		}
 	}
-	cfg.CacheTTL = time.Duration(cacheTTLSeconds) * time.Second
 
-	cfg.CacheMaxSize = 1000 // Default max 1000 tokens
-	if maxSizeEnv := os.Getenv("CACHE_MAX_SIZE"); maxSizeEnv != "" {
-		if maxSize, err := strconv.Atoi(maxSizeEnv); err == nil && maxSize > 0 {
-			cfg.CacheMaxSize = maxSize
+	if c.Notifications.ReAlertInterval < 0 {
+		fail("notifications.realert_interval must not be negative, got %v", c.Notifications.ReAlertInterval)
+	}
+	if c.Notifications.UnreachableChecks <= 0 {
+		fail("notifications.unreachable_checks must be positive, got %d", c.Notifications.UnreachableChecks)
+	}
+	for i, channel := range c.Notifications.Channels {
+		name := fmt.Sprintf("notifications.channels[%d]", i)
+		if !NotificationTypes[channel.Type] {
+			fail("%s: unknown type %q (use %s)", name, channel.Type, strings.Join(sortedKeys(NotificationTypes), ", "))
+		}
+		// The URL is secret, don't include it in the error
+		if u, err := url.Parse(channel.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("%s: invalid URL", name)
+		}
+		if channel.Type == "gotify" && channel.Token == "" {
+			fail("%s: token is required for gotify", name)
 		}
 	}
 
-	// Token health check configuration
-	tokenHealthCheckSeconds := 300 // Default 5 minutes
-	if healthEnv := os.Getenv("TOKEN_HEALTH_CHECK_INTERVAL"); healthEnv != "" {
-		if interval, err := strconv.Atoi(healthEnv); err == nil && interval > 0 {
-			tokenHealthCheckSeconds = interval
+	if c.Audit.MaxSizeMB < 0 {
+		fail("audit.max_size_mb must not be negative, got %d", c.Audit.MaxSizeMB)
+	}
+	if c.Audit.MaxBackups < 0 {
+		fail("audit.max_backups must not be negative, got %d", c.Audit.MaxBackups)
+	}
+	if c.Audit.RecentEvents < 0 {
+		fail("audit.recent_events must not be negative, got %d", c.Audit.RecentEvents)
+	}
+
+	for _, proxy := range c.TrustedProxies {
+		if parseCIDR(proxy) == nil {
+			fail("trusted_proxies: invalid IP or CIDR %q", proxy)
+		}
+	}
+	limits := map[string]int{
+		"rate_limit.login_per_ip":     c.RateLimit.LoginPerIP,
+		"rate_limit.callback_per_ip":  c.RateLimit.CallbackPerIP,
+		"rate_limit.auth_per_ip":      c.RateLimit.AuthPerIP,
+		"rate_limit.global":           c.RateLimit.Global,
+		"rate_limit.lockout_failures": c.RateLimit.LockoutFailures,
+	}
+	for _, name := range sortedKeys(limits) {
+		if limits[name] < 0 {
+			fail("%s must not be negative, got %d", name, limits[name])
+		}
+	}
+	if c.RateLimit.LockoutFailures > 0 && c.RateLimit.LockoutDuration <= 0 {
+		fail("rate_limit.lockout_duration must be positive, got %v", c.RateLimit.LockoutDuration)
+	}
+
+	if c.History.Retention < 0 {
+		fail("history.retention must not be negative, got %v", c.History.Retention)
+	}
+	if c.History.MaxLogins < 0 {
+		fail("history.max_logins must not be negative, got %d", c.History.MaxLogins)
+	}
+	if c.History.FlushInterval <= 0 {
+		fail("history.flush_interval must be positive, got %v", c.History.FlushInterval)
+	}
+
+	headers := map[string]string{
+		"headers.user":    c.Headers.User,
+		"headers.user_id": c.Headers.UserID,
+		"headers.email":   c.Headers.Email,
+		"headers.bypass":  c.Headers.Bypass,
+		"headers.service": c.Headers.Service,
+	}
+	for _, name := range sortedKeys(headers) {
+		if headers[name] != "" && !isToken(headers[name]) {
+			fail("%s: invalid header name %q", name, headers[name])
 		}
 	}
-	cfg.TokenHealthCheckTTL = time.Duration(tokenHealthCheckSeconds) * time.Second
 
-	// Validate required fields
-	if cfg.PlexToken == "" {
-		return nil, fmt.Errorf("PLEX_TOKEN environment variable is required")
+	if !isToken(c.Sessions.CookieName) {
+		fail("sessions.cookie_name: invalid cookie name %q", c.Sessions.CookieName)
 	}
 
-	if cfg.PlexServerID == "" {
-		return nil, fmt.Errorf("PLEX_SERVER_ID environment variable is required")
+	return errs
+}
+
+// ValidateAPIKey checks the name and scopes of an API key, the name is sent in a header
+func ValidateAPIKey(name string, hosts, paths []string) []error {
+	var errs []error
+	if !isToken(name) {
+		errs = append(errs, fmt.Errorf("invalid name %q, it must not be empty or contain spaces or separators", name))
 	}
+	return append(errs, scopeErrors(hosts, paths)...)
+}
 
-	return cfg, nil
+// scopeErrors checks the host patterns and path prefixes of a policy rule or API key
+func scopeErrors(hosts, paths []string) []error {
+	var errs []error
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("path %q must start with /", path))
+		}
+	}
+	for _, host := range hosts {
+		if host == "" || strings.Contains(host[1:], "*") || (strings.HasPrefix(host, "*") && !strings.HasPrefix(host, "*.")) {
+			errs = append(errs, fmt.Errorf("invalid host %q", host))
+		}
+	}
+	return errs
+}
+
+// ParseCIDRs parses a list of IPs or CIDRs, skipping invalid entries
+func ParseCIDRs(values []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, value := range values {
+		if network := parseCIDR(value); network != nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// parseCIDR parses a CIDR or a single IP, returning nil if it is invalid
+func parseCIDR(value string) *net.IPNet {
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		return network
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// isToken returns true if s is a valid HTTP token (header or cookie name)
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?={}`, r) {
+			return false
+		}
+	}
+	return true
 }
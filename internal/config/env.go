@@ -0,0 +1,140 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envLoader reads typed environment variables, collecting every parse error
+type envLoader struct {
+	errs []error
+}
+
+func (e *envLoader) fail(name, kind, value string) {
+	e.errs = append(e.errs, fmt.Errorf("%s: invalid %s %q", name, kind, value))
+}
+
+func (e *envLoader) string(name string, target *string) {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		*target = value
+	}
+}
+
+// secret reads a secret from name, or from the file named by name_FILE.
+// Setting either one overrides both the value and the file of the configuration file.
+func (e *envLoader) secret(name string, target, file *string) {
+	value, path := os.Getenv(name), os.Getenv(name+"_FILE")
+	switch {
+	case value != "" && path != "":
+		e.errs = append(e.errs, fmt.Errorf("%s and %s_FILE are mutually exclusive", name, name))
+		*target = value
+	case value != "":
+		*target = value
+		*file = ""
+	case path != "":
+		*file = path
+	}
+}
+
+// list reads a comma-separated list, ignoring empty items
+func (e *envLoader) list(name string, target *[]string) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*target = items
+}
+
+func (e *envLoader) bool(name string, target *bool) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		e.fail(name, "boolean", value)
+		return
+	}
+	*target = parsed
+}
+
+func (e *envLoader) int(name string, target *int) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		e.fail(name, "integer", value)
+		return
+	}
+	*target = parsed
+}
+
+func (e *envLoader) float(name string, target *float64) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		e.fail(name, "number", value)
+		return
+	}
+	*target = parsed
+}
+
+// duration accepts a plain number in the given unit or a Go duration such as "5m"
+func (e *envLoader) duration(name string, unit time.Duration, target *time.Duration) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := parseDuration(value, unit)
+	if err != nil {
+		e.fail(name, "duration", value)
+		return
+	}
+	*target = parsed
+}
+
+// time reads an RFC 3339 time such as "2024-01-31T00:00:00Z"
+func (e *envLoader) time(name string, target *time.Time) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		e.fail(name, "RFC 3339 time", value)
+		return
+	}
+	*target = parsed
+}
+
+// parseDuration parses a plain number in the given unit or a Go duration such as "5m"
+func parseDuration(value string, unit time.Duration) (time.Duration, error) {
+	if n, err := strconv.Atoi(value); err == nil {
+		return time.Duration(n) * unit, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
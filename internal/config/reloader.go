@@ -0,0 +1,215 @@
+package config
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reloadableFields are the settings applied by a reload,
+// changing any other setting requires a restart
+var reloadableFields = map[string]bool{
+	"CacheTTL":        true,
+	"CacheMaxSize":    true,
+	"CacheStaleGrace": true,
+	"Policies":        true,
+	"Headers":         true,
+	"ReadinessChecks": true,
+	"APIKeys":         true,
+}
+
+// runtimeFields are changed at runtime by other means and ignored by reloads,
+// the owner token is rotated through the admin API or its secret file
+var runtimeFields = map[string]bool{
+	"PlexToken": true,
+}
+
+// ReloadStats describes the configuration reloads since startup
+type ReloadStats struct {
+	Reloads      int       `json:"reloads"`
+	Failures     int       `json:"failures"`
+	LastReloadAt time.Time `json:"last_reload_at"`
+	LastResult   string    `json:"last_result,omitempty"`
+	LastTrigger  string    `json:"last_trigger,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// Reloader holds the current configuration and reloads it from the
+// configuration file and environment when asked to or when the file changes.
+// Invalid configurations are rejected and the current one is kept.
+type Reloader struct {
+	path     string
+	current  atomic.Pointer[Config]
+	reloadMu sync.Mutex
+	statsMu  sync.RWMutex
+	stats    ReloadStats
+	modTime  time.Time
+	size     int64
+	stopChan chan struct{}
+	onReload func(old, new *Config)
+}
+
+// NewReloader creates a reloader for the configuration loaded from path
+func NewReloader(path string, cfg *Config) *Reloader {
+	r := &Reloader{
+		path:     path,
+		stopChan: make(chan struct{}),
+	}
+	r.current.Store(cfg)
+	r.modTime, r.size = r.fileState()
+	return r
+}
+
+// SetReloadCallback sets a callback function that will be called with the
+// previous and new configuration after each successful reload
+func (r *Reloader) SetReloadCallback(callback func(old, new *Config)) {
+	r.onReload = callback
+}
+
+// Current returns the configuration in use
+func (r *Reloader) Current() *Config {
+	return r.current.Load()
+}
+
+// Stats returns the reload counters and the result of the last reload
+func (r *Reloader) Stats() ReloadStats {
+	r.statsMu.RLock()
+	defer r.statsMu.RUnlock()
+	return r.stats
+}
+
+// Start watches the configuration file for changes, checking every
+// ReloadInterval. Nothing is watched without a file or with a zero interval.
+func (r *Reloader) Start() {
+	interval := r.Current().ReloadInterval
+	if r.path == "" || interval <= 0 {
+		return
+	}
+
+	log.Printf("Watching config file %s for changes (check interval: %v)", r.path, interval)
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if r.fileChanged() {
+					r.Reload("file change")
+				}
+			case <-r.stopChan:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops watching the configuration file
+func (r *Reloader) Stop() {
+	close(r.stopChan)
+}
+
+// Reload loads and validates the configuration, then swaps it in.
+// The trigger (e.g. "SIGHUP") is only used for logging and stats.
+func (r *Reloader) Reload(trigger string) error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	// Record the file state first so a rejected file isn't reloaded again until it changes
+	r.modTime, r.size = r.fileState()
+
+	old := r.Current()
+	cfg, err := LoadFrom(r.path)
+	if err != nil {
+		log.Printf("⚠️  Config reload (%s) rejected, keeping the running configuration: %v", trigger, err)
+		r.record(trigger, err)
+		return err
+	}
+
+	if fields := restartRequired(old, cfg); len(fields) > 0 {
+		log.Printf("⚠️  Config reload (%s): changes to %s require a restart and were ignored", trigger, strings.Join(fields, ", "))
+	}
+
+	cfg = mergeReloadable(old, cfg)
+	r.current.Store(cfg)
+	r.record(trigger, nil)
+	log.Printf("✓ Configuration reloaded (%s)", trigger)
+
+	if r.onReload != nil {
+		r.onReload(old, cfg)
+	}
+	return nil
+}
+
+// record updates the stats with the result of a reload
+func (r *Reloader) record(trigger string, err error) {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+
+	r.stats.LastReloadAt = time.Now()
+	r.stats.LastTrigger = trigger
+	if err != nil {
+		r.stats.Failures++
+		r.stats.LastResult = "rejected"
+		r.stats.LastError = err.Error()
+		return
+	}
+	r.stats.Reloads++
+	r.stats.LastResult = "success"
+	r.stats.LastError = ""
+}
+
+// fileChanged returns true if the modification time or size of the file changed
+func (r *Reloader) fileChanged() bool {
+	modTime, size := r.fileState()
+
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	return !modTime.Equal(r.modTime) || size != r.size
+}
+
+// fileState returns the modification time and size of the configuration file,
+// zero values if it can't be read
+func (r *Reloader) fileState() (time.Time, int64) {
+	if r.path == "" {
+		return time.Time{}, 0
+	}
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return time.Time{}, 0
+	}
+	return info.ModTime(), info.Size()
+}
+
+// restartRequired returns the names of the settings that differ
+// between two configurations but can't be reloaded
+func restartRequired(old, new *Config) []string {
+	var fields []string
+	oldValue, newValue := reflect.ValueOf(*old), reflect.ValueOf(*new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		if reloadableFields[field.Name] || runtimeFields[field.Name] {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			fields = append(fields, strings.Split(field.Tag.Get("yaml"), ",")[0])
+		}
+	}
+	return fields
+}
+
+// mergeReloadable returns a copy of old with the reloadable settings of new
+func mergeReloadable(old, new *Config) *Config {
+	merged := *old
+	mergedValue, newValue := reflect.ValueOf(&merged).Elem(), reflect.ValueOf(*new)
+	for i := 0; i < mergedValue.NumField(); i++ {
+		if reloadableFields[mergedValue.Type().Field(i).Name] {
+			mergedValue.Field(i).Set(newValue.Field(i))
+		}
+	}
+	return &merged
+}
@@ -0,0 +1,202 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
+)
+
+// Check reports whether a dependency of the server is healthy, returning nil if it is
+type Check func(ctx context.Context) error
+
+// CheckResult is the outcome of a named check
+type CheckResult struct {
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+	// GatesReadiness is true if a failure makes the server not ready
+	GatesReadiness bool   `json:"gates_readiness"`
+	Duration       string `json:"duration"`
+}
+
+// namedCheck is a check registered under a name
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Registry holds the named checks run by the health endpoints
+type Registry struct {
+	mu        sync.RWMutex
+	checks    []namedCheck
+	readiness map[string]bool
+	timeout   time.Duration
+}
+
+// NewRegistry creates an empty registry whose checks get timeout to complete
+func NewRegistry(timeout time.Duration) *Registry {
+	return &Registry{timeout: timeout}
+}
+
+// Register adds a named check
+func (r *Registry) Register(name string, check Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = append(r.checks, namedCheck{name: name, check: check})
+}
+
+// SetReadinessChecks sets the names of the checks that gate readiness.
+// With no names, every check gates readiness.
+func (r *Registry) SetReadinessChecks(names []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.readiness = nil
+	if len(names) == 0 {
+		return
+	}
+	r.readiness = make(map[string]bool, len(names))
+	for _, name := range names {
+		r.readiness[name] = true
+	}
+}
+
+// Run runs every check concurrently and returns their results by name
+func (r *Registry) Run(ctx context.Context) map[string]CheckResult {
+	r.mu.RLock()
+	checks := r.checks
+	readiness := r.readiness
+	r.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	results := make(map[string]CheckResult, len(checks))
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c namedCheck) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := runCheck(ctx, c.check)
+			result := CheckResult{
+				Healthy:        err == nil,
+				GatesReadiness: readiness == nil || readiness[c.name],
+				Duration:       time.Since(start).Round(time.Millisecond).String(),
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+
+			resultsMu.Lock()
+			results[c.name] = result
+			resultsMu.Unlock()
+		}(c)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// runCheck runs a check, giving up when the context is done even if the check doesn't
+func runCheck(ctx context.Context, check Check) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("check timed out: %w", ctx.Err())
+	}
+}
+
+// Ready returns true if no check gating readiness failed
+func Ready(results map[string]CheckResult) bool {
+	for _, result := range results {
+		if result.GatesReadiness && !result.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// TokenCheck fails while the owner token is invalid or doesn't own the Plex server
+func TokenCheck(monitor *TokenMonitor) Check {
+	return func(ctx context.Context) error {
+		status := monitor.GetStatus()
+		if status.Valid && !status.ServerOwned {
+			return ErrServerNotOwned
+		}
+		if status.Valid {
+			return nil
+		}
+		if status.LastError != "" {
+			return errors.New(status.LastError)
+		}
+		return errors.New("owner token has not been validated yet")
+	}
+}
+
+// plexCheckCacheDuration limits how often the Plex check calls the Plex API
+const plexCheckCacheDuration = 5 * time.Second
+
+// PlexCheck fails if the Plex API doesn't answer within the check timeout.
+// The result is reused for a few seconds so frequent probes don't load Plex.
+func PlexCheck(client *plex.Client) Check {
+	var mu sync.Mutex
+	var lastErr error
+	var lastChecked time.Time
+
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if time.Since(lastChecked) < plexCheckCacheDuration {
+			return lastErr
+		}
+
+		// A rejected owner token still means Plex answered
+		_, err := client.IdentifyContext(ctx, client.Token())
+		if err != nil {
+			err = fmt.Errorf("Plex API unreachable: %w", err)
+		}
+
+		lastErr, lastChecked = err, time.Now()
+		return err
+	}
+}
+
+// cacheCleanupMissed is the number of cleanup intervals without cleanup failing the cache check
+const cacheCleanupMissed = 3
+
+// CacheCheck fails if the token cache stopped removing expired entries, revoked tokens then
+// pile up in memory. A cache kept locked times the check out.
+func CacheCheck(tokenCache *cache.TokenCache) Check {
+	return func(ctx context.Context) error {
+		if since := time.Since(tokenCache.LastCleanup()); since > cacheCleanupMissed*cache.CleanupInterval {
+			return fmt.Errorf("token cache cleanup hasn't run for %s", since.Round(time.Second))
+		}
+		return nil
+	}
+}
+
+// ConfigCheck fails if no configuration is loaded
+func ConfigCheck(reloader *config.Reloader) Check {
+	return func(ctx context.Context) error {
+		if reloader.Current() == nil {
+			return errors.New("configuration not loaded")
+		}
+		return nil
+	}
+}
@@ -3,19 +3,30 @@ package health
 import (
 	"encoding/json"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
 )
 
 // Handler manages health check endpoints
 type Handler struct {
+	checks       *Registry
 	tokenMonitor *TokenMonitor
+	plexClient   *plex.Client
+	reloader     *config.Reloader
 	startTime    time.Time
 }
 
-// NewHandler creates a new health check handler
-func NewHandler(tokenMonitor *TokenMonitor) *Handler {
+// NewHandler creates a new health check handler running the checks of the registry
+func NewHandler(checks *Registry, tokenMonitor *TokenMonitor, plexClient *plex.Client, reloader *config.Reloader) *Handler {
 	return &Handler{
+		checks:       checks,
 		tokenMonitor: tokenMonitor,
+		plexClient:   plexClient,
+		reloader:     reloader,
 		startTime:    time.Now(),
 	}
 }
@@ -28,14 +39,40 @@ func (h *Handler) HandleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+// HandleLiveness reports that the process is alive. It doesn't depend on Plex or the owner
+// token so an orchestrator doesn't restart a server that can't fix itself by restarting.
+func (h *Handler) HandleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// HandleReadiness runs the checks and returns 503 if one gating readiness fails
+func (h *Handler) HandleReadiness(w http.ResponseWriter, r *http.Request) {
+	results := h.checks.Run(r.Context())
+
+	status := "ready"
+	httpStatus := http.StatusOK
+	if !Ready(results) {
+		status = "not ready"
+		httpStatus = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": results,
+	})
+}
+
 // HandleTokenHealth returns detailed token health status
 func (h *Handler) HandleTokenHealth(w http.ResponseWriter, r *http.Request) {
 	status := h.tokenMonitor.GetStatus()
 
-	// Determine HTTP status code based on token validity
+	// Determine HTTP status code based on token validity and server ownership
 	httpStatus := http.StatusOK
-	if !status.Valid {
-		// Token is invalid - service is degraded
+	if !status.Valid || !status.ServerOwned {
+		// Users can't be authenticated - service is degraded
 		httpStatus = http.StatusServiceUnavailable
 	}
 
@@ -47,26 +84,69 @@ func (h *Handler) HandleTokenHealth(w http.ResponseWriter, r *http.Request) {
 // HandleDetailedHealth returns comprehensive health information
 func (h *Handler) HandleDetailedHealth(w http.ResponseWriter, r *http.Request) {
 	tokenStatus := h.tokenMonitor.GetStatus()
+	breakerStats := h.plexClient.BreakerStats()
+	checks := h.checks.Run(r.Context())
 
 	response := map[string]interface{}{
 		"status":  "healthy",
 		"uptime":  time.Since(h.startTime).String(),
 		"token":   tokenStatus,
+		"plex":    map[string]interface{}{"circuit_breaker": breakerStats},
+		"config":  h.reloader.Stats(),
+		"checks":  checks,
 		"service": "nginx-plex-auth-server",
 	}
 
+	// Plex being unreachable degrades the service but doesn't make it unavailable,
+	// cached decisions are still served
+	if breakerStats.State != plex.BreakerClosed.String() {
+		response["status"] = "degraded"
+		response["message"] = "Plex API is unavailable - only cached decisions are served"
+	}
+
+	if tokenStatus.State == TokenStateServerOffline {
+		response["status"] = "degraded"
+		response["message"] = "Plex reports the server as offline"
+	}
+
 	// If token is invalid, mark overall status as degraded
 	if !tokenStatus.Valid {
 		response["status"] = "degraded"
 		response["message"] = "Owner token is invalid - authentication will fail"
 	}
+	if !tokenStatus.Valid && tokenStatus.LastSuccess.IsZero() && !tokenStatus.PlexReachable {
+		// Started in degraded mode, Plex hasn't been reachable since
+		response["message"] = "Owner token has not been validated yet - Plex API is unavailable"
+	}
+	if tokenStatus.Valid && !tokenStatus.ServerOwned {
+		response["status"] = "degraded"
+		response["message"] = "Owner token does not own the Plex server - authentication will fail"
+	}
 
+	if failing := failingChecks(checks); len(failing) > 0 && response["status"] == "healthy" {
+		response["status"] = "degraded"
+		response["message"] = "Failing checks: " + strings.Join(failing, ", ")
+	}
+
+	// Not ready means requests can't be served, e.g. with an invalid owner token
 	httpStatus := http.StatusOK
-	if !tokenStatus.Valid {
+	if !Ready(checks) {
 		httpStatus = http.StatusServiceUnavailable
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(httpStatus)
 	json.NewEncoder(w).Encode(response)
-}
\ No newline at end of file
+}
+
+// failingChecks returns the sorted names of the failing checks
+func failingChecks(results map[string]CheckResult) []string {
+	var names []string
+	for name, result := range results {
+		if !result.Healthy {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
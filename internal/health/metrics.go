@@ -0,0 +1,59 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
+)
+
+// HandleMetrics exposes health metrics in the Prometheus text format
+func (h *Handler) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	tokenStatus := h.tokenMonitor.GetStatus()
+	breakerStats := h.plexClient.BreakerStats()
+	reloadStats := h.reloader.Stats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeMetric(w, "plex_auth_uptime_seconds", "gauge", "Time since the server started", time.Since(h.startTime).Seconds())
+	writeMetric(w, "plex_auth_owner_token_valid", "gauge", "Whether the owner token is valid (1) or not (0)", boolToFloat(tokenStatus.Valid))
+	writeMetric(w, "plex_auth_owner_server_owned", "gauge", "Whether the owner token owns the Plex server (1) or not (0)", boolToFloat(tokenStatus.ServerOwned))
+	writeMetric(w, "plex_auth_owner_server_online", "gauge", "Whether Plex reports the server as online (1) or not (0)", boolToFloat(tokenStatus.ServerOnline))
+	writeMetric(w, "plex_auth_owner_check_consecutive_failures", "gauge", "Consecutive failed owner token checks", float64(tokenStatus.ConsecutiveFailures))
+	writeMetric(w, "plex_auth_owner_check_latency_seconds", "gauge", "Average latency of the recent owner token checks", tokenStatus.AverageLatency().Seconds())
+	if !tokenStatus.LastSuccess.IsZero() {
+		writeMetric(w, "plex_auth_owner_check_last_success_timestamp_seconds", "gauge", "Time of the last successful owner token check", float64(tokenStatus.LastSuccess.Unix()))
+	}
+	writeMetric(w, "plex_auth_plex_circuit_state", "gauge", "State of the Plex API circuit breaker (0=closed, 1=open, 2=half-open)", breakerStateValue(breakerStats.State))
+	writeMetric(w, "plex_auth_plex_circuit_consecutive_failures", "gauge", "Consecutive failed Plex API requests", float64(breakerStats.ConsecutiveFailures))
+	writeMetric(w, "plex_auth_plex_circuit_opens_total", "counter", "Number of times the Plex API circuit breaker opened", float64(breakerStats.Opens))
+	writeMetric(w, "plex_auth_plex_circuit_rejected_total", "counter", "Plex API requests rejected by the open circuit breaker", float64(breakerStats.Rejected))
+	writeMetric(w, "plex_auth_config_reloads_total", "counter", "Successful configuration reloads", float64(reloadStats.Reloads))
+	writeMetric(w, "plex_auth_config_reload_failures_total", "counter", "Rejected configuration reloads", float64(reloadStats.Failures))
+}
+
+// writeMetric writes a single unlabelled metric with its HELP and TYPE lines
+func writeMetric(w http.ResponseWriter, name, metricType, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+	fmt.Fprintf(w, "%s %g\n", name, value)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func breakerStateValue(state string) float64 {
+	switch state {
+	case plex.BreakerOpen.String():
+		return 1
+	case plex.BreakerHalfOpen.String():
+		return 2
+	default:
+		return 0
+	}
+}
@@ -1,6 +1,8 @@
 package health
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"sync"
 	"time"
@@ -8,6 +10,41 @@ import (
 	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
 )
 
+// TokenState tells why the last owner token check succeeded or failed
+type TokenState string
+
+const (
+	// TokenStateUnknown is the state before the first check
+	TokenStateUnknown TokenState = "unknown"
+	// TokenStateOK means the token is valid and owns the online Plex server
+	TokenStateOK TokenState = "ok"
+	// TokenStateInvalid means Plex rejected the token, e.g. it was revoked
+	TokenStateInvalid TokenState = "token_invalid"
+	// TokenStateServerNotOwned means the token is valid but doesn't own PLEX_SERVER_ID,
+	// e.g. the server was unclaimed or transferred to another account
+	TokenStateServerNotOwned TokenState = "server_not_owned"
+	// TokenStateServerOffline means the server is owned but Plex reports it offline.
+	// Users are still authenticated through plex.tv, so this counts as a successful check.
+	TokenStateServerOffline TokenState = "server_offline"
+	// TokenStatePlexUnreachable means plex.tv couldn't be reached or is rate limiting
+	TokenStatePlexUnreachable TokenState = "plex_unreachable"
+	// TokenStateError means Plex gave an unexpected answer
+	TokenStateError TokenState = "error"
+)
+
+// ErrServerNotOwned is passed to the invalid token callback when the owner token doesn't own the Plex server
+var ErrServerNotOwned = errors.New("owner token does not own the Plex server")
+
+// latencyHistorySize is the number of checks kept in the latency history
+const latencyHistorySize = 20
+
+// CheckSample records the outcome and latency of a single owner token check
+type CheckSample struct {
+	Time      time.Time  `json:"time"`
+	LatencyMs int64      `json:"latency_ms"`
+	State     TokenState `json:"state"`
+}
+
 // TokenStatus represents the health status of the owner token
 type TokenStatus struct {
 	Valid         bool      `json:"valid"`
@@ -15,28 +52,68 @@ type TokenStatus struct {
 	LastError     string    `json:"last_error,omitempty"`
 	OwnerUsername string    `json:"owner_username,omitempty"`
 	OwnerID       int       `json:"owner_id,omitempty"`
+	// PlexReachable is false if the last check couldn't reach the Plex API
+	PlexReachable bool `json:"plex_reachable"`
+	// State tells a revoked token from an unclaimed server or an unreachable Plex API
+	State      TokenState `json:"state"`
+	ServerID   string     `json:"server_id"`
+	ServerName string     `json:"server_name,omitempty"`
+	// ServerOwned and ServerOnline keep their previous value while Plex is unreachable
+	ServerOwned  bool `json:"server_owned"`
+	ServerOnline bool `json:"server_online"`
+	// ConsecutiveFailures counts the failed checks since the last successful one
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success"`
+	// LatencyHistory holds the most recent checks, oldest first
+	LatencyHistory []CheckSample `json:"latency_history"`
+}
+
+// Healthy returns true if the last check succeeded
+func (s TokenStatus) Healthy() bool {
+	return s.State == TokenStateOK || s.State == TokenStateServerOffline
+}
+
+// AverageLatency returns the average latency of the checks in the history
+func (s TokenStatus) AverageLatency() time.Duration {
+	if len(s.LatencyHistory) == 0 {
+		return 0
+	}
+	var total int64
+	for _, sample := range s.LatencyHistory {
+		total += sample.LatencyMs
+	}
+	return time.Duration(total/int64(len(s.LatencyHistory))) * time.Millisecond
 }
 
 // TokenMonitor periodically checks the health of the Plex owner token
+// and that it still owns the Plex server
 type TokenMonitor struct {
 	plexClient     *plex.Client
 	ownerToken     string
+	tokenMu        sync.RWMutex
+	serverID       string
 	checkInterval  time.Duration
+	retryBackoff   time.Duration
 	status         TokenStatus
 	statusMu       sync.RWMutex
 	stopChan       chan struct{}
 	onInvalidToken func(error)
+	onStatus       func(TokenStatus)
+	reloadToken    func() bool
 }
 
-// NewTokenMonitor creates a new token health monitor
-func NewTokenMonitor(client *plex.Client, ownerToken string, checkInterval time.Duration) *TokenMonitor {
+// NewTokenMonitor creates a new token health monitor for the owner of serverID
+func NewTokenMonitor(client *plex.Client, ownerToken, serverID string, checkInterval time.Duration) *TokenMonitor {
 	return &TokenMonitor{
 		plexClient:    client,
 		ownerToken:    ownerToken,
+		serverID:      serverID,
 		checkInterval: checkInterval,
 		status: TokenStatus{
 			Valid:       false,
 			LastChecked: time.Time{},
+			State:       TokenStateUnknown,
+			ServerID:    serverID,
 		},
 		stopChan: make(chan struct{}),
 	}
@@ -47,6 +124,39 @@ func (m *TokenMonitor) SetInvalidTokenCallback(callback func(error)) {
 	m.onInvalidToken = callback
 }
 
+// SetStatusCallback sets a callback function that will be called with the status after every check
+func (m *TokenMonitor) SetStatusCallback(callback func(TokenStatus)) {
+	m.onStatus = callback
+}
+
+// SetTokenReloader sets a function called when the owner token becomes invalid to pick up
+// a rotated token, e.g. from a secret file. It returns true if the owner token was replaced
+// (see SetOwnerToken), in which case the new token is checked right away.
+func (m *TokenMonitor) SetTokenReloader(reloader func() bool) {
+	m.reloadToken = reloader
+}
+
+// SetRetryBackoff makes the monitor recheck sooner while Plex can't validate the token,
+// e.g. during a plex.tv outage. The first retry waits backoff, doubled for each consecutive
+// failure up to the check interval. A zero backoff waits for the check interval.
+func (m *TokenMonitor) SetRetryBackoff(backoff time.Duration) {
+	m.retryBackoff = backoff
+}
+
+// SetOwnerToken replaces the owner token checked by the monitor
+func (m *TokenMonitor) SetOwnerToken(token string) {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	m.ownerToken = token
+}
+
+// token returns the owner token checked by the monitor
+func (m *TokenMonitor) token() string {
+	m.tokenMu.RLock()
+	defer m.tokenMu.RUnlock()
+	return m.ownerToken
+}
+
 // Start begins the periodic token health checks
 func (m *TokenMonitor) Start() {
 	log.Printf("Starting token health monitor (check interval: %v)", m.checkInterval)
@@ -55,14 +165,15 @@ func (m *TokenMonitor) Start() {
 	m.check()
 
 	// Start periodic checks
-	ticker := time.NewTicker(m.checkInterval)
+	timer := time.NewTimer(m.nextDelay())
 	go func() {
 		for {
 			select {
-			case <-ticker.C:
+			case <-timer.C:
 				m.check()
+				timer.Reset(m.nextDelay())
 			case <-m.stopChan:
-				ticker.Stop()
+				timer.Stop()
 				log.Println("Token health monitor stopped")
 				return
 			}
@@ -70,64 +181,180 @@ func (m *TokenMonitor) Start() {
 	}()
 }
 
+// nextDelay returns the delay before the next check, backing off from the retry backoff
+// to the check interval while Plex couldn't validate the token
+func (m *TokenMonitor) nextDelay() time.Duration {
+	status := m.GetStatus()
+	if m.retryBackoff <= 0 || (status.State != TokenStatePlexUnreachable && status.State != TokenStateError) {
+		return m.checkInterval
+	}
+
+	delay := m.retryBackoff
+	for i := 1; i < status.ConsecutiveFailures && delay < m.checkInterval; i++ {
+		delay *= 2
+	}
+	delay = min(delay, m.checkInterval)
+	log.Printf("Retrying owner token validation in %v", delay)
+	return delay
+}
+
 // Stop stops the periodic health checks
 func (m *TokenMonitor) Stop() {
 	close(m.stopChan)
 }
 
-// check validates the owner token and updates the status
+// Check validates the owner token now instead of waiting for the next periodic check
+func (m *TokenMonitor) Check() {
+	m.check()
+}
+
+// checkResult is the outcome of a single owner token check
+type checkResult struct {
+	state  TokenState
+	user   *plex.UserInfo
+	server *plex.Resource
+	err    error
+}
+
+// check validates the owner token and its server ownership and updates the status
 func (m *TokenMonitor) check() {
-	m.statusMu.Lock()
-	defer m.statusMu.Unlock()
+	defer m.reportStatus()
 
+	start := time.Now()
+	result := m.verify()
+	latency := time.Since(start)
+
+	m.statusMu.Lock()
+	previous := m.status.State
 	m.status.LastChecked = time.Now()
+	m.status.State = result.state
+	m.status.PlexReachable = result.state != TokenStatePlexUnreachable
 
-	// Validate the token
-	valid, err := m.plexClient.ValidateToken(m.ownerToken)
-	if err != nil {
+	switch result.state {
+	case TokenStatePlexUnreachable:
+		// Plex couldn't tell us, keep the previous validity and server state
+		m.status.LastError = "Plex API unavailable: " + result.err.Error()
+		log.Printf("⚠️  Token health check skipped, Plex API unavailable: %v", result.err)
+
+	case TokenStateError:
+		// The token may still be valid if only listing the servers failed
+		m.status.Valid = result.user != nil
+		m.status.LastError = result.err.Error()
+		log.Printf("⚠️  Token health check failed: %v", result.err)
+
+	case TokenStateInvalid:
 		m.status.Valid = false
-		m.status.LastError = err.Error()
-		log.Printf("⚠️  Token health check failed: %v", err)
+		m.status.ServerOwned = false
+		m.status.ServerOnline = false
+		m.status.LastError = "Token is invalid or expired"
+		log.Printf("❌ CRITICAL: Owner token is INVALID. Please update PLEX_TOKEN or the PLEX_TOKEN_FILE secret!")
+
+	case TokenStateServerNotOwned:
+		m.status.Valid = true
+		m.status.ServerOwned = false
+		m.status.ServerOnline = result.server != nil && result.server.Presence
+		m.status.LastError = fmt.Sprintf("Owner token does not own Plex server %s", m.serverID)
+		log.Printf("❌ CRITICAL: Owner token %s does not own Plex server %s, was it unclaimed or transferred?", result.user.Username, m.serverID)
+
+	case TokenStateServerOffline, TokenStateOK:
+		m.status.Valid = true
+		m.status.ServerOwned = true
+		m.status.ServerOnline = result.state == TokenStateOK
+		m.status.LastError = ""
+	}
+
+	if result.user != nil {
+		m.status.OwnerUsername = result.user.Username
+		m.status.OwnerID = result.user.ID
+	}
+	if result.server != nil {
+		m.status.ServerName = result.server.Name
+	}
+
+	if m.status.Healthy() {
+		m.status.ConsecutiveFailures = 0
+		m.status.LastSuccess = m.status.LastChecked
+	} else {
+		m.status.ConsecutiveFailures++
+	}
+
+	m.status.LatencyHistory = append(m.status.LatencyHistory, CheckSample{
+		Time:      m.status.LastChecked,
+		LatencyMs: latency.Milliseconds(),
+		State:     result.state,
+	})
+	if excess := len(m.status.LatencyHistory) - latencyHistorySize; excess > 0 {
+		m.status.LatencyHistory = m.status.LatencyHistory[excess:]
+	}
 
-		// Call the callback if token validation failed
-		if m.onInvalidToken != nil {
-			m.onInvalidToken(err)
+	// Log only if the state changed
+	if result.state != previous {
+		switch result.state {
+		case TokenStateOK:
+			log.Printf("✓ Token health check passed (Owner: %s, ID: %d, server: %s)", m.status.OwnerUsername, m.status.OwnerID, m.status.ServerName)
+		case TokenStateServerOffline:
+			log.Printf("⚠️  Token health check passed but Plex reports server %s as offline", m.serverID)
 		}
-		return
 	}
 
-	if !valid {
-		m.status.Valid = false
-		m.status.LastError = "Token is invalid or expired"
-		log.Printf("❌ CRITICAL: Owner token is INVALID. Please update PLEX_TOKEN environment variable!")
+	m.statusMu.Unlock()
 
-		// Call the callback if token is invalid
-		if m.onInvalidToken != nil {
+	// Call the callback if the token can't be used to authenticate users, without
+	// holding the lock as it may read the status or call remote services
+	if m.onInvalidToken != nil {
+		switch result.state {
+		case TokenStateInvalid:
 			m.onInvalidToken(nil)
+		case TokenStateServerNotOwned:
+			m.onInvalidToken(ErrServerNotOwned)
+		case TokenStatePlexUnreachable, TokenStateError:
+			m.onInvalidToken(result.err)
 		}
-		return
 	}
+}
 
-	// Token is valid - get owner info
-	userInfo, err := m.plexClient.GetUserInfo(m.ownerToken)
+// verify runs the Plex API calls of a check without holding the status lock
+func (m *TokenMonitor) verify() checkResult {
+	// Validate the token and fetch the owner info in a single lookup
+	identity, err := m.plexClient.Identify(m.token())
+	if err == nil && !identity.Valid && m.reloadToken != nil && m.reloadToken() {
+		identity, err = m.plexClient.Identify(m.token())
+	}
 	if err != nil {
-		// Token is valid but couldn't get user info
-		m.status.Valid = true
-		m.status.LastError = "Could not fetch owner info: " + err.Error()
-		log.Printf("⚠️  Token is valid but could not fetch owner info: %v", err)
-		return
+		return checkResult{state: errorState(err), err: err}
+	}
+	if !identity.Valid {
+		return checkResult{state: TokenStateInvalid}
 	}
 
-	// Update status with success
-	previousValid := m.status.Valid
-	m.status.Valid = true
-	m.status.LastError = ""
-	m.status.OwnerUsername = userInfo.Username
-	m.status.OwnerID = userInfo.ID
+	resources, err := m.plexClient.GetResources(m.token())
+	if err != nil {
+		return checkResult{state: errorState(err), user: identity.User, err: fmt.Errorf("failed to list Plex servers: %w", err)}
+	}
 
-	// Log only if status changed or this is the first check
-	if !previousValid || m.status.OwnerID == 0 {
-		log.Printf("✓ Token health check passed (Owner: %s, ID: %d)", userInfo.Username, userInfo.ID)
+	server := plex.FindServer(resources, m.serverID)
+	switch {
+	case server == nil || !server.Owned:
+		return checkResult{state: TokenStateServerNotOwned, user: identity.User, server: server}
+	case !server.Presence:
+		return checkResult{state: TokenStateServerOffline, user: identity.User, server: server}
+	default:
+		return checkResult{state: TokenStateOK, user: identity.User, server: server}
+	}
+}
+
+// errorState returns the state of a check that failed with err
+func errorState(err error) TokenState {
+	if errors.Is(err, plex.ErrUpstreamUnavailable) || errors.Is(err, plex.ErrRateLimited) {
+		return TokenStatePlexUnreachable
+	}
+	return TokenStateError
+}
+
+// reportStatus calls the status callback with the current status
+func (m *TokenMonitor) reportStatus() {
+	if m.onStatus != nil {
+		m.onStatus(m.GetStatus())
 	}
 }
 
@@ -137,13 +364,10 @@ func (m *TokenMonitor) GetStatus() TokenStatus {
 	defer m.statusMu.RUnlock()
 
 	// Return a copy to prevent race conditions
-	return TokenStatus{
-		Valid:         m.status.Valid,
-		LastChecked:   m.status.LastChecked,
-		LastError:     m.status.LastError,
-		OwnerUsername: m.status.OwnerUsername,
-		OwnerID:       m.status.OwnerID,
-	}
+	status := m.status
+	status.LatencyHistory = make([]CheckSample, len(m.status.LatencyHistory))
+	copy(status.LatencyHistory, m.status.LatencyHistory)
+	return status
 }
 
 // IsHealthy returns true if the token is currently valid
@@ -151,4 +375,4 @@ func (m *TokenMonitor) IsHealthy() bool {
 	m.statusMu.RLock()
 	defer m.statusMu.RUnlock()
 	return m.status.Valid
-}
\ No newline at end of file
+}
@@ -0,0 +1,180 @@
+package health
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex/plextest"
+)
+
+const testServerID = "test-server"
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestMonitor starts a fake Plex with an owner of the test server and returns
+// a monitor of the owner token
+func newTestMonitor(t *testing.T) (*TokenMonitor, *plextest.Fake, *httptest.Server, string) {
+	t.Helper()
+
+	fake := plextest.New()
+	token := fake.AddUser(plextest.User{ID: 1, Username: "owner"})
+	fake.AddServer(plextest.Server{MachineID: testServerID, Name: "Test", OwnerID: 1, Online: true})
+	server := plextest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client := plex.NewClientWithOptions(server.URL, token, "test", plex.Options{
+		RequestTimeout: 2 * time.Second,
+		Breaker:        plex.DefaultBreakerOptions(),
+	})
+	return NewTokenMonitor(client, token, testServerID, time.Minute), fake, server, token
+}
+
+func TestTokenMonitorStates(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(fake *plextest.Fake, token string)
+		state   TokenState
+		valid   bool
+		healthy bool
+	}{
+		{
+			name:    "valid token",
+			prepare: func(fake *plextest.Fake, token string) {},
+			state:   TokenStateOK,
+			valid:   true,
+			healthy: true,
+		},
+		{
+			name:    "revoked token",
+			prepare: func(fake *plextest.Fake, token string) { fake.RevokeToken(token) },
+			state:   TokenStateInvalid,
+		},
+		{
+			name:    "server unclaimed",
+			prepare: func(fake *plextest.Fake, token string) { fake.RemoveServer(testServerID) },
+			state:   TokenStateServerNotOwned,
+			valid:   true,
+		},
+		{
+			name:    "server offline",
+			prepare: func(fake *plextest.Fake, token string) { fake.SetServerOnline(testServerID, false) },
+			state:   TokenStateServerOffline,
+			valid:   true,
+			healthy: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			monitor, fake, _, token := newTestMonitor(t)
+			tt.prepare(fake, token)
+
+			monitor.Check()
+
+			status := monitor.GetStatus()
+			if status.State != tt.state {
+				t.Fatalf("state = %q, want %q", status.State, tt.state)
+			}
+			if status.Valid != tt.valid {
+				t.Errorf("valid = %v, want %v", status.Valid, tt.valid)
+			}
+			if status.Healthy() != tt.healthy {
+				t.Errorf("healthy = %v, want %v", status.Healthy(), tt.healthy)
+			}
+		})
+	}
+}
+
+func TestTokenMonitorPlexUnreachable(t *testing.T) {
+	monitor, _, server, _ := newTestMonitor(t)
+	monitor.Check()
+
+	server.Close()
+	monitor.Check()
+
+	status := monitor.GetStatus()
+	if status.State != TokenStatePlexUnreachable {
+		t.Fatalf("state = %q, want %q", status.State, TokenStatePlexUnreachable)
+	}
+	if !status.Valid || !status.ServerOwned {
+		t.Error("the previous validity wasn't kept while Plex is unreachable")
+	}
+	if status.PlexReachable {
+		t.Error("Plex is reported reachable")
+	}
+	if status.ConsecutiveFailures != 1 {
+		t.Errorf("consecutive failures = %d, want 1", status.ConsecutiveFailures)
+	}
+}
+
+func TestTokenMonitorInvalidTokenCallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(fake *plextest.Fake, token string)
+		err     error
+	}{
+		{name: "revoked token", prepare: func(fake *plextest.Fake, token string) { fake.RevokeToken(token) }},
+		{name: "server unclaimed", prepare: func(fake *plextest.Fake, token string) { fake.RemoveServer(testServerID) }, err: ErrServerNotOwned},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			monitor, fake, _, token := newTestMonitor(t)
+			tt.prepare(fake, token)
+
+			calls := 0
+			var state TokenState
+			monitor.SetInvalidTokenCallback(func(err error) {
+				calls++
+				if !errors.Is(err, tt.err) {
+					t.Errorf("callback error = %v, want %v", err, tt.err)
+				}
+				// The status lock is released before the callback
+				state = monitor.GetStatus().State
+			})
+
+			done := make(chan struct{})
+			go func() {
+				monitor.Check()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the check is blocked by the callback reading the status")
+			}
+
+			if calls != 1 {
+				t.Fatalf("callback called %d time(s), want 1", calls)
+			}
+			if state == TokenStateOK || state == TokenStateUnknown {
+				t.Errorf("callback saw state %q", state)
+			}
+		})
+	}
+}
+
+func TestTokenMonitorReloadsRotatedToken(t *testing.T) {
+	monitor, fake, _, token := newTestMonitor(t)
+	rotated := fake.IssueToken(1)
+	fake.RevokeToken(token)
+
+	monitor.SetTokenReloader(func() bool {
+		monitor.SetOwnerToken(rotated)
+		return true
+	})
+	monitor.Check()
+
+	if state := monitor.GetStatus().State; state != TokenStateOK {
+		t.Fatalf("state = %q, want %q", state, TokenStateOK)
+	}
+}
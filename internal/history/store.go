@@ -0,0 +1,421 @@
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/audit"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/auth"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/policy"
+)
+
+// pendingEvents is the number of events buffered for the background writer.
+// Events recorded while the buffer is full are dropped rather than slowing down /auth.
+const pendingEvents = 4096
+
+// maxHostsPerUser is the number of hosts remembered per user, the least recently
+// seen one is forgotten to make room for a new host
+const maxHostsPerUser = 50
+
+// fileVersion is the version of the history file format
+const fileVersion = 1
+
+// Activity is the last successful /auth of a user on a host
+type Activity struct {
+	LastSeen time.Time `json:"last_seen"`
+	ClientIP string    `json:"client_ip"`
+}
+
+// Login is a login or logout of a user
+type Login struct {
+	Time     time.Time       `json:"time"`
+	Type     audit.EventType `json:"type"`
+	ClientIP string          `json:"client_ip"`
+}
+
+// User is the activity history of a Plex user
+type User struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	// LastSeen is the time of the last successful /auth on any host
+	LastSeen  time.Time `json:"last_seen"`
+	LastIP    string    `json:"last_ip,omitempty"`
+	LastLogin time.Time `json:"last_login"`
+	// Hosts holds the last successful /auth per host
+	Hosts map[string]Activity `json:"hosts"`
+	// Logins are the logins and logouts, most recent first
+	Logins []Login `json:"logins"`
+}
+
+// Stats describes the state of the store for the admin API
+type Stats struct {
+	File      string    `json:"file,omitempty"`
+	Users     int       `json:"users"`
+	Dropped   int64     `json:"dropped_events"`
+	LastFlush time.Time `json:"last_flush"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// historyFile is the content of the history file
+type historyFile struct {
+	Version int     `json:"version"`
+	Users   []*User `json:"users"`
+}
+
+// Store keeps the last-seen time and login history of each user, persisted to a
+// JSON file by a background writer. Without a file the history is kept in memory only.
+type Store struct {
+	path          string
+	retention     time.Duration
+	maxLogins     int
+	flushInterval time.Duration
+
+	mu        sync.RWMutex
+	users     map[int]*User
+	dirty     bool
+	lastFlush time.Time
+	lastError string
+
+	pending         chan audit.Event
+	dropped         atomic.Int64
+	droppedReported int64
+	stopChan        chan struct{}
+	done            chan struct{}
+}
+
+// NewStore creates a store, loading the history file if it exists
+func NewStore(path string, retention time.Duration, maxLogins int, flushInterval time.Duration) (*Store, error) {
+	s := &Store{
+		path:          path,
+		retention:     retention,
+		maxLogins:     maxLogins,
+		flushInterval: flushInterval,
+		users:         make(map[int]*User),
+		pending:       make(chan audit.Event, pendingEvents),
+		stopChan:      make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the history file, a missing file starts an empty history
+func (s *Store) load() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read history file %s: %w", s.path, err)
+	}
+
+	var file historyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse history file %s: %w", s.path, err)
+	}
+	if file.Version != fileVersion {
+		return fmt.Errorf("history file %s has unsupported version %d", s.path, file.Version)
+	}
+
+	for _, user := range file.Users {
+		if user.Hosts == nil {
+			user.Hosts = make(map[string]Activity)
+		}
+		s.users[user.UserID] = user
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.lastFlush = info.ModTime()
+	}
+	s.prune(time.Now())
+	return nil
+}
+
+// Observe queues the logins, logouts and allowed /auth decisions of the audit log.
+// It never blocks: events are dropped if the background writer falls behind.
+func (s *Store) Observe(event audit.Event) {
+	if event.UserID == 0 {
+		return
+	}
+	switch {
+	case event.Type == audit.EventAuth && event.Decision == auth.DecisionAllowed:
+	case (event.Type == audit.EventLogin || event.Type == audit.EventLogout) && event.Decision == auth.DecisionSuccess:
+	default:
+		return
+	}
+
+	select {
+	case s.pending <- event:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Start begins applying the queued events and writing the history file
+func (s *Store) Start() {
+	if s.path != "" {
+		log.Printf("Starting user history store (file: %s, flush interval: %v)", s.path, s.flushInterval)
+	}
+
+	ticker := time.NewTicker(s.flushInterval)
+	go func() {
+		defer close(s.done)
+		for {
+			select {
+			case event := <-s.pending:
+				s.applyBatch(event)
+			case <-ticker.C:
+				s.Flush()
+			case <-s.stopChan:
+				ticker.Stop()
+				s.drain()
+				s.Flush()
+				return
+			}
+		}
+	}()
+}
+
+// Stop applies the queued events, writes the history file and stops the background writer
+func (s *Store) Stop() {
+	close(s.stopChan)
+	<-s.done
+}
+
+// applyBatch applies an event and every other event already queued under a single lock
+func (s *Store) applyBatch(first audit.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.apply(first)
+	for {
+		select {
+		case event := <-s.pending:
+			s.apply(event)
+		default:
+			return
+		}
+	}
+}
+
+// drain applies the queued events
+func (s *Store) drain() {
+	select {
+	case event := <-s.pending:
+		s.applyBatch(event)
+	default:
+	}
+}
+
+// apply records an event, the caller must hold the lock
+func (s *Store) apply(event audit.Event) {
+	user, exists := s.users[event.UserID]
+	if !exists {
+		user = &User{UserID: event.UserID, Hosts: make(map[string]Activity)}
+		s.users[event.UserID] = user
+	}
+	if event.Username != "" {
+		user.Username = event.Username
+	}
+
+	switch event.Type {
+	case audit.EventAuth:
+		if event.Time.After(user.LastSeen) {
+			user.LastSeen = event.Time
+			user.LastIP = event.ClientIP
+		}
+		host := policy.NormalizeHost(event.Host)
+		activity, known := user.Hosts[host]
+		if !known && len(user.Hosts) >= maxHostsPerUser {
+			forgetOldestHost(user)
+		}
+		if event.Time.After(activity.LastSeen) {
+			user.Hosts[host] = Activity{LastSeen: event.Time, ClientIP: event.ClientIP}
+		}
+	default:
+		if event.Type == audit.EventLogin && event.Time.After(user.LastLogin) {
+			user.LastLogin = event.Time
+		}
+		user.Logins = append([]Login{{Time: event.Time, Type: event.Type, ClientIP: event.ClientIP}}, user.Logins...)
+		if s.maxLogins > 0 && len(user.Logins) > s.maxLogins {
+			user.Logins = user.Logins[:s.maxLogins]
+		}
+	}
+	s.dirty = true
+}
+
+// forgetOldestHost drops the least recently seen host of a user
+func forgetOldestHost(user *User) {
+	var oldest string
+	var oldestSeen time.Time
+	first := true
+	for host, activity := range user.Hosts {
+		if first || activity.LastSeen.Before(oldestSeen) {
+			oldest, oldestSeen, first = host, activity.LastSeen, false
+		}
+	}
+	delete(user.Hosts, oldest)
+}
+
+// prune drops the activity older than the retention period, the caller must hold the lock
+func (s *Store) prune(now time.Time) {
+	if s.retention <= 0 {
+		return
+	}
+	cutoff := now.Add(-s.retention)
+
+	for id, user := range s.users {
+		for host, activity := range user.Hosts {
+			if activity.LastSeen.Before(cutoff) {
+				delete(user.Hosts, host)
+				s.dirty = true
+			}
+		}
+		kept := len(user.Logins)
+		for kept > 0 && user.Logins[kept-1].Time.Before(cutoff) {
+			kept--
+		}
+		if kept < len(user.Logins) {
+			user.Logins = user.Logins[:kept]
+			s.dirty = true
+		}
+		if user.LastSeen.Before(cutoff) && user.LastLogin.Before(cutoff) && len(user.Logins) == 0 {
+			delete(s.users, id)
+			s.dirty = true
+		}
+	}
+}
+
+// Flush drops expired activity and writes the history file if it changed
+func (s *Store) Flush() {
+	s.mu.Lock()
+	if dropped := s.dropped.Load(); dropped > s.droppedReported {
+		log.Printf("⚠️  User history fell behind, %d event(s) dropped", dropped-s.droppedReported)
+		s.droppedReported = dropped
+	}
+	s.prune(time.Now())
+	if !s.dirty || s.path == "" {
+		s.dirty = false
+		s.mu.Unlock()
+		return
+	}
+	file := historyFile{Version: fileVersion, Users: make([]*User, 0, len(s.users))}
+	for _, user := range s.users {
+		file.Users = append(file.Users, user)
+	}
+	data, err := json.Marshal(file)
+	s.dirty = false
+	s.mu.Unlock()
+
+	if err == nil {
+		err = writeFile(s.path, data)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		log.Printf("⚠️  Failed to write user history: %v", err)
+		s.lastError = err.Error()
+		// Retry on the next flush
+		s.dirty = true
+		return
+	}
+	s.lastFlush = time.Now()
+	s.lastError = ""
+}
+
+// writeFile replaces path atomically so a crash never leaves a truncated file
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Users returns a copy of the history of every user, most recently seen first
+func (s *Store) Users() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, copyUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return lastActivity(users[i]).After(lastActivity(users[j]))
+	})
+	return users
+}
+
+// User returns a copy of the history of a user
+func (s *Store) User(userID int) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, exists := s.users[userID]
+	if !exists {
+		return User{}, false
+	}
+	return copyUser(user), true
+}
+
+// Stats returns the state of the store
+func (s *Store) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return Stats{
+		File:      s.path,
+		Users:     len(s.users),
+		Dropped:   s.dropped.Load(),
+		LastFlush: s.lastFlush,
+		LastError: s.lastError,
+	}
+}
+
+// copyUser returns a copy of user that doesn't share its host map or logins
+func copyUser(user *User) User {
+	copied := *user
+	copied.Hosts = make(map[string]Activity, len(user.Hosts))
+	for host, activity := range user.Hosts {
+		copied.Hosts[host] = activity
+	}
+	copied.Logins = make([]Login, len(user.Logins))
+	copy(copied.Logins, user.Logins)
+	return copied
+}
+
+// lastActivity returns the time of the last successful /auth or login of a user
+func lastActivity(user User) time.Time {
+	if user.LastLogin.After(user.LastSeen) {
+		return user.LastLogin
+	}
+	return user.LastSeen
+}
@@ -0,0 +1,116 @@
+package notify
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/health"
+)
+
+// TokenAlerter turns the statuses reported by the token monitor into events
+// on state transitions: the owner token becoming invalid or valid again, and
+// Plex being unreachable for several consecutive checks or reachable again.
+type TokenAlerter struct {
+	dispatcher        *Dispatcher
+	unreachableChecks int
+	mu                sync.Mutex
+	// tokenValid is nil until Plex gave an answer about the token
+	tokenValid  *bool
+	unreachable int
+}
+
+// NewTokenAlerter creates an alerter alerting after unreachableChecks consecutive unreachable checks
+func NewTokenAlerter(dispatcher *Dispatcher, unreachableChecks int) *TokenAlerter {
+	return &TokenAlerter{
+		dispatcher:        dispatcher,
+		unreachableChecks: unreachableChecks,
+	}
+}
+
+// Observe processes the status after a token check, see TokenMonitor.SetStatusCallback
+func (a *TokenAlerter) Observe(status health.TokenStatus) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	details := map[string]string{}
+	if status.OwnerUsername != "" {
+		details["owner"] = status.OwnerUsername
+	}
+	if status.LastError != "" {
+		details["error"] = status.LastError
+	}
+
+	if !status.PlexReachable {
+		a.unreachable++
+		// Keep dispatching while unreachable, the dispatcher handles re-alerts
+		if a.unreachable >= a.unreachableChecks {
+			a.dispatcher.Dispatch(Event{
+				Type:     EventPlexUnreachable,
+				Severity: SeverityWarning,
+				Title:    "Plex API unreachable",
+				Message:  fmt.Sprintf("The Plex API has been unreachable for %d consecutive owner token checks. Only cached decisions are served.", a.unreachable),
+				Details:  withDetail(details, "consecutive_checks", strconv.Itoa(a.unreachable)),
+			})
+		}
+		// The token state is unknown while Plex is unreachable
+		return
+	}
+
+	if a.unreachable > 0 {
+		a.dispatcher.Dispatch(Event{
+			Type:     EventPlexReachable,
+			Severity: SeverityResolved,
+			Title:    "Plex API reachable again",
+			Message:  "The Plex API is reachable again.",
+			Details:  details,
+			Resolves: EventPlexUnreachable,
+		})
+		a.unreachable = 0
+	}
+
+	// Plex gave an unexpected answer, the token state is unknown
+	if status.State == health.TokenStateError {
+		return
+	}
+
+	// Only a rejected token or one not owning the server is invalid, not e.g. an offline server
+	wasValid := a.tokenValid
+	valid := status.State != health.TokenStateInvalid && status.State != health.TokenStateServerNotOwned
+	a.tokenValid = &valid
+
+	switch {
+	case !valid:
+		message := "The owner token was rejected by Plex, users can't be authenticated. Rotate the token or update PLEX_TOKEN."
+		if status.State == health.TokenStateServerNotOwned {
+			message = "The owner token doesn't own the Plex server, was it unclaimed or transferred? Users can't be authenticated. Rotate the token or update PLEX_TOKEN."
+		}
+		// Also dispatched while the token stays invalid, the dispatcher handles re-alerts
+		a.dispatcher.Dispatch(Event{
+			Type:     EventTokenInvalid,
+			Severity: SeverityCritical,
+			Title:    "Plex owner token is invalid",
+			Message:  message,
+			Details:  withDetail(details, "state", string(status.State)),
+		})
+	case wasValid != nil && !*wasValid:
+		a.dispatcher.Dispatch(Event{
+			Type:     EventTokenValid,
+			Severity: SeverityResolved,
+			Title:    "Plex owner token is valid again",
+			Message:  "The owner token is valid again, users can be authenticated.",
+			Details:  details,
+			Resolves: EventTokenInvalid,
+		})
+	}
+}
+
+// withDetail returns a copy of details with an additional entry
+func withDetail(details map[string]string, key, value string) map[string]string {
+	copied := make(map[string]string, len(details)+1)
+	for k, v := range details {
+		copied[k] = v
+	}
+	copied[key] = value
+	return copied
+}
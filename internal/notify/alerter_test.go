@@ -0,0 +1,81 @@
+package notify
+
+import (
+	"testing"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/health"
+)
+
+// status returns the status reported by the token monitor after a check ending in state
+func status(state health.TokenState) health.TokenStatus {
+	return health.TokenStatus{
+		State:         state,
+		Valid:         state == health.TokenStateOK || state == health.TokenStateServerOffline || state == health.TokenStateServerNotOwned,
+		PlexReachable: state != health.TokenStatePlexUnreachable,
+		OwnerUsername: "owner",
+	}
+}
+
+func TestTokenAlerter(t *testing.T) {
+	tests := []struct {
+		name   string
+		states []health.TokenState
+		want   []EventType
+	}{
+		{
+			name:   "token rejected then valid again",
+			states: []health.TokenState{health.TokenStateOK, health.TokenStateInvalid, health.TokenStateInvalid, health.TokenStateOK},
+			want:   []EventType{EventTokenInvalid, EventTokenValid},
+		},
+		{
+			name:   "server not owned",
+			states: []health.TokenState{health.TokenStateOK, health.TokenStateServerNotOwned},
+			want:   []EventType{EventTokenInvalid},
+		},
+		{
+			name:   "offline server isn't an invalid token",
+			states: []health.TokenState{health.TokenStateOK, health.TokenStateServerOffline, health.TokenStateOK},
+			want:   []EventType{},
+		},
+		{
+			name:   "unexpected answer isn't an invalid token",
+			states: []health.TokenState{health.TokenStateOK, health.TokenStateError, health.TokenStateOK},
+			want:   []EventType{},
+		},
+		{
+			name:   "unexpected answer keeps an invalid token invalid",
+			states: []health.TokenState{health.TokenStateInvalid, health.TokenStateError, health.TokenStateOK},
+			want:   []EventType{EventTokenInvalid, EventTokenValid},
+		},
+		{
+			name: "Plex unreachable for several checks",
+			states: []health.TokenState{
+				health.TokenStateOK, health.TokenStatePlexUnreachable, health.TokenStatePlexUnreachable,
+				health.TokenStatePlexUnreachable, health.TokenStateOK,
+			},
+			want: []EventType{EventPlexUnreachable, EventPlexReachable},
+		},
+		{
+			name:   "Plex briefly unreachable",
+			states: []health.TokenState{health.TokenStateOK, health.TokenStatePlexUnreachable, health.TokenStateOK},
+			want:   []EventType{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier := &recorder{}
+			dispatcher := NewDispatcher([]Notifier{notifier}, 0)
+			alerter := NewTokenAlerter(dispatcher, 2)
+
+			for _, state := range tt.states {
+				alerter.Observe(status(state))
+				dispatcher.Wait()
+			}
+
+			if got := notifier.types(); !equalTypes(got, tt.want) {
+				t.Errorf("sent %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+)
+
+// New creates the notifiers of the configured channels
+func New(channels []config.NotificationChannel) ([]Notifier, error) {
+	notifiers := make([]Notifier, 0, len(channels))
+	for _, channel := range channels {
+		switch channel.Type {
+		case "webhook":
+			notifiers = append(notifiers, &Webhook{URL: channel.URL})
+		case "discord":
+			notifiers = append(notifiers, &Discord{URL: channel.URL})
+		case "slack":
+			notifiers = append(notifiers, &Slack{URL: channel.URL})
+		case "ntfy":
+			notifiers = append(notifiers, &Ntfy{URL: channel.URL, Token: channel.Token})
+		case "gotify":
+			notifiers = append(notifiers, &Gotify{URL: channel.URL, Token: channel.Token})
+		default:
+			return nil, fmt.Errorf("unknown notification channel type %q", channel.Type)
+		}
+	}
+	return notifiers, nil
+}
+
+// Webhook posts the event as JSON to a URL.
+// Like the other notifiers, it sends with http.DefaultClient if Client is nil.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+// Name implements Notifier
+func (n *Webhook) Name() string { return "webhook" }
+
+// Notify implements Notifier
+func (n *Webhook) Notify(ctx context.Context, event Event) error {
+	return postJSON(ctx, n.Client, n.URL, event, nil)
+}
+
+// Discord posts the event as an embed to a Discord webhook
+type Discord struct {
+	URL    string
+	Client *http.Client
+}
+
+// Name implements Notifier
+func (n *Discord) Name() string { return "discord" }
+
+// Notify implements Notifier
+func (n *Discord) Notify(ctx context.Context, event Event) error {
+	payload := map[string]interface{}{
+		"username": "Plex Auth Server",
+		"embeds": []map[string]interface{}{{
+			"title":       event.Title,
+			"description": event.Message,
+			"color":       discordColor(event.Severity),
+			"timestamp":   event.Time.UTC().Format("2006-01-02T15:04:05Z"),
+			"fields":      discordFields(event.Details),
+		}},
+	}
+	return postJSON(ctx, n.Client, n.URL, payload, nil)
+}
+
+// Slack posts the event to a Slack incoming webhook
+type Slack struct {
+	URL    string
+	Client *http.Client
+}
+
+// Name implements Notifier
+func (n *Slack) Name() string { return "slack" }
+
+// Notify implements Notifier
+func (n *Slack) Notify(ctx context.Context, event Event) error {
+	text := fmt.Sprintf("%s *%s*\n%s", slackEmoji(event.Severity), event.Title, event.Message)
+	for _, key := range sortedKeys(event.Details) {
+		text += fmt.Sprintf("\n• %s: %s", key, event.Details[key])
+	}
+	return postJSON(ctx, n.Client, n.URL, map[string]string{"text": text}, nil)
+}
+
+// Ntfy publishes the event to an ntfy topic URL, e.g. https://ntfy.sh/my-topic
+type Ntfy struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+// Name implements Notifier
+func (n *Ntfy) Name() string { return "ntfy" }
+
+// Notify implements Notifier
+func (n *Ntfy) Notify(ctx context.Context, event Event) error {
+	headers := map[string]string{
+		"Title":    event.Title,
+		"Priority": ntfyPriority(event.Severity),
+		"Tags":     ntfyTags(event.Severity),
+	}
+	if n.Token != "" {
+		headers["Authorization"] = "Bearer " + n.Token
+	}
+	return post(ctx, n.Client, n.URL, "text/plain; charset=utf-8", []byte(event.Message), headers)
+}
+
+// Gotify sends the event as a message to a Gotify server
+type Gotify struct {
+	// URL is the server URL, e.g. https://gotify.example.com
+	URL string
+	// Token is an application token
+	Token  string
+	Client *http.Client
+}
+
+// Name implements Notifier
+func (n *Gotify) Name() string { return "gotify" }
+
+// Notify implements Notifier
+func (n *Gotify) Notify(ctx context.Context, event Event) error {
+	payload := map[string]interface{}{
+		"title":    event.Title,
+		"message":  event.Message,
+		"priority": gotifyPriority(event.Severity),
+	}
+	headers := map[string]string{"X-Gotify-Key": n.Token}
+	return postJSON(ctx, n.Client, strings.TrimRight(n.URL, "/")+"/message", payload, headers)
+}
+
+// postJSON posts a value encoded as JSON
+func postJSON(ctx context.Context, client *http.Client, target string, value interface{}, headers map[string]string) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+	return post(ctx, client, target, "application/json", body, headers)
+}
+
+// post sends a notification and fails on non-2xx responses.
+// The URL isn't included in errors since it often contains a secret.
+func post(ctx context.Context, client *http.Client, target, contentType string, body []byte, headers map[string]string) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", errorWithoutURL(err))
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", errorWithoutURL(err))
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// errorWithoutURL strips the URL from the errors of net/http
+func errorWithoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+func discordColor(severity Severity) int {
+	switch severity {
+	case SeverityCritical:
+		return 0xf44336
+	case SeverityWarning:
+		return 0xe5a00d
+	default:
+		return 0x4caf50
+	}
+}
+
+func discordFields(details map[string]string) []map[string]interface{} {
+	fields := []map[string]interface{}{}
+	for _, key := range sortedKeys(details) {
+		fields = append(fields, map[string]interface{}{"name": key, "value": details[key], "inline": true})
+	}
+	return fields
+}
+
+func slackEmoji(severity Severity) string {
+	switch severity {
+	case SeverityCritical:
+		return ":rotating_light:"
+	case SeverityWarning:
+		return ":warning:"
+	default:
+		return ":white_check_mark:"
+	}
+}
+
+func ntfyPriority(severity Severity) string {
+	switch severity {
+	case SeverityCritical:
+		return "urgent"
+	case SeverityWarning:
+		return "high"
+	default:
+		return "default"
+	}
+}
+
+func ntfyTags(severity Severity) string {
+	switch severity {
+	case SeverityCritical:
+		return "rotating_light"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return "white_check_mark"
+	}
+}
+
+func gotifyPriority(severity Severity) int {
+	switch severity {
+	case SeverityCritical:
+		return 8
+	case SeverityWarning:
+		return 5
+	default:
+		return 2
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,215 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testEvent is the event sent to every channel
+var testEvent = Event{
+	Type:     EventTokenInvalid,
+	Severity: SeverityCritical,
+	Title:    "Plex owner token is invalid",
+	Message:  "The owner token was rejected by Plex.",
+	Time:     time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+	Details:  map[string]string{"owner": "owner", "state": "token_invalid"},
+}
+
+// receivedRequest is a notification received by a test server
+type receivedRequest struct {
+	path    string
+	headers http.Header
+	body    []byte
+}
+
+// newReceiver starts a server answering status to every notification and
+// returns it with a function returning the received requests
+func newReceiver(t *testing.T, status int) (*httptest.Server, func() []receivedRequest) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var received []receivedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, receivedRequest{path: r.URL.Path, headers: r.Header.Clone(), body: body})
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []receivedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]receivedRequest(nil), received...)
+	}
+}
+
+// decodeJSON decodes a JSON notification body
+func decodeJSON(t *testing.T, body []byte) map[string]interface{} {
+	t.Helper()
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("body is not JSON: %v\n%s", err, body)
+	}
+	return payload
+}
+
+func TestNotifiers(t *testing.T) {
+	tests := []struct {
+		name     string
+		notifier func(url string) Notifier
+		check    func(t *testing.T, request receivedRequest)
+	}{
+		{
+			name:     "webhook",
+			notifier: func(url string) Notifier { return &Webhook{URL: url + "/hooks/secret"} },
+			check: func(t *testing.T, request receivedRequest) {
+				if request.path != "/hooks/secret" {
+					t.Errorf("path = %q", request.path)
+				}
+				var event Event
+				if err := json.Unmarshal(request.body, &event); err != nil {
+					t.Fatalf("body is not an event: %v", err)
+				}
+				if event.Type != testEvent.Type || event.Severity != testEvent.Severity || event.Title != testEvent.Title ||
+					event.Message != testEvent.Message || !event.Time.Equal(testEvent.Time) || event.Details["state"] != "token_invalid" {
+					t.Errorf("event = %+v, want %+v", event, testEvent)
+				}
+			},
+		},
+		{
+			name:     "discord",
+			notifier: func(url string) Notifier { return &Discord{URL: url + "/api/webhooks/1/secret"} },
+			check: func(t *testing.T, request receivedRequest) {
+				payload := decodeJSON(t, request.body)
+				embeds, ok := payload["embeds"].([]interface{})
+				if !ok || len(embeds) != 1 {
+					t.Fatalf("embeds = %v, want one embed", payload["embeds"])
+				}
+				embed := embeds[0].(map[string]interface{})
+				if embed["title"] != testEvent.Title || embed["description"] != testEvent.Message {
+					t.Errorf("embed = %v", embed)
+				}
+				if embed["timestamp"] != "2024-01-01T12:00:00Z" {
+					t.Errorf("timestamp = %v", embed["timestamp"])
+				}
+				if embed["color"] != float64(0xf44336) {
+					t.Errorf("color = %v, want the critical color", embed["color"])
+				}
+				if fields, _ := embed["fields"].([]interface{}); len(fields) != 2 {
+					t.Errorf("fields = %v, want one per detail", embed["fields"])
+				}
+			},
+		},
+		{
+			name:     "slack",
+			notifier: func(url string) Notifier { return &Slack{URL: url + "/services/secret"} },
+			check: func(t *testing.T, request receivedRequest) {
+				payload := decodeJSON(t, request.body)
+				text, _ := payload["text"].(string)
+				for _, want := range []string{":rotating_light:", "*" + testEvent.Title + "*", testEvent.Message, "• owner: owner", "• state: token_invalid"} {
+					if !strings.Contains(text, want) {
+						t.Errorf("text %q doesn't contain %q", text, want)
+					}
+				}
+			},
+		},
+		{
+			name:     "ntfy",
+			notifier: func(url string) Notifier { return &Ntfy{URL: url + "/my-topic", Token: "tk_secret"} },
+			check: func(t *testing.T, request receivedRequest) {
+				if request.path != "/my-topic" {
+					t.Errorf("path = %q", request.path)
+				}
+				if string(request.body) != testEvent.Message {
+					t.Errorf("body = %q, want the message", request.body)
+				}
+				want := map[string]string{
+					"Title":         testEvent.Title,
+					"Priority":      "urgent",
+					"Tags":          "rotating_light",
+					"Authorization": "Bearer tk_secret",
+				}
+				for header, value := range want {
+					if got := request.headers.Get(header); got != value {
+						t.Errorf("%s = %q, want %q", header, got, value)
+					}
+				}
+			},
+		},
+		{
+			name:     "gotify",
+			notifier: func(url string) Notifier { return &Gotify{URL: url + "/", Token: "app-secret"} },
+			check: func(t *testing.T, request receivedRequest) {
+				if request.path != "/message" {
+					t.Errorf("path = %q, want /message", request.path)
+				}
+				if key := request.headers.Get("X-Gotify-Key"); key != "app-secret" {
+					t.Errorf("X-Gotify-Key = %q", key)
+				}
+				payload := decodeJSON(t, request.body)
+				if payload["title"] != testEvent.Title || payload["message"] != testEvent.Message || payload["priority"] != float64(8) {
+					t.Errorf("payload = %v", payload)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, received := newReceiver(t, http.StatusOK)
+
+			if err := tt.notifier(server.URL).Notify(context.Background(), testEvent); err != nil {
+				t.Fatalf("Notify: %v", err)
+			}
+
+			requests := received()
+			if len(requests) != 1 {
+				t.Fatalf("received %d request(s), want 1", len(requests))
+			}
+			tt.check(t, requests[0])
+		})
+	}
+}
+
+func TestNotifierErrorsHideURL(t *testing.T) {
+	failing, _ := newReceiver(t, http.StatusInternalServerError)
+	closed, _ := newReceiver(t, http.StatusOK)
+	closed.Close()
+
+	notifiers := map[string]func(url string) Notifier{
+		"webhook": func(url string) Notifier { return &Webhook{URL: url} },
+		"discord": func(url string) Notifier { return &Discord{URL: url} },
+		"slack":   func(url string) Notifier { return &Slack{URL: url} },
+		"ntfy":    func(url string) Notifier { return &Ntfy{URL: url} },
+		"gotify":  func(url string) Notifier { return &Gotify{URL: url} },
+	}
+	servers := map[string]string{"failing": failing.URL, "unreachable": closed.URL}
+
+	for name, notifier := range notifiers {
+		for server, url := range servers {
+			t.Run(name+" "+server, func(t *testing.T) {
+				secretURL := url + "/secret-webhook-token"
+
+				err := notifier(secretURL).Notify(context.Background(), testEvent)
+				if err == nil {
+					t.Fatal("Notify succeeded")
+				}
+				if strings.Contains(err.Error(), "secret-webhook-token") || strings.Contains(err.Error(), url) {
+					t.Errorf("error %q contains the URL", err)
+				}
+			})
+		}
+	}
+}
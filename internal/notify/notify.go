@@ -0,0 +1,127 @@
+package notify
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// EventType identifies what happened
+type EventType string
+
+const (
+	// EventTokenInvalid is sent when the owner token becomes invalid
+	EventTokenInvalid EventType = "token_invalid"
+	// EventTokenValid is sent when the owner token is valid again
+	EventTokenValid EventType = "token_valid"
+	// EventPlexUnreachable is sent when Plex is unreachable for several consecutive checks
+	EventPlexUnreachable EventType = "plex_unreachable"
+	// EventPlexReachable is sent when Plex is reachable again
+	EventPlexReachable EventType = "plex_reachable"
+)
+
+// Severity tells how urgent an event is
+type Severity string
+
+const (
+	SeverityCritical Severity = "critical"
+	SeverityWarning  Severity = "warning"
+	SeverityResolved Severity = "resolved"
+)
+
+// sendTimeout limits how long a single notification may take
+const sendTimeout = 10 * time.Second
+
+// Event is a notification about a state change
+type Event struct {
+	Type     EventType         `json:"type"`
+	Severity Severity          `json:"severity"`
+	Title    string            `json:"title"`
+	Message  string            `json:"message"`
+	Time     time.Time         `json:"time"`
+	Details  map[string]string `json:"details,omitempty"`
+	// Resolves is the alert this event ends, empty for alerts
+	Resolves EventType `json:"resolves,omitempty"`
+}
+
+// Notifier sends events to a notification channel
+type Notifier interface {
+	// Name identifies the channel in logs
+	Name() string
+	// Notify sends an event
+	Notify(ctx context.Context, event Event) error
+}
+
+// Dispatcher sends events to every notifier, dropping duplicates.
+// An alert is sent again only after the re-alert interval while it is active,
+// and a resolving event is only sent for an alert that was sent.
+type Dispatcher struct {
+	notifiers       []Notifier
+	reAlertInterval time.Duration
+	mu              sync.Mutex
+	active          map[EventType]time.Time
+	wg              sync.WaitGroup
+}
+
+// NewDispatcher creates a dispatcher. A zero re-alert interval sends each alert once.
+func NewDispatcher(notifiers []Notifier, reAlertInterval time.Duration) *Dispatcher {
+	return &Dispatcher{
+		notifiers:       notifiers,
+		reAlertInterval: reAlertInterval,
+		active:          make(map[EventType]time.Time),
+	}
+}
+
+// Dispatch sends an event to every notifier in the background unless it is a duplicate.
+// It returns true if the event is sent.
+func (d *Dispatcher) Dispatch(event Event) bool {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if !d.shouldSend(event) || len(d.notifiers) == 0 {
+		return false
+	}
+
+	for _, notifier := range d.notifiers {
+		d.wg.Add(1)
+		go func(notifier Notifier) {
+			defer d.wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+			defer cancel()
+
+			if err := notifier.Notify(ctx, event); err != nil {
+				log.Printf("⚠️  Failed to send %s notification to %s: %v", event.Type, notifier.Name(), err)
+			}
+		}(notifier)
+	}
+	return true
+}
+
+// Wait waits for the notifications being sent, e.g. before exiting
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// shouldSend records the event and returns false if it is a duplicate
+func (d *Dispatcher) shouldSend(event Event) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if event.Resolves != "" {
+		if _, active := d.active[event.Resolves]; !active {
+			return false
+		}
+		delete(d.active, event.Resolves)
+		return true
+	}
+
+	if lastSent, active := d.active[event.Type]; active {
+		if d.reAlertInterval <= 0 || event.Time.Sub(lastSent) < d.reAlertInterval {
+			return false
+		}
+	}
+	d.active[event.Type] = event.Time
+	return true
+}
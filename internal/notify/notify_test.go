@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// recorder is a notifier recording the events it is sent
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recorder) Name() string { return "recorder" }
+
+func (r *recorder) Notify(ctx context.Context, event Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+// types returns the types of the events sent
+func (r *recorder) types() []EventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	types := make([]EventType, len(r.events))
+	for i, event := range r.events {
+		types[i] = event.Type
+	}
+	return types
+}
+
+func equalTypes(got, want []EventType) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDispatcher(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	alert := func(after time.Duration) Event {
+		return Event{Type: EventTokenInvalid, Severity: SeverityCritical, Time: start.Add(after)}
+	}
+	recovery := func(after time.Duration) Event {
+		return Event{Type: EventTokenValid, Severity: SeverityResolved, Time: start.Add(after), Resolves: EventTokenInvalid}
+	}
+
+	tests := []struct {
+		name            string
+		reAlertInterval time.Duration
+		events          []Event
+		want            []EventType
+	}{
+		{
+			name:            "duplicate alerts are dropped",
+			reAlertInterval: time.Hour,
+			events:          []Event{alert(0), alert(time.Minute), alert(59 * time.Minute)},
+			want:            []EventType{EventTokenInvalid},
+		},
+		{
+			name:            "active alerts are sent again after the re-alert interval",
+			reAlertInterval: time.Hour,
+			events:          []Event{alert(0), alert(30 * time.Minute), alert(time.Hour), alert(90 * time.Minute), alert(2 * time.Hour)},
+			want:            []EventType{EventTokenInvalid, EventTokenInvalid, EventTokenInvalid},
+		},
+		{
+			name:            "alerts are sent once without re-alert interval",
+			reAlertInterval: 0,
+			events:          []Event{alert(0), alert(24 * time.Hour)},
+			want:            []EventType{EventTokenInvalid},
+		},
+		{
+			name:            "recoveries are only sent for sent alerts",
+			reAlertInterval: time.Hour,
+			events:          []Event{recovery(0), alert(time.Minute), recovery(2 * time.Minute), recovery(3 * time.Minute)},
+			want:            []EventType{EventTokenInvalid, EventTokenValid},
+		},
+		{
+			name:            "a recovery ends the alert",
+			reAlertInterval: time.Hour,
+			events:          []Event{alert(0), recovery(time.Minute), alert(2 * time.Minute)},
+			want:            []EventType{EventTokenInvalid, EventTokenValid, EventTokenInvalid},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier := &recorder{}
+			dispatcher := NewDispatcher([]Notifier{notifier}, tt.reAlertInterval)
+
+			// Events are sent in the background, wait for each one to keep their order
+			for _, event := range tt.events {
+				dispatcher.Dispatch(event)
+				dispatcher.Wait()
+			}
+
+			if got := notifier.types(); !equalTypes(got, tt.want) {
+				t.Errorf("sent %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDispatcherSendsToEveryNotifier(t *testing.T) {
+	first, second := &recorder{}, &recorder{}
+	dispatcher := NewDispatcher([]Notifier{first, second}, 0)
+
+	if !dispatcher.Dispatch(Event{Type: EventPlexUnreachable}) {
+		t.Fatal("Dispatch dropped the first alert")
+	}
+	dispatcher.Wait()
+
+	for i, notifier := range []*recorder{first, second} {
+		if got := notifier.types(); !equalTypes(got, []EventType{EventPlexUnreachable}) {
+			t.Errorf("notifier %d was sent %v", i, got)
+		}
+	}
+}
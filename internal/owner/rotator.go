@@ -0,0 +1,169 @@
+package owner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/access"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/health"
+	"github.com/hubert_i/nginx_plex_auth_server/pkg/plex"
+)
+
+var (
+	// ErrInvalidToken is returned when Plex rejects the new owner token
+	ErrInvalidToken = errors.New("owner token is invalid")
+
+	// ErrNotServerOwner is returned when the new owner token doesn't own the Plex server
+	ErrNotServerOwner = errors.New("owner token does not own the Plex server")
+)
+
+// Rotator replaces the owner token used by the Plex client and the token monitor at runtime
+type Rotator struct {
+	plexClient   *plex.Client
+	serverID     string
+	tokenMonitor *health.TokenMonitor
+	accessList   *access.Refresher
+	tokenCache   *cache.TokenCache
+	onRotate     func(token string)
+	rotateMu     sync.Mutex
+	stopChan     chan struct{}
+	fileMu       sync.Mutex
+	// rejectedToken is the last token read from the file that failed validation,
+	// so it isn't retried until the file changes
+	rejectedToken string
+}
+
+// NewRotator creates a new owner token rotator
+func NewRotator(client *plex.Client, serverID string, tokenMonitor *health.TokenMonitor, accessList *access.Refresher, tokenCache *cache.TokenCache) *Rotator {
+	return &Rotator{
+		plexClient:   client,
+		serverID:     serverID,
+		tokenMonitor: tokenMonitor,
+		accessList:   accessList,
+		tokenCache:   tokenCache,
+		stopChan:     make(chan struct{}),
+	}
+}
+
+// SetRotateCallback sets a callback function that will be called with the new owner token after each rotation
+func (r *Rotator) SetRotateCallback(callback func(token string)) {
+	r.onRotate = callback
+}
+
+// Rotate validates a new owner token and switches to it.
+// The token must be valid and own the Plex server. Cached decisions based on the
+// previous owner's shared users are dropped once the shared users are refreshed,
+// and every cached decision is dropped if the owner account changed.
+func (r *Rotator) Rotate(ctx context.Context, token string) (*plex.UserInfo, error) {
+	r.rotateMu.Lock()
+	defer r.rotateMu.Unlock()
+
+	owner, err := r.validate(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	var previousOwnerID int
+	if snapshot := r.accessList.Snapshot(); snapshot != nil {
+		previousOwnerID = snapshot.Owner.ID
+	}
+
+	r.plexClient.SetToken(token)
+	r.tokenMonitor.SetOwnerToken(token)
+	log.Printf("✓ Owner token rotated (Owner: %s, ID: %d)", owner.Username, owner.ID)
+	if r.onRotate != nil {
+		r.onRotate(token)
+	}
+
+	if previousOwnerID != 0 && previousOwnerID != owner.ID {
+		r.tokenCache.Clear()
+		log.Printf("Owner account changed (ID: %d -> %d), cleared the token cache", previousOwnerID, owner.ID)
+	}
+
+	// The refresh reports the users who gained or lost access, whose cached decisions are dropped
+	if err := r.accessList.Refresh(ctx); err != nil {
+		log.Printf("⚠️  Shared users refresh after owner token rotation failed: %v", err)
+	}
+
+	return owner, nil
+}
+
+// RotateFromFile reads the owner token from a file and rotates to it if it changed.
+// It returns true if the token was replaced.
+func (r *Rotator) RotateFromFile(path string) bool {
+	r.fileMu.Lock()
+	defer r.fileMu.Unlock()
+
+	token, err := config.ReadSecretFile(path)
+	if err != nil {
+		log.Printf("⚠️  Failed to read owner token file: %v", err)
+		return false
+	}
+	if token == r.plexClient.Token() || token == r.rejectedToken {
+		return false
+	}
+
+	log.Printf("Owner token file %s changed, rotating the owner token", path)
+	_, err = r.Rotate(context.Background(), token)
+	if errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrNotServerOwner) {
+		r.rejectedToken = token
+	}
+	if err != nil {
+		log.Printf("⚠️  Owner token from %s rejected, keeping the current token: %v", path, err)
+		return false
+	}
+	return true
+}
+
+// WatchFile checks the owner token file for a new token at each interval
+func (r *Rotator) WatchFile(path string, interval time.Duration) {
+	log.Printf("Watching owner token file %s (check interval: %v)", path, interval)
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if r.RotateFromFile(path) {
+					r.tokenMonitor.Check()
+				}
+			case <-r.stopChan:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops watching the owner token file
+func (r *Rotator) Stop() {
+	close(r.stopChan)
+}
+
+// validate checks that a token is valid and owns the Plex server, returning its account
+func (r *Rotator) validate(ctx context.Context, token string) (*plex.UserInfo, error) {
+	identity, err := r.plexClient.IdentifyContext(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate owner token: %w", err)
+	}
+	if !identity.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	resources, err := r.plexClient.GetResourcesContext(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the servers of the owner token: %w", err)
+	}
+	server := plex.FindServer(resources, r.serverID)
+	if server == nil || !server.Owned {
+		return nil, ErrNotServerOwner
+	}
+
+	return identity.User, nil
+}
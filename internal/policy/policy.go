@@ -0,0 +1,196 @@
+package policy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+)
+
+// Request describes an authorization request. The user fields are only set
+// for users with server access.
+type Request struct {
+	Host     string
+	Path     string
+	ClientIP string
+	UserID   int
+	Username string
+	Email    string
+}
+
+// Decision is the result of evaluating the policy rules
+type Decision struct {
+	Allowed bool
+	// Bypass is true if the client network is allowed without authentication
+	Bypass bool
+	// Rule is the name of the matching rule, empty if no rule matched
+	Rule   string
+	Reason string
+}
+
+// rule is a policy rule with its networks parsed
+type rule struct {
+	config.PolicyRule
+	name   string
+	allow  []*net.IPNet
+	bypass []*net.IPNet
+	deny   []*net.IPNet
+}
+
+// Engine evaluates the policy rules from the configuration
+type Engine struct {
+	rules []rule
+}
+
+// NewEngine creates a policy engine from the configured rules
+func NewEngine(rules []config.PolicyRule) *Engine {
+	e := &Engine{rules: make([]rule, 0, len(rules))}
+	for i, r := range rules {
+		name := r.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i)
+		}
+		e.rules = append(e.rules, rule{
+			PolicyRule: r,
+			name:       name,
+			allow:      config.ParseCIDRs(r.AllowNetworks),
+			bypass:     config.ParseCIDRs(r.BypassNetworks),
+			deny:       config.ParseCIDRs(r.DenyNetworks),
+		})
+	}
+	return e
+}
+
+// Evaluate applies the first rule matching the request host and path.
+// Requests matching no rule are allowed.
+func (e *Engine) Evaluate(req Request) Decision {
+	r := e.match(req)
+	if r == nil {
+		return Decision{Allowed: true, Reason: "no rule matched"}
+	}
+
+	if decision, decided := r.evaluateNetwork(req.ClientIP); decided {
+		return decision
+	}
+
+	if containsUser(r.DenyUsers, req) {
+		return Decision{Allowed: false, Rule: r.name, Reason: "user is denied by rule " + r.name}
+	}
+	if len(r.AllowUsers) > 0 && !containsUser(r.AllowUsers, req) {
+		return Decision{Allowed: false, Rule: r.name, Reason: "user is not allowed by rule " + r.name}
+	}
+	return Decision{Allowed: true, Rule: r.name, Reason: "user is allowed by rule " + r.name}
+}
+
+// EvaluateNetwork applies the network conditions of the first rule matching the
+// request host and path, before the user is known. It returns false when the
+// decision depends on the user.
+func (e *Engine) EvaluateNetwork(req Request) (Decision, bool) {
+	r := e.match(req)
+	if r == nil {
+		return Decision{}, false
+	}
+	return r.evaluateNetwork(req.ClientIP)
+}
+
+// match returns the first rule matching the request host and path, nil if none does
+func (e *Engine) match(req Request) *rule {
+	for i := range e.rules {
+		if Matches(e.rules[i].Hosts, e.rules[i].Paths, req.Host, req.Path) {
+			return &e.rules[i]
+		}
+	}
+	return nil
+}
+
+// Matches returns true if the host matches one of the host patterns and the path
+// starts with one of the path prefixes, empty lists matching everything. Patterns
+// are matched like the hosts and paths of policy rules.
+func Matches(hosts, paths []string, host, path string) bool {
+	return matchesHost(hosts, NormalizeHost(host)) && matchesPath(paths, path)
+}
+
+// evaluateNetwork denies clients of the deny networks or outside the allow networks,
+// and bypasses authentication for clients of the bypass networks. It returns false
+// when the client network doesn't decide.
+func (r *rule) evaluateNetwork(clientIP string) (Decision, bool) {
+	ip := net.ParseIP(clientIP)
+	if containsIP(r.deny, ip) {
+		return Decision{Allowed: false, Rule: r.name, Reason: "client network is denied by rule " + r.name}, true
+	}
+	if containsIP(r.bypass, ip) {
+		return Decision{Allowed: true, Bypass: true, Rule: r.name, Reason: "client network bypasses authentication by rule " + r.name}, true
+	}
+	if len(r.allow) > 0 && !containsIP(r.allow, ip) {
+		return Decision{Allowed: false, Rule: r.name, Reason: "client network is not allowed by rule " + r.name}, true
+	}
+	return Decision{}, false
+}
+
+// containsIP returns true if ip belongs to one of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeHost lowercases the host and strips the port and trailing dot
+func NormalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// matchesHost returns true if the host matches one of the patterns (or there are none)
+func matchesHost(patterns []string, host string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPath returns true if the path starts with one of the prefixes (or there are none).
+// Prefixes match whole path segments: "/admin" matches "/admin" and "/admin/users" but
+// not "/administrator".
+func matchesPath(prefixes []string, path string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// containsUser returns true if the list names the user by username or email
+func containsUser(users []string, req Request) bool {
+	for _, user := range users {
+		if strings.EqualFold(user, req.Username) || (req.Email != "" && strings.EqualFold(user, req.Email)) {
+			return true
+		}
+	}
+	return false
+}
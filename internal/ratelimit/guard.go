@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hubert_i/nginx_plex_auth_server/internal/cache"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/clientip"
+	"github.com/hubert_i/nginx_plex_auth_server/internal/config"
+)
+
+// cleanupInterval is how often idle buckets and expired lockouts are dropped
+const cleanupInterval = time.Minute
+
+// Endpoints limited by the guard
+const (
+	EndpointLogin    = "login"
+	EndpointCallback = "callback"
+	// EndpointAuth is limited on cache misses only, they are validated with Plex
+	EndpointAuth = "auth"
+	// EndpointAdmin is limited on admin requests with a Plex token validated with Plex
+	EndpointAdmin = "admin"
+)
+
+// Guard applies per-IP and global rate limits to the endpoints calling plex.tv
+// and locks out tokens that repeatedly fail validation. Each endpoint has its own
+// global bucket, so a flood of one endpoint doesn't block the others.
+type Guard struct {
+	perIP    map[string]*Limiter
+	global   map[string]*Limiter
+	lockout  *Lockout
+	stopChan chan struct{}
+}
+
+// NewGuard creates a guard from the rate limit settings. Limits apply to the
+// client IP resolved by the clientip middleware.
+func NewGuard(cfg config.RateLimit) *Guard {
+	return &Guard{
+		perIP: map[string]*Limiter{
+			EndpointLogin:    NewLimiter(cfg.LoginPerIP),
+			EndpointCallback: NewLimiter(cfg.CallbackPerIP),
+			EndpointAuth:     NewLimiter(cfg.AuthPerIP),
+			EndpointAdmin:    NewLimiter(cfg.AuthPerIP),
+		},
+		global: map[string]*Limiter{
+			EndpointLogin:    NewLimiter(cfg.Global),
+			EndpointCallback: NewLimiter(cfg.Global),
+			EndpointAuth:     NewLimiter(cfg.Global),
+			EndpointAdmin:    NewLimiter(cfg.Global),
+		},
+		lockout:  NewLockout(cfg.LockoutFailures, cfg.LockoutDuration),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Start begins dropping idle buckets and expired lockouts
+func (g *Guard) Start() {
+	ticker := time.NewTicker(cleanupInterval)
+	go func() {
+		for {
+			select {
+			case now := <-ticker.C:
+				for endpoint, limiter := range g.perIP {
+					limiter.cleanup(now)
+					g.global[endpoint].cleanup(now)
+				}
+				g.lockout.cleanup(now)
+			case <-g.stopChan:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the cleanup
+func (g *Guard) Stop() {
+	close(g.stopChan)
+}
+
+// Allow checks the per-IP and global limits of an endpoint. When a limit is
+// exceeded it writes a 429 response with Retry-After and returns false.
+func (g *Guard) Allow(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+	if wait := g.Wait(r, endpoint); wait > 0 {
+		tooManyRequests(w, wait)
+		return false
+	}
+	return true
+}
+
+// Wait checks the per-IP and global limits of an endpoint like Allow, for callers
+// writing their own response. It returns how long the client must wait, 0 if the
+// request is allowed. A request denied by the global limit doesn't count towards
+// the limit of its client.
+func (g *Guard) Wait(r *http.Request, endpoint string) time.Duration {
+	ip := clientip.FromRequest(r)
+
+	allowed, wait := g.perIP[endpoint].Allow(ip)
+	scope := "client " + ip
+	if allowed {
+		allowed, wait = g.global[endpoint].Allow("")
+		scope = "all clients"
+		if !allowed {
+			g.perIP[endpoint].Refund(ip)
+		}
+	}
+	if allowed {
+		return 0
+	}
+
+	log.Printf("⚠️  Rate limit of /%s exceeded by %s, retry in %v", endpoint, scope, wait.Round(time.Second))
+	return wait
+}
+
+// Limit wraps a handler with the limits of an endpoint
+func (g *Guard) Limit(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if g.Allow(w, r, endpoint) {
+			next(w, r)
+		}
+	}
+}
+
+// CheckToken writes a 429 response with Retry-After and returns false
+// if the token is locked out
+func (g *Guard) CheckToken(w http.ResponseWriter, token string) bool {
+	wait := g.TokenLocked(token)
+	if wait <= 0 {
+		return true
+	}
+
+	tooManyRequests(w, wait)
+	return false
+}
+
+// TokenLocked returns how long the token remains locked out, 0 if it isn't
+func (g *Guard) TokenLocked(token string) time.Duration {
+	return g.lockout.Locked(cache.SessionID(token))
+}
+
+// TokenFailed records a failed validation of a token, returning true if it got locked out
+func (g *Guard) TokenFailed(token string) bool {
+	return g.lockout.Fail(cache.SessionID(token))
+}
+
+// TokenSucceeded forgets the failed validations of a token
+func (g *Guard) TokenSucceeded(token string) {
+	g.lockout.Reset(cache.SessionID(token))
+}
+
+// tooManyRequests writes a 429 response asking to retry after wait
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+}
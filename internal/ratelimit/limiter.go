@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket refilled continuously
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a set of token buckets keyed by e.g. client IP. Each bucket allows
+// perMinute requests per minute, in bursts of up to perMinute requests.
+// A nil limiter allows everything.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+// NewLimiter creates a limiter allowing perMinute requests per minute and key,
+// it returns nil (no limit) if perMinute is 0
+func NewLimiter(perMinute int) *Limiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket of key. When the bucket is empty it returns
+// false and how long until a token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Refund gives back the token taken from the bucket of key by an allowed request
+// that didn't go through, e.g. denied by another limit
+func (l *Limiter) Refund(key string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, exists := l.buckets[key]; exists {
+		b.tokens = math.Min(l.burst, b.tokens+1)
+	}
+}
+
+// cleanup drops the buckets that refilled completely, they are recreated full when needed
+func (l *Limiter) cleanup(now time.Time) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Lockout locks keys out, e.g. tokens, after repeated failures within its duration.
+// A nil lockout never locks anything out.
+type Lockout struct {
+	mu          sync.Mutex
+	maxFailures int
+	duration    time.Duration
+	entries     map[string]*lockoutEntry
+}
+
+// lockoutEntry counts the failures of a key since the first one
+type lockoutEntry struct {
+	failures    int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// NewLockout creates a lockout after maxFailures failures within duration, lasting
+// duration. It returns nil (no lockout) if maxFailures is 0.
+func NewLockout(maxFailures int, duration time.Duration) *Lockout {
+	if maxFailures <= 0 {
+		return nil
+	}
+	return &Lockout{
+		maxFailures: maxFailures,
+		duration:    duration,
+		entries:     make(map[string]*lockoutEntry),
+	}
+}
+
+// Locked returns how long key remains locked out, 0 if it isn't
+func (l *Lockout) Locked(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry, exists := l.entries[key]; exists {
+		if remaining := time.Until(entry.lockedUntil); remaining > 0 {
+			return remaining
+		}
+	}
+	return 0
+}
+
+// Fail records a failure of key, returning true if it got locked out
+func (l *Lockout) Fail(key string) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	entry, exists := l.entries[key]
+	if !exists || now.Sub(entry.first) > l.duration {
+		entry = &lockoutEntry{first: now}
+		l.entries[key] = entry
+	}
+
+	entry.failures++
+	if entry.failures >= l.maxFailures {
+		entry.lockedUntil = now.Add(l.duration)
+		entry.failures = 0
+		entry.first = now
+		return true
+	}
+	return false
+}
+
+// Reset forgets the failures of key
+func (l *Lockout) Reset(key string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, key)
+}
+
+// cleanup drops the entries whose failures and lockout expired
+func (l *Lockout) cleanup(now time.Time) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, entry := range l.entries {
+		if now.After(entry.lockedUntil) && now.Sub(entry.first) > l.duration {
+			delete(l.entries, key)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package plex
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState represents the state of the circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets every request through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails every request fast
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of probe requests through
+	BreakerHalfOpen
+)
+
+// String returns the name of the state
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerOptions configures the circuit breaker around Plex API calls
+type BreakerOptions struct {
+	// ConsecutiveFailures opens the circuit after this many failures in a row (0 disables)
+	ConsecutiveFailures int
+	// FailureRate opens the circuit when the ratio of failed requests
+	// within Window reaches it (0 disables)
+	FailureRate float64
+	// MinRequests is the number of requests within Window before FailureRate applies
+	MinRequests int
+	// Window is the period over which the failure rate is computed
+	Window time.Duration
+	// OpenTimeout is how long the circuit stays open before probing Plex again
+	OpenTimeout time.Duration
+	// HalfOpenProbes is the number of successful probes needed to close the circuit
+	HalfOpenProbes int
+	// OnStateChange is called when the circuit changes state
+	OnStateChange func(from, to BreakerState)
+}
+
+// BreakerStats is a point-in-time view of the circuit breaker
+type BreakerStats struct {
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	WindowRequests      int       `json:"window_requests"`
+	WindowFailures      int       `json:"window_failures"`
+	OpenedAt            time.Time `json:"opened_at,omitempty"`
+	OpenUntil           time.Time `json:"open_until,omitempty"`
+	Opens               uint64    `json:"opens_total"`
+	Rejected            uint64    `json:"rejected_total"`
+}
+
+// circuitBreaker tracks Plex API failures and fails fast while Plex is degraded
+type circuitBreaker struct {
+	mu             sync.Mutex
+	options        BreakerOptions
+	state          BreakerState
+	consecutive    int
+	windowStart    time.Time
+	windowRequests int
+	windowFailures int
+	openedAt       time.Time
+	probes         int
+	probeSuccesses int
+	opens          uint64
+	rejected       uint64
+}
+
+func newCircuitBreaker(options BreakerOptions) *circuitBreaker {
+	if options.HalfOpenProbes <= 0 {
+		options.HalfOpenProbes = 1
+	}
+	return &circuitBreaker{
+		options:     options,
+		windowStart: time.Now(),
+	}
+}
+
+// allow returns ErrCircuitOpen if the request must not be sent to Plex
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.options.OpenTimeout {
+		b.setState(BreakerHalfOpen)
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		b.rejected++
+		return ErrCircuitOpen
+	case BreakerHalfOpen:
+		// Only let as many probes through as needed to close the circuit
+		if b.probes >= b.options.HalfOpenProbes {
+			b.rejected++
+			return ErrCircuitOpen
+		}
+		b.probes++
+	}
+
+	return nil
+}
+
+// release gives back a half-open probe slot whose outcome is unknown
+// (e.g. the caller gave up before Plex answered)
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// record updates the breaker with the outcome of a request let through by allow
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.options.Window > 0 && now.Sub(b.windowStart) >= b.options.Window {
+		b.windowStart = now
+		b.windowRequests = 0
+		b.windowFailures = 0
+	}
+
+	b.windowRequests++
+	if success {
+		b.consecutive = 0
+	} else {
+		b.consecutive++
+		b.windowFailures++
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if !success {
+			b.open(now)
+			return
+		}
+		b.probeSuccesses++
+		if b.probeSuccesses >= b.options.HalfOpenProbes {
+			b.setState(BreakerClosed)
+		}
+	case BreakerClosed:
+		if !success && b.shouldOpen() {
+			b.open(now)
+		}
+	}
+}
+
+// shouldOpen returns true if the failure thresholds are reached
+// Must be called with lock held
+func (b *circuitBreaker) shouldOpen() bool {
+	if b.options.ConsecutiveFailures > 0 && b.consecutive >= b.options.ConsecutiveFailures {
+		return true
+	}
+
+	if b.options.FailureRate > 0 && b.windowRequests >= b.options.MinRequests {
+		return float64(b.windowFailures)/float64(b.windowRequests) >= b.options.FailureRate
+	}
+
+	return false
+}
+
+// open trips the circuit
+// Must be called with lock held
+func (b *circuitBreaker) open(now time.Time) {
+	b.openedAt = now
+	b.opens++
+	b.setState(BreakerOpen)
+}
+
+// setState changes the state and resets the per-state counters
+// Must be called with lock held
+func (b *circuitBreaker) setState(state BreakerState) {
+	previous := b.state
+	b.state = state
+	b.probes = 0
+	b.probeSuccesses = 0
+
+	if state == BreakerClosed {
+		b.consecutive = 0
+		b.windowStart = time.Now()
+		b.windowRequests = 0
+		b.windowFailures = 0
+	}
+
+	if previous != state && b.options.OnStateChange != nil {
+		// Run outside of the lock so the callback can query the breaker
+		go b.options.OnStateChange(previous, state)
+	}
+}
+
+// stats returns a snapshot of the breaker
+func (b *circuitBreaker) stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := BreakerStats{
+		State:               b.state.String(),
+		ConsecutiveFailures: b.consecutive,
+		WindowRequests:      b.windowRequests,
+		WindowFailures:      b.windowFailures,
+		Opens:               b.opens,
+		Rejected:            b.rejected,
+	}
+
+	if b.state != BreakerClosed {
+		stats.OpenedAt = b.openedAt
+		stats.OpenUntil = b.openedAt.Add(b.options.OpenTimeout)
+	}
+
+	return stats
+}
@@ -1,60 +1,117 @@
 package plex
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"time"
+	"strings"
+	"sync"
 )
 
 // Client represents a Plex API client
 type Client struct {
 	baseURL    string
 	token      string
+	tokenMu    sync.RWMutex
 	clientID   string
 	httpClient *http.Client
+	options    Options
+	breaker    *circuitBreaker
 }
 
-// NewClient creates a new Plex API client
+// NewClient creates a new Plex API client with the default options
 func NewClient(baseURL, token, clientID string) *Client {
+	return NewClientWithOptions(baseURL, token, clientID, DefaultOptions())
+}
+
+// NewClientWithOptions creates a new Plex API client with custom timeouts and retries
+func NewClientWithOptions(baseURL, token, clientID string, options Options) *Client {
 	return &Client{
-		baseURL:  baseURL,
-		token:    token,
-		clientID: clientID,
-		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
-		},
+		baseURL:    baseURL,
+		token:      token,
+		clientID:   clientID,
+		httpClient: &http.Client{},
+		options:    options,
+		breaker:    newCircuitBreaker(options.Breaker),
 	}
 }
 
-// ValidateToken checks if a Plex token is valid
-func (c *Client) ValidateToken(token string) (bool, error) {
+// SetToken replaces the owner token used by owner requests, e.g. after it was rotated
+func (c *Client) SetToken(token string) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.token = token
+}
+
+// Token returns the owner token
+func (c *Client) Token() string {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.token
+}
+
+// Identity is the result of an identity lookup
+type Identity struct {
+	// Valid is false if Plex rejected the token
+	Valid bool
+	// User is the account owning the token, nil if the token is invalid
+	User *UserInfo
+}
+
+// Identify looks up the account owning a token
+func (c *Client) Identify(token string) (*Identity, error) {
+	return c.IdentifyContext(context.Background(), token)
+}
+
+// IdentifyContext looks up the account owning a token in a single request,
+// returning both the validity of the token and the user record.
+// A token rejected by Plex is not an error, it yields an invalid identity.
+func (c *Client) IdentifyContext(ctx context.Context, token string) (*Identity, error) {
 	// Use the identity endpoint which returns JSON
-	req, err := http.NewRequest("GET", c.baseURL+"/api/v2/user", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/api/v2/user", nil)
 	if err != nil {
-		return false, fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	// Use the provided token for validation
 	req.Header.Set("X-Plex-Token", token)
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return false, fmt.Errorf("failed to make request: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	// Check response status
-	if resp.StatusCode == http.StatusOK {
-		return true, nil
+	if resp.StatusCode == http.StatusUnauthorized {
+		return &Identity{Valid: false}, nil
 	}
 
-	if resp.StatusCode == http.StatusUnauthorized {
-		return false, nil
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+
+	var userInfo UserInfo
+	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+		return nil, &DecodeError{Err: err}
 	}
 
-	return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	return &Identity{Valid: true, User: &userInfo}, nil
+}
+
+// ValidateToken checks if a Plex token is valid
+func (c *Client) ValidateToken(token string) (bool, error) {
+	return c.ValidateTokenContext(context.Background(), token)
+}
+
+// ValidateTokenContext checks if a Plex token is valid
+func (c *Client) ValidateTokenContext(ctx context.Context, token string) (bool, error) {
+	identity, err := c.IdentifyContext(ctx, token)
+	if err != nil {
+		return false, err
+	}
+	return identity.Valid, nil
 }
 
 // UserInfo represents basic Plex user information
@@ -64,27 +121,35 @@ type UserInfo struct {
 	Email    string `json:"email"`
 }
 
+// SharedUser represents a user the server has been shared with
+type SharedUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
 // ServerAccessResponse represents the response from server shared users endpoint
 type ServerAccessResponse struct {
 	MediaContainer struct {
-		User []struct {
-			ID       int    `json:"id"`
-			Username string `json:"username"`
-			Email    string `json:"email"`
-		} `json:"User"`
+		User []SharedUser `json:"User"`
 	} `json:"MediaContainer"`
 }
 
 // CheckServerAccess validates if a user has access to a specific Plex server
 func (c *Client) CheckServerAccess(userToken, serverID string) (bool, error) {
+	return c.CheckServerAccessContext(context.Background(), userToken, serverID)
+}
+
+// CheckServerAccessContext validates if a user has access to a specific Plex server
+func (c *Client) CheckServerAccessContext(ctx context.Context, userToken, serverID string) (bool, error) {
 	// First, get the user info from their token
-	userInfo, err := c.GetUserInfo(userToken)
+	userInfo, err := c.GetUserInfoContext(ctx, userToken)
 	if err != nil {
 		return false, fmt.Errorf("failed to get user info: %w", err)
 	}
 
 	// Check if this is the server owner
-	ownerInfo, err := c.GetUserInfo(c.token)
+	ownerInfo, err := c.GetOwnerInfoContext(ctx)
 	if err != nil {
 		return false, fmt.Errorf("failed to get owner info: %w", err)
 	}
@@ -95,7 +160,7 @@ func (c *Client) CheckServerAccess(userToken, serverID string) (bool, error) {
 	}
 
 	// Check if user has access via shared servers
-	hasAccess, err := c.checkSharedServerAccess(userInfo.ID, serverID)
+	hasAccess, err := c.checkSharedServerAccess(ctx, userInfo.ID, serverID)
 	if err != nil {
 		return false, fmt.Errorf("failed to check shared access: %w", err)
 	}
@@ -105,71 +170,210 @@ func (c *Client) CheckServerAccess(userToken, serverID string) (bool, error) {
 
 // GetUserInfo retrieves user information from a token
 func (c *Client) GetUserInfo(token string) (*UserInfo, error) {
-	req, err := http.NewRequest("GET", c.baseURL+"/api/v2/user", nil)
+	return c.GetUserInfoContext(context.Background(), token)
+}
+
+// GetUserInfoContext retrieves user information from a token.
+// An invalid token yields ErrUnauthorized.
+func (c *Client) GetUserInfoContext(ctx context.Context, token string) (*UserInfo, error) {
+	identity, err := c.IdentifyContext(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if !identity.Valid {
+		return nil, ErrUnauthorized
+	}
+	return identity.User, nil
+}
+
+// checkSharedServerAccess checks if a user has access to a shared server
+func (c *Client) checkSharedServerAccess(ctx context.Context, userID int, serverID string) (bool, error) {
+	users, err := c.GetSharedUsersContext(ctx, serverID)
+	if errors.Is(err, ErrServerNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Check if the user ID is in the list of users with access
+	for _, user := range users {
+		if user.ID == userID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// GetOwnerInfo retrieves the user information of the owner token
+func (c *Client) GetOwnerInfo() (*UserInfo, error) {
+	return c.GetOwnerInfoContext(context.Background())
+}
+
+// GetOwnerInfoContext retrieves the user information of the owner token
+func (c *Client) GetOwnerInfoContext(ctx context.Context) (*UserInfo, error) {
+	return c.GetUserInfoContext(ctx, c.Token())
+}
+
+// GetSharedUsers retrieves the list of users the server is shared with.
+// An unknown server yields ErrServerNotFound.
+func (c *Client) GetSharedUsers(serverID string) ([]SharedUser, error) {
+	return c.GetSharedUsersContext(context.Background(), serverID)
+}
+
+// GetSharedUsersContext retrieves the list of users the server is shared with.
+// An unknown server yields ErrServerNotFound.
+func (c *Client) GetSharedUsersContext(ctx context.Context, serverID string) ([]SharedUser, error) {
+	url := fmt.Sprintf("%s/api/v2/shared_servers/%s", c.baseURL, serverID)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("X-Plex-Token", token)
+	req.Header.Set("X-Plex-Token", c.Token())
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrServerNotFound
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, statusError(resp)
 	}
 
-	var userInfo UserInfo
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	var accessResp ServerAccessResponse
+	if err := json.NewDecoder(resp.Body).Decode(&accessResp); err != nil {
+		return nil, &DecodeError{Err: err}
 	}
 
-	return &userInfo, nil
+	return accessResp.MediaContainer.User, nil
 }
 
-// checkSharedServerAccess checks if a user has access to a shared server
-func (c *Client) checkSharedServerAccess(userID int, serverID string) (bool, error) {
-	// Get list of users with access to the server
-	url := fmt.Sprintf("%s/api/v2/shared_servers/%s", c.baseURL, serverID)
-	req, err := http.NewRequest("GET", url, nil)
+// HomeUser represents a member of a Plex Home
+type HomeUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	// Title is the display name, managed users have no username
+	Title string `json:"title"`
+	Email string `json:"email"`
+	// Admin is true for the account owning the Plex Home
+	Admin bool `json:"admin"`
+}
+
+// HomeUsersResponse represents the response from the Plex Home users endpoint
+type HomeUsersResponse struct {
+	ID    int        `json:"id"`
+	Users []HomeUser `json:"users"`
+}
+
+// GetHomeUsers retrieves the members of the owner's Plex Home, including the owner
+func (c *Client) GetHomeUsers() ([]HomeUser, error) {
+	return c.GetHomeUsersContext(context.Background())
+}
+
+// GetHomeUsersContext retrieves the members of the owner's Plex Home, including the owner.
+// An account without a Plex Home yields no users.
+func (c *Client) GetHomeUsersContext(ctx context.Context) ([]HomeUser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/api/v2/home/users", nil)
 	if err != nil {
-		return false, fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("X-Plex-Token", c.token)
+	req.Header.Set("X-Plex-Token", c.Token())
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return false, fmt.Errorf("failed to make request: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound {
-		return false, nil
+		return nil, nil
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, statusError(resp)
 	}
 
-	var accessResp ServerAccessResponse
-	if err := json.NewDecoder(resp.Body).Decode(&accessResp); err != nil {
-		return false, fmt.Errorf("failed to decode response: %w", err)
+	var homeResp HomeUsersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&homeResp); err != nil {
+		return nil, &DecodeError{Err: err}
 	}
 
-	// Check if the user ID is in the list of users with access
-	for _, user := range accessResp.MediaContainer.User {
-		if user.ID == userID {
-			return true, nil
+	return homeResp.Users, nil
+}
+
+// Resource represents a Plex server or client registered with an account
+type Resource struct {
+	Name             string `json:"name"`
+	Product          string `json:"product"`
+	Provides         string `json:"provides"`
+	ClientIdentifier string `json:"clientIdentifier"`
+	Owned            bool   `json:"owned"`
+	OwnerID          int    `json:"ownerId"`
+	Presence         bool   `json:"presence"`
+}
+
+// ProvidesServer returns true if the resource is a Plex Media Server
+func (r *Resource) ProvidesServer() bool {
+	for _, capability := range strings.Split(r.Provides, ",") {
+		if strings.TrimSpace(capability) == "server" {
+			return true
 		}
 	}
+	return false
+}
 
-	return false, nil
+// GetResources retrieves the servers and clients the token's account owns or has access to
+func (c *Client) GetResources(token string) ([]Resource, error) {
+	return c.GetResourcesContext(context.Background(), token)
+}
+
+// GetResourcesContext retrieves the servers and clients the token's account owns or has access to.
+// An invalid token yields ErrUnauthorized.
+func (c *Client) GetResourcesContext(ctx context.Context, token string) ([]Resource, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/api/v2/resources", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("X-Plex-Token", token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+
+	var resources []Resource
+	if err := json.NewDecoder(resp.Body).Decode(&resources); err != nil {
+		return nil, &DecodeError{Err: err}
+	}
+
+	return resources, nil
+}
+
+// FindServer returns the server with the given machine identifier, nil if it isn't listed
+func FindServer(resources []Resource, serverID string) *Resource {
+	for i := range resources {
+		if resources[i].ClientIdentifier == serverID && resources[i].ProvidesServer() {
+			return &resources[i]
+		}
+	}
+	return nil
 }
 
 // AuthPinResponse represents the response when requesting a PIN
@@ -189,8 +393,14 @@ type AuthPinCheckResponse struct {
 
 // RequestAuthPin requests a new authentication PIN from Plex
 func (c *Client) RequestAuthPin() (*AuthPinResponse, error) {
+	return c.RequestAuthPinContext(context.Background())
+}
+
+// RequestAuthPinContext requests a new authentication PIN from Plex.
+// Creating a PIN is not idempotent, so it is never retried.
+func (c *Client) RequestAuthPinContext(ctx context.Context) (*AuthPinResponse, error) {
 	// Add strong=true parameter as per Overseerr implementation
-	req, err := http.NewRequest("POST", c.baseURL+"/api/v2/pins?strong=true", nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/v2/pins?strong=true", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -206,19 +416,19 @@ func (c *Client) RequestAuthPin() (*AuthPinResponse, error) {
 	req.Header.Set("X-Plex-Device", "Linux")
 	req.Header.Set("X-Plex-Device-Name", "Nginx Auth Server")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, statusError(resp)
 	}
 
 	var pinResp AuthPinResponse
 	if err := json.NewDecoder(resp.Body).Decode(&pinResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+		return nil, &DecodeError{Err: err}
 	}
 
 	return &pinResp, nil
@@ -226,8 +436,13 @@ func (c *Client) RequestAuthPin() (*AuthPinResponse, error) {
 
 // CheckAuthPin checks if a PIN has been authenticated
 func (c *Client) CheckAuthPin(pinID int) (*AuthPinCheckResponse, error) {
+	return c.CheckAuthPinContext(context.Background(), pinID)
+}
+
+// CheckAuthPinContext checks if a PIN has been authenticated
+func (c *Client) CheckAuthPinContext(ctx context.Context, pinID int) (*AuthPinCheckResponse, error) {
 	url := fmt.Sprintf("%s/api/v2/pins/%d", c.baseURL, pinID)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -235,19 +450,19 @@ func (c *Client) CheckAuthPin(pinID int) (*AuthPinCheckResponse, error) {
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("X-Plex-Client-Identifier", c.clientID)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, statusError(resp)
 	}
 
 	var checkResp AuthPinCheckResponse
 	if err := json.NewDecoder(resp.Body).Decode(&checkResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+		return nil, &DecodeError{Err: err}
 	}
 
 	// Normalize auth token (Plex API might use authToken or auth_token)
@@ -0,0 +1,116 @@
+package plex
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrUnauthorized is returned when Plex rejects the token (invalid, expired or revoked)
+	ErrUnauthorized = errors.New("plex token is invalid or expired")
+	// ErrServerNotFound is returned when the Plex server is unknown to the owner account
+	ErrServerNotFound = errors.New("plex server not found")
+	// ErrRateLimited is matched by RateLimitError
+	ErrRateLimited = errors.New("plex API rate limit exceeded")
+	// ErrUpstreamUnavailable is matched by network errors, 5xx responses and an open circuit breaker
+	ErrUpstreamUnavailable = errors.New("plex API unavailable")
+	// ErrCircuitOpen is returned without contacting Plex while the circuit breaker is open
+	ErrCircuitOpen = fmt.Errorf("plex circuit breaker is open: %w", ErrUpstreamUnavailable)
+)
+
+// RateLimitError is returned when Plex answers 429 Too Many Requests
+type RateLimitError struct {
+	// RetryAfter is the delay requested by Plex, zero if it didn't send one
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%v (retry after %v)", ErrRateLimited, e.RetryAfter)
+	}
+	return ErrRateLimited.Error()
+}
+
+// Is makes RateLimitError match ErrRateLimited
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// StatusError is returned when Plex answers with an unexpected status code
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+// Is makes 5xx responses match ErrUpstreamUnavailable
+func (e *StatusError) Is(target error) bool {
+	return target == ErrUpstreamUnavailable && e.StatusCode >= http.StatusInternalServerError
+}
+
+// RequestError is returned when Plex could not be reached
+type RequestError struct {
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	return "failed to make request: " + e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes network errors match ErrUpstreamUnavailable
+func (e *RequestError) Is(target error) bool {
+	return target == ErrUpstreamUnavailable
+}
+
+// DecodeError is returned when a Plex response can't be decoded
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return "failed to decode response: " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// statusError converts an unexpected response into a typed error
+func statusError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusTooManyRequests:
+		return &RateLimitError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	default:
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+}
+
+// parseRetryAfter parses a Retry-After header in seconds or HTTP date form
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,244 @@
+package plextest
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serveAPI routes the plex.tv API endpoints
+func (f *Fake) serveAPI(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+
+	switch {
+	case path == "/api/v2/user" && r.Method == http.MethodGet:
+		f.handleUser(w, r)
+	case path == "/api/v2/pins" && r.Method == http.MethodPost:
+		f.handleCreatePin(w, r)
+	case strings.HasPrefix(path, "/api/v2/pins/") && r.Method == http.MethodGet:
+		f.handleCheckPin(w, r, strings.TrimPrefix(path, "/api/v2/pins/"))
+	case strings.HasPrefix(path, "/api/v2/shared_servers/") && r.Method == http.MethodGet:
+		f.handleSharedServer(w, r, strings.TrimPrefix(path, "/api/v2/shared_servers/"))
+	case path == "/api/v2/home/users" && r.Method == http.MethodGet:
+		f.handleHomeUsers(w, r)
+	case path == "/api/v2/resources" && r.Method == http.MethodGet:
+		f.handleResources(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleUser returns the account owning the token
+func (f *Fake) handleUser(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	user, ok := f.userForToken(requestToken(r))
+	f.mu.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, userJSON(user))
+}
+
+// handleCreatePin creates a new authentication PIN
+func (f *Fake) handleCreatePin(w http.ResponseWriter, r *http.Request) {
+	clientID := r.Header.Get("X-Plex-Client-Identifier")
+	if clientID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.nextPinID++
+	pin := &Pin{
+		ID:        f.nextPinID,
+		Code:      strings.ToUpper(randomString(4)),
+		ClientID:  clientID,
+		ExpiresAt: time.Now().Add(f.pinTTL),
+	}
+	f.pins[pin.ID] = pin
+	response := pinJSON(pin)
+	f.mu.Unlock()
+
+	writeJSON(w, http.StatusCreated, response)
+}
+
+// handleCheckPin returns a PIN, with its token once approved
+func (f *Fake) handleCheckPin(w http.ResponseWriter, r *http.Request, rawID string) {
+	pinID, err := strconv.Atoi(rawID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	pin, ok := f.pins[pinID]
+	var response map[string]interface{}
+	if ok && time.Now().After(pin.ExpiresAt) {
+		delete(f.pins, pinID)
+		ok = false
+	}
+	if ok && pin.ClientID != r.Header.Get("X-Plex-Client-Identifier") {
+		ok = false
+	}
+	if ok {
+		response = pinJSON(pin)
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleSharedServer lists the users a server owned by the token's account is shared with
+func (f *Fake) handleSharedServer(w http.ResponseWriter, r *http.Request, machineID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	owner, ok := f.userForToken(requestToken(r))
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	server, ok := f.servers[machineID]
+	if !ok || server.OwnerID != owner.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	users := []map[string]interface{}{}
+	for _, id := range sortedIDs(f.shares[machineID]) {
+		if user, ok := f.users[id]; ok {
+			users = append(users, userJSON(user))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"MediaContainer": map[string]interface{}{
+			"size": len(users),
+			"User": users,
+		},
+	})
+}
+
+// handleHomeUsers lists the members of the token's account Plex Home, including the admin
+func (f *Fake) handleHomeUsers(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	owner, ok := f.userForToken(requestToken(r))
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	admin := userJSON(owner)
+	admin["admin"] = true
+	users := []map[string]interface{}{admin}
+	for _, id := range sortedIDs(f.homes[owner.ID]) {
+		if user, ok := f.users[id]; ok {
+			member := userJSON(user)
+			member["admin"] = false
+			users = append(users, member)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":    owner.ID,
+		"users": users,
+	})
+}
+
+// handleResources lists the servers owned by or shared with the token's account
+func (f *Fake) handleResources(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user, ok := f.userForToken(requestToken(r))
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	machineIDs := make([]string, 0, len(f.servers))
+	for machineID := range f.servers {
+		machineIDs = append(machineIDs, machineID)
+	}
+	sort.Strings(machineIDs)
+
+	resources := []map[string]interface{}{}
+	for _, machineID := range machineIDs {
+		server := f.servers[machineID]
+		owned := server.OwnerID == user.ID
+		if !owned && !f.shares[machineID][user.ID] {
+			continue
+		}
+		resources = append(resources, map[string]interface{}{
+			"name":             server.Name,
+			"product":          "Plex Media Server",
+			"provides":         "server",
+			"clientIdentifier": server.MachineID,
+			"owned":            owned,
+			"ownerId":          server.OwnerID,
+			"presence":         server.Online,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, resources)
+}
+
+// requestToken returns the token from the X-Plex-Token header or query parameter
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get("X-Plex-Token"); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("X-Plex-Token")
+}
+
+func userJSON(user *User) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       user.ID,
+		"username": user.Username,
+		"title":    user.Username,
+		"email":    user.Email,
+	}
+}
+
+func pinJSON(pin *Pin) map[string]interface{} {
+	var authToken interface{}
+	if pin.AuthToken != "" {
+		authToken = pin.AuthToken
+	}
+	return map[string]interface{}{
+		"id":               pin.ID,
+		"code":             pin.Code,
+		"clientIdentifier": pin.ClientID,
+		"authToken":        authToken,
+		"expiresAt":        pin.ExpiresAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func sortedIDs(set map[int]bool) []int {
+	ids := make([]int, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
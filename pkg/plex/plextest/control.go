@@ -0,0 +1,131 @@
+package plextest
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// controlPrefix is the path prefix of the control API
+const controlPrefix = "/__plextest/"
+
+// serveControl exposes the scripting methods of the fake over HTTP.
+// Parameters are read from the query string or a form body.
+//
+//	POST   /__plextest/users?id=&username=&email=   add an account, returns its token
+//	POST   /__plextest/tokens?user=                 issue a token
+//	DELETE /__plextest/tokens?token=                revoke a token
+//	POST   /__plextest/pins/approve?pin=&user=      approve a PIN
+//	POST   /__plextest/shares?server=&user=         share a server
+//	DELETE /__plextest/shares?server=&user=         unshare a server
+//	POST   /__plextest/home?owner=&user=            add a Plex Home member
+//	DELETE /__plextest/home?owner=&user=            remove a Plex Home member
+//	POST   /__plextest/servers/online?server=&online=
+//	POST   /__plextest/errors?path=&status=&times=  inject an error
+//	DELETE /__plextest/errors                       clear injected errors
+//	POST   /__plextest/latency?ms=                  delay every response
+//	GET    /__plextest/requests                     request counters
+func (f *Fake) serveControl(w http.ResponseWriter, r *http.Request) {
+	route := r.Method + " " + strings.TrimPrefix(r.URL.Path, controlPrefix)
+
+	switch route {
+	case "POST users":
+		id, ok := intParam(w, r, "id")
+		if !ok {
+			return
+		}
+		token := f.AddUser(User{ID: id, Username: r.FormValue("username"), Email: r.FormValue("email")})
+		writeJSON(w, http.StatusCreated, map[string]string{"token": token})
+	case "POST tokens":
+		userID, ok := intParam(w, r, "user")
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]string{"token": f.IssueToken(userID)})
+	case "DELETE tokens":
+		f.RevokeToken(r.FormValue("token"))
+		w.WriteHeader(http.StatusNoContent)
+	case "POST pins/approve":
+		pinID, ok := intParam(w, r, "pin")
+		if !ok {
+			return
+		}
+		userID, ok := intParam(w, r, "user")
+		if !ok {
+			return
+		}
+		if !f.ApprovePin(pinID, userID) {
+			http.Error(w, "unknown pin or user", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "POST shares", "DELETE shares":
+		userID, ok := intParam(w, r, "user")
+		if !ok {
+			return
+		}
+		if r.Method == http.MethodPost {
+			f.Share(r.FormValue("server"), userID)
+		} else {
+			f.Unshare(r.FormValue("server"), userID)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "POST home", "DELETE home":
+		ownerID, ok := intParam(w, r, "owner")
+		if !ok {
+			return
+		}
+		userID, ok := intParam(w, r, "user")
+		if !ok {
+			return
+		}
+		if r.Method == http.MethodPost {
+			f.AddHomeUser(ownerID, userID)
+		} else {
+			f.RemoveHomeUser(ownerID, userID)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "POST servers/online":
+		f.SetServerOnline(r.FormValue("server"), r.FormValue("online") == "true")
+		w.WriteHeader(http.StatusNoContent)
+	case "POST errors":
+		status, ok := intParam(w, r, "status")
+		if !ok {
+			return
+		}
+		times, _ := strconv.Atoi(r.FormValue("times"))
+		f.InjectError(r.FormValue("path"), status, times)
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE errors":
+		f.ClearErrors()
+		w.WriteHeader(http.StatusNoContent)
+	case "POST latency":
+		ms, ok := intParam(w, r, "ms")
+		if !ok {
+			return
+		}
+		f.SetLatency(time.Duration(ms) * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	case "GET requests":
+		f.mu.Lock()
+		counts := make(map[string]int, len(f.requests))
+		for path, count := range f.requests {
+			counts[path] = count
+		}
+		f.mu.Unlock()
+		writeJSON(w, http.StatusOK, counts)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// intParam reads a required integer parameter, writing a 400 if it is missing or malformed
+func intParam(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	value, err := strconv.Atoi(r.FormValue(name))
+	if err != nil {
+		http.Error(w, "invalid "+name+" parameter", http.StatusBadRequest)
+		return 0, false
+	}
+	return value, true
+}
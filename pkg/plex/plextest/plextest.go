@@ -0,0 +1,350 @@
+// Package plextest provides an in-memory fake of the plex.tv API for tests and local development.
+//
+// The fake implements the endpoints used by the plex package (user identity,
+// PINs, shared servers, home users and resources) on top of a scriptable model
+// of users, tokens, servers, shares and PIN approvals. Latency and error codes
+// can be injected to exercise timeouts, retries and the circuit breaker.
+package plextest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User is a Plex account known to the fake
+type User struct {
+	ID       int
+	Username string
+	Email    string
+}
+
+// Server is a Plex Media Server known to the fake
+type Server struct {
+	MachineID string
+	Name      string
+	OwnerID   int
+	Online    bool
+}
+
+// Pin is an authentication PIN created through the API
+type Pin struct {
+	ID        int
+	Code      string
+	ClientID  string
+	AuthToken string
+	ExpiresAt time.Time
+}
+
+// injectedError makes requests to a path prefix fail with a status code
+type injectedError struct {
+	pathPrefix string
+	status     int
+	remaining  int // <= 0 means until cleared
+}
+
+// Fake is an in-memory plex.tv API.
+// It implements http.Handler and is safe for concurrent use.
+type Fake struct {
+	mu         sync.Mutex
+	users      map[int]*User
+	tokens     map[string]int
+	servers    map[string]*Server
+	shares     map[string]map[int]bool
+	homes      map[int]map[int]bool
+	pins       map[int]*Pin
+	nextPinID  int
+	latency    time.Duration
+	errors     []*injectedError
+	requests   map[string]int
+	pinTTL     time.Duration
+	controlAPI bool
+}
+
+// New creates an empty fake
+func New() *Fake {
+	return &Fake{
+		users:     make(map[int]*User),
+		tokens:    make(map[string]int),
+		servers:   make(map[string]*Server),
+		shares:    make(map[string]map[int]bool),
+		homes:     make(map[int]map[int]bool),
+		pins:      make(map[int]*Pin),
+		nextPinID: 1000,
+		requests:  make(map[string]int),
+		pinTTL:    15 * time.Minute,
+	}
+}
+
+// NewServer starts an httptest server backed by the fake.
+// The caller must Close it, typically with defer.
+func NewServer(fake *Fake) *httptest.Server {
+	return httptest.NewServer(fake)
+}
+
+// AddUser adds an account and returns a valid token for it
+func (f *Fake) AddUser(user User) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	u := user
+	f.users[user.ID] = &u
+	return f.issueToken(user.ID)
+}
+
+// IssueToken returns a new valid token for an existing account
+func (f *Fake) IssueToken(userID int) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.issueToken(userID)
+}
+
+// RevokeToken makes a token invalid
+func (f *Fake) RevokeToken(token string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.tokens, token)
+}
+
+// AddServer adds a server owned by an account
+func (f *Fake) AddServer(server Server) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := server
+	f.servers[server.MachineID] = &s
+	if f.shares[server.MachineID] == nil {
+		f.shares[server.MachineID] = make(map[int]bool)
+	}
+}
+
+// RemoveServer removes a server, e.g. to simulate it being unclaimed
+func (f *Fake) RemoveServer(machineID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.servers, machineID)
+	delete(f.shares, machineID)
+}
+
+// SetServerOnline changes the presence of a server
+func (f *Fake) SetServerOnline(machineID string, online bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if server, ok := f.servers[machineID]; ok {
+		server.Online = online
+	}
+}
+
+// Share gives an account access to a server
+func (f *Fake) Share(machineID string, userID int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.shares[machineID] == nil {
+		f.shares[machineID] = make(map[int]bool)
+	}
+	f.shares[machineID][userID] = true
+}
+
+// Unshare removes the access of an account to a server
+func (f *Fake) Unshare(machineID string, userID int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.shares[machineID], userID)
+}
+
+// AddHomeUser adds an account to the Plex Home of an owner
+func (f *Fake) AddHomeUser(ownerID, userID int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.homes[ownerID] == nil {
+		f.homes[ownerID] = make(map[int]bool)
+	}
+	f.homes[ownerID][userID] = true
+}
+
+// RemoveHomeUser removes an account from the Plex Home of an owner
+func (f *Fake) RemoveHomeUser(ownerID, userID int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.homes[ownerID], userID)
+}
+
+// ApprovePin completes the authentication of a PIN for an account,
+// as if the user had signed in on app.plex.tv
+func (f *Fake) ApprovePin(pinID, userID int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pin, ok := f.pins[pinID]
+	if !ok {
+		return false
+	}
+	if _, ok := f.users[userID]; !ok {
+		return false
+	}
+	pin.AuthToken = f.issueToken(userID)
+	return true
+}
+
+// Pin returns a PIN created through the API
+func (f *Fake) Pin(pinID int) (Pin, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pin, ok := f.pins[pinID]
+	if !ok {
+		return Pin{}, false
+	}
+	return *pin, true
+}
+
+// SetPinTTL changes how long new PINs stay valid
+func (f *Fake) SetPinTTL(ttl time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pinTTL = ttl
+}
+
+// SetLatency delays every response
+func (f *Fake) SetLatency(latency time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = latency
+}
+
+// InjectError makes the next times requests whose path starts with pathPrefix
+// fail with status. A times <= 0 keeps failing until ClearErrors.
+// A 429 status comes with a one second Retry-After header.
+func (f *Fake) InjectError(pathPrefix string, status, times int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors = append(f.errors, &injectedError{
+		pathPrefix: pathPrefix,
+		status:     status,
+		remaining:  times,
+	})
+}
+
+// ClearErrors removes every injected error
+func (f *Fake) ClearErrors() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors = nil
+}
+
+// Requests returns the number of requests received for a path,
+// or for every path if path is empty
+func (f *Fake) Requests(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if path != "" {
+		return f.requests[path]
+	}
+
+	total := 0
+	for _, count := range f.requests {
+		total += count
+	}
+	return total
+}
+
+// ResetRequests resets the request counters
+func (f *Fake) ResetRequests() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = make(map[string]int)
+}
+
+// EnableControlAPI exposes the scripting methods over HTTP under /__plextest/,
+// for driving the fake from outside the process
+func (f *Fake) EnableControlAPI() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.controlAPI = true
+}
+
+// ServeHTTP implements http.Handler
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, controlPrefix) {
+		f.mu.Lock()
+		enabled := f.controlAPI
+		f.mu.Unlock()
+		if enabled {
+			f.serveControl(w, r)
+			return
+		}
+	}
+
+	latency, status := f.beforeRequest(r.URL.Path)
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != 0 {
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.WriteHeader(status)
+		return
+	}
+
+	f.serveAPI(w, r)
+}
+
+// beforeRequest counts the request and returns the latency and injected error to apply
+func (f *Fake) beforeRequest(path string) (time.Duration, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests[path]++
+
+	for i, injected := range f.errors {
+		if !strings.HasPrefix(path, injected.pathPrefix) {
+			continue
+		}
+		if injected.remaining > 0 {
+			injected.remaining--
+			if injected.remaining == 0 {
+				f.errors = append(f.errors[:i], f.errors[i+1:]...)
+			}
+		}
+		return f.latency, injected.status
+	}
+
+	return f.latency, 0
+}
+
+// issueToken creates a new token for an account
+// Must be called with lock held
+func (f *Fake) issueToken(userID int) string {
+	token := randomString(10)
+	f.tokens[token] = userID
+	return token
+}
+
+// userForToken returns the account owning a token
+// Must be called with lock held
+func (f *Fake) userForToken(token string) (*User, bool) {
+	userID, ok := f.tokens[token]
+	if !ok {
+		return nil, false
+	}
+	user, ok := f.users[userID]
+	return user, ok
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
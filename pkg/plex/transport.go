@@ -0,0 +1,123 @@
+package plex
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Options configures timeouts and retries of the Plex API client
+type Options struct {
+	// RequestTimeout bounds a single HTTP attempt to the Plex API
+	RequestTimeout time.Duration
+	// MaxRetries is the number of times an idempotent call is retried
+	// after a network error or a 5xx response
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled after each attempt
+	RetryBackoff time.Duration
+	// Breaker configures the circuit breaker around Plex API calls
+	Breaker BreakerOptions
+}
+
+// DefaultOptions returns the options used by NewClient
+func DefaultOptions() Options {
+	return Options{
+		RequestTimeout: 10 * time.Second,
+		MaxRetries:     2,
+		RetryBackoff:   200 * time.Millisecond,
+		Breaker:        DefaultBreakerOptions(),
+	}
+}
+
+// DefaultBreakerOptions returns the circuit breaker options used by NewClient
+func DefaultBreakerOptions() BreakerOptions {
+	return BreakerOptions{
+		ConsecutiveFailures: 5,
+		FailureRate:         0.5,
+		MinRequests:         20,
+		Window:              time.Minute,
+		OpenTimeout:         30 * time.Second,
+		HalfOpenProbes:      1,
+	}
+}
+
+// BreakerStats returns the current state of the circuit breaker
+func (c *Client) BreakerStats() BreakerStats {
+	return c.breaker.stats()
+}
+
+// do sends a request, bounding each attempt by the request timeout and retrying
+// idempotent requests with exponential backoff on network errors and 5xx responses.
+// The request context cancels all attempts, including the backoff waits.
+// Every attempt goes through the circuit breaker, which fails fast with
+// ErrCircuitOpen while Plex is considered down.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	attempts := 1
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		attempts += c.options.MaxRetries
+	}
+
+	backoff := c.options.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		if err := c.breaker.allow(); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.attempt(req)
+
+		retryable := err != nil || resp.StatusCode >= http.StatusInternalServerError
+		if err != nil && ctx.Err() != nil {
+			// The caller gave up, this says nothing about the health of Plex
+			c.breaker.release()
+		} else {
+			c.breaker.record(!retryable && resp.StatusCode != http.StatusTooManyRequests)
+		}
+		if !retryable || attempt >= attempts || ctx.Err() != nil {
+			if err != nil {
+				return nil, &RequestError{Err: err}
+			}
+			return resp, nil
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, &RequestError{Err: ctx.Err()}
+		}
+		backoff *= 2
+	}
+}
+
+// attempt sends a single HTTP request bounded by the request timeout
+func (c *Client) attempt(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), c.options.RequestTimeout)
+
+	resp, err := c.httpClient.Do(req.Clone(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The timeout also covers reading the body, so release it on close
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels the attempt context once the response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}